@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"database/sql"
 	"encoding/csv"
 	"errors"
 	"fmt"
@@ -66,11 +67,24 @@ func main() {
 		logrus.WithError(err).Fatal("write csv header")
 	}
 
+	// optionally, also write the bars to an archive for backtesting
+	var archive *db.ArchiveWriter
+	if dir := os.Getenv("ARCHIVE_DIR"); dir != "" {
+		archive = db.NewArchiveWriter(dir)
+	}
+
 	store.Range(func(a globals.Aggregate) bool {
 		if a.Open == 0 || a.High == 0 || a.Low == 0 || a.Close == 0 || a.Volume == 0 {
 			return true
 		}
 
+		if archive != nil {
+			if err := archive.Add(a); err != nil {
+				logrus.WithError(err).Fatal("add to archive")
+				return false
+			}
+		}
+
 		a.Timestamp = a.StartTimestamp
 		buf, err := a.MarshalCSV()
 		if err != nil {
@@ -85,6 +99,50 @@ func main() {
 
 		return true
 	})
+
+	if archive != nil {
+		if err := archive.Flush(); err != nil {
+			logrus.WithError(err).Fatal("write archive")
+		}
+	}
+
+	// optionally, also load the bars into a partitioned Postgres table
+	if url := os.Getenv("POSTGRES_URL"); url != "" {
+		if err := loadPostgres(context.Background(), url, store); err != nil {
+			logrus.WithError(err).Fatal("load postgres")
+		}
+	}
+}
+
+func loadPostgres(ctx context.Context, url string, store *db.NativeDB) error {
+	sqlDB, err := sql.Open("postgres", url)
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	pg, err := db.NewSQL(sqlDB, db.WithDailyPartitions(0))
+	if err != nil {
+		return fmt.Errorf("create table: %w", err)
+	}
+
+	start := time.Now()
+	n, err := pg.BulkLoad(ctx, func(fn func(globals.Aggregate) bool) {
+		store.Range(func(a globals.Aggregate) bool {
+			if a.Open == 0 || a.High == 0 || a.Low == 0 || a.Close == 0 || a.Volume == 0 {
+				return true
+			}
+
+			return fn(a)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("loaded %d bars into postgres in %v", n, time.Since(start).Round(time.Millisecond))
+
+	return nil
 }
 
 type CSVUnmarshaler interface {
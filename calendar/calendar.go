@@ -0,0 +1,286 @@
+// Package calendar describes when a market trades: its trading days, holidays and early closes,
+// and the pre-market, regular and after-hours sessions of each trading day.
+//
+// Calendars are data rather than code, loaded from versioned JSON or YAML files, so that new holidays
+// don't require a release; see nyse.yaml for the format, and for the calendar in NYSE.
+package calendar
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"time"
+	// so that calendars, and the market timezones of package db, can be loaded on hosts without a timezone database
+	_ "time/tzdata"
+
+	"github.com/suremarc/go-lib-aggregates/internal/config"
+)
+
+// Session is the part of a trading day that a time, or a bar, falls in.
+type Session string
+
+const (
+	SessionClosed     Session = "closed"
+	SessionPreMarket  Session = "pre"
+	SessionRegular    Session = "regular"
+	SessionAfterHours Session = "after"
+	// SessionMixed tags bars that span more than one session, such as daily bars.
+	SessionMixed Session = "mixed"
+)
+
+// Hours are the local times, in HH:MM format, at which the sessions of a trading day start and end.
+// The pre-market runs from PreMarketOpen to RegularOpen, and after-hours from RegularClose to AfterHoursClose.
+type Hours struct {
+	PreMarketOpen   string `json:"preMarketOpen" yaml:"preMarketOpen"`
+	RegularOpen     string `json:"regularOpen" yaml:"regularOpen"`
+	RegularClose    string `json:"regularClose" yaml:"regularClose"`
+	AfterHoursClose string `json:"afterHoursClose" yaml:"afterHoursClose"`
+}
+
+// Calendar is the trading calendar of a market. Weekdays trade during Hours, except for Holidays,
+// when the market is closed, and EarlyCloses, which trade during EarlyCloseHours.
+// Both are keyed by date, in YYYY-MM-DD format, and hold a description of the day.
+//
+// Dates past the last holiday listed are assumed to be regular trading days, so calendars must be kept up to date.
+type Calendar struct {
+	// Version is the version of the file format, which must be FormatVersion.
+	Version int    `json:"version" yaml:"version"`
+	Name    string `json:"name" yaml:"name"`
+	// Timezone is the IANA name of the timezone that the calendar's dates and times are local to.
+	Timezone string `json:"timezone" yaml:"timezone"`
+
+	Hours           Hours `json:"hours" yaml:"hours"`
+	EarlyCloseHours Hours `json:"earlyCloseHours" yaml:"earlyCloseHours"`
+
+	Holidays    map[string]string `json:"holidays" yaml:"holidays"`
+	EarlyCloses map[string]string `json:"earlyCloses" yaml:"earlyCloses"`
+
+	location        *time.Location
+	hours           sessionTimes
+	earlyCloseHours sessionTimes
+}
+
+// FormatVersion is the only version of the file format supported.
+const FormatVersion = 1
+
+// ErrInvalidCalendar is returned when a calendar can't be parsed.
+var ErrInvalidCalendar = errors.New("invalid calendar")
+
+//go:embed nyse.yaml
+var nyse []byte
+
+// NYSE is the calendar of the NYSE and Nasdaq, which share their holidays and hours: pre-market from 4:00 to 9:30,
+// regular hours until 16:00, or 13:00 on early closes, and after-hours until 20:00, or 17:00 on early closes.
+var NYSE = mustParse(nyse)
+
+// TradingDay holds the times at which the sessions of a trading day start and end.
+type TradingDay struct {
+	PreMarketOpen   time.Time
+	RegularOpen     time.Time
+	RegularClose    time.Time
+	AfterHoursClose time.Time
+
+	EarlyClose bool
+}
+
+// Location returns the timezone that the calendar's dates and times are local to.
+func (c *Calendar) Location() *time.Location {
+	return c.location
+}
+
+// RegularOpen returns the local time of day of the regular open, e.g. 9h30m.
+func (c *Calendar) RegularOpen() time.Duration {
+	return c.hours.regularOpen.sinceMidnight()
+}
+
+// Holiday returns the description of the holiday on t's local date, if it is one.
+func (c *Calendar) Holiday(t time.Time) (string, bool) {
+	name, ok := c.Holidays[c.date(t)]
+	return name, ok
+}
+
+// IsTradingDay reports whether the market trades on t's local date.
+func (c *Calendar) IsTradingDay(t time.Time) bool {
+	_, ok := c.TradingDay(t)
+	return ok
+}
+
+// TradingDay returns the sessions of the trading day on t's local date, or false if the market doesn't trade that day.
+func (c *Calendar) TradingDay(t time.Time) (TradingDay, bool) {
+	t = t.In(c.location)
+	if weekday := t.Weekday(); weekday == time.Saturday || weekday == time.Sunday {
+		return TradingDay{}, false
+	}
+
+	date := c.date(t)
+	if _, ok := c.Holidays[date]; ok {
+		return TradingDay{}, false
+	}
+
+	hours := c.hours
+	_, early := c.EarlyCloses[date]
+	if early {
+		hours = c.earlyCloseHours
+	}
+
+	year, month, day := t.Date()
+	at := func(clock clock) time.Time {
+		return time.Date(year, month, day, clock.hour, clock.minute, 0, 0, c.location)
+	}
+
+	return TradingDay{
+		PreMarketOpen:   at(hours.preMarketOpen),
+		RegularOpen:     at(hours.regularOpen),
+		RegularClose:    at(hours.regularClose),
+		AfterHoursClose: at(hours.afterHoursClose),
+		EarlyClose:      early,
+	}, true
+}
+
+// Session returns the session that t falls in.
+func (c *Calendar) Session(t time.Time) Session {
+	day, ok := c.TradingDay(t)
+	switch {
+	case !ok, t.Before(day.PreMarketOpen):
+		return SessionClosed
+	case t.Before(day.RegularOpen):
+		return SessionPreMarket
+	case t.Before(day.RegularClose):
+		return SessionRegular
+	case t.Before(day.AfterHoursClose):
+		return SessionAfterHours
+	default:
+		return SessionClosed
+	}
+}
+
+// BarSession returns the session of a bar from start to end: the session it falls in entirely,
+// or SessionMixed if it spans more than one.
+func (c *Calendar) BarSession(start, end time.Time) Session {
+	session := c.Session(start)
+	for t := c.nextBoundary(start); t.Before(end); t = c.nextBoundary(t) {
+		if c.Session(t) != session {
+			return SessionMixed
+		}
+	}
+
+	return session
+}
+
+// nextBoundary returns the first time after t at which the session may change:
+// the next start or end of a session on t's local date, or else the next local midnight.
+func (c *Calendar) nextBoundary(t time.Time) time.Time {
+	t = t.In(c.location)
+	if day, ok := c.TradingDay(t); ok {
+		for _, boundary := range []time.Time{day.PreMarketOpen, day.RegularOpen, day.RegularClose, day.AfterHoursClose} {
+			if boundary.After(t) {
+				return boundary
+			}
+		}
+	}
+
+	year, month, day := t.Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, c.location)
+}
+
+func (c *Calendar) date(t time.Time) string {
+	return t.In(c.location).Format(dateLayout)
+}
+
+const dateLayout = "2006-01-02"
+
+// Parse parses a calendar in YAML.
+func Parse(data []byte) (*Calendar, error) {
+	return config.Parse(data, config.YAML, ErrInvalidCalendar, (*Calendar).validate)
+}
+
+// ParseJSON parses a calendar in JSON.
+func ParseJSON(data []byte) (*Calendar, error) {
+	return config.Parse(data, config.JSON, ErrInvalidCalendar, (*Calendar).validate)
+}
+
+// Load reads a calendar from a JSON or YAML file, depending on its extension.
+func Load(path string) (*Calendar, error) {
+	return config.Load(path, ErrInvalidCalendar, (*Calendar).validate)
+}
+
+func (c *Calendar) validate() error {
+	if c.Version != FormatVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidCalendar, c.Version)
+	}
+
+	var err error
+	if c.location, err = time.LoadLocation(c.Timezone); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCalendar, err)
+	}
+
+	if c.hours, err = parseHours(c.Hours); err != nil {
+		return fmt.Errorf("%w: hours: %v", ErrInvalidCalendar, err)
+	}
+
+	if c.earlyCloseHours, err = parseHours(c.EarlyCloseHours); err != nil {
+		return fmt.Errorf("%w: early close hours: %v", ErrInvalidCalendar, err)
+	}
+
+	for _, dates := range []map[string]string{c.Holidays, c.EarlyCloses} {
+		for date := range dates {
+			if _, err := time.Parse(dateLayout, date); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidCalendar, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// clock is a local time of day.
+type clock struct {
+	hour, minute int
+}
+
+func (c clock) sinceMidnight() time.Duration {
+	return time.Duration(c.hour)*time.Hour + time.Duration(c.minute)*time.Minute
+}
+
+func (c clock) before(other clock) bool {
+	return c.hour < other.hour || c.hour == other.hour && c.minute < other.minute
+}
+
+type sessionTimes struct {
+	preMarketOpen, regularOpen, regularClose, afterHoursClose clock
+}
+
+func parseHours(hours Hours) (sessionTimes, error) {
+	var times sessionTimes
+	for _, field := range []struct {
+		value string
+		dst   *clock
+	}{
+		{hours.PreMarketOpen, &times.preMarketOpen},
+		{hours.RegularOpen, &times.regularOpen},
+		{hours.RegularClose, &times.regularClose},
+		{hours.AfterHoursClose, &times.afterHoursClose},
+	} {
+		t, err := time.Parse("15:04", field.value)
+		if err != nil {
+			return times, err
+		}
+
+		*field.dst = clock{hour: t.Hour(), minute: t.Minute()}
+	}
+
+	if times.regularOpen.before(times.preMarketOpen) || !times.regularOpen.before(times.regularClose) || times.afterHoursClose.before(times.regularClose) {
+		return times, errors.New("sessions are out of order")
+	}
+
+	return times, nil
+}
+
+func mustParse(data []byte) *Calendar {
+	c, err := Parse(data)
+	if err != nil {
+		panic(err)
+	}
+
+	return c
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suremarc/go-lib-aggregates/db"
+	"github.com/suremarc/go-lib-aggregates/internal/backend"
+)
+
+// check compares the aggregates in two backends, given as URLs (see backend.Open), and writes a JSON report
+// of the missing, extra and divergent bars. It exits with status 1 if the backends disagree, so it can run as a nightly job.
+func main() {
+	var (
+		expected   = flag.String("expected", "", "URL of the backend holding the reference bars")
+		actual     = flag.String("actual", "", "URL of the backend to check")
+		tickers    = flag.String("tickers", "", "comma-separated tickers to compare (default all)")
+		barLengths = flag.String("bar-lengths", "", "comma-separated bar lengths to compare, e.g. min,day (default all)")
+		from       = flag.String("from", "", "compare bars starting at or after this date or RFC 3339 time")
+		to         = flag.String("to", "", "compare bars starting before this date or RFC 3339 time")
+		tolerance  = flag.Float64("tolerance", 1e-9, "relative difference allowed between prices and volumes")
+		out        = flag.String("out", "", "file to write the report to (default stdout)")
+	)
+	flag.Parse()
+
+	filter, err := backend.ParseFilter(*tickers, *barLengths, *from, *to)
+	if err != nil {
+		logrus.WithError(err).Fatal("parse filter")
+	}
+
+	want, err := backend.Open(*expected)
+	if err != nil {
+		logrus.WithError(err).Fatal("open expected")
+	}
+	defer want.Close()
+
+	got, err := backend.Open(*actual)
+	if err != nil {
+		logrus.WithError(err).Fatal("open actual")
+	}
+	defer got.Close()
+
+	report, err := db.Check(context.Background(), want.Source, got.Source, db.CheckOptions{
+		Filter:    filter,
+		Tolerance: *tolerance,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("check")
+	}
+
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		logrus.WithError(err).Fatal("marshal report")
+	}
+	buf = append(buf, '\n')
+
+	if *out == "" {
+		_, err = os.Stdout.Write(buf)
+	} else {
+		err = os.WriteFile(*out, buf, 0o644)
+	}
+	if err != nil {
+		logrus.WithError(err).Fatal("write report")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"compared":  report.Compared,
+		"matched":   report.Matched,
+		"missing":   len(report.Missing),
+		"extra":     len(report.Extra),
+		"divergent": len(report.Divergent),
+	}).Info("check finished")
+
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
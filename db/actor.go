@@ -0,0 +1,261 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/ptime"
+)
+
+// UpdateFunc computes the new value of an aggregate, and of its state, from their current values.
+// The state is nil for a new bar. The function may modify the state in place and return it.
+type UpdateFunc func(aggregate globals.Aggregate, state []byte) (globals.Aggregate, []byte)
+
+// ActorDB is an in-memory store in which every ticker is owned by exactly one goroutine (a shard).
+// Updates are sent to the owning shard as messages and applied one at a time, so no locks are taken
+// on the hot path, and updates for a ticker are applied in the order they were sent.
+// Unlike NativeDB, ActorDB does not implement DB, since it has no notion of a transaction;
+// instead, each read-modify-write is expressed as a single UpdateFunc.
+type ActorDB struct {
+	shards []*actorShard
+	wg     sync.WaitGroup
+}
+
+type actorShard struct {
+	inbox chan actorMessage
+	data  map[index]actorEntry
+	ttl   map[BarLength]time.Duration
+}
+
+type actorEntry struct {
+	aggregate   globals.Aggregate
+	state       []byte
+	lastUpdated time.Time
+}
+
+type actorMessage struct {
+	// exactly one of update and rangeFn is set
+	update  *actorUpdate
+	rangeFn func(globals.Aggregate) bool
+	done    chan struct{}
+}
+
+type actorResult struct {
+	aggregate globals.Aggregate
+	updated   bool
+	err       error
+}
+
+type actorUpdate struct {
+	ticker    string
+	timestamp ptime.INanoseconds
+	barLength BarLength
+	fn        UpdateFunc
+	reply     func(agg globals.Aggregate, updated bool, err error)
+}
+
+// NewActorDB starts an ActorDB with the given number of shards, each with an inbox of the given size.
+// If ttl is set, aggregates expire on the same schedule as NativeDB.
+// Close must be called to stop the shard goroutines.
+func NewActorDB(shards, inboxSize int, ttl bool) *ActorDB {
+	if shards < 1 {
+		shards = 1
+	}
+
+	a := &ActorDB{
+		shards: make([]*actorShard, shards),
+	}
+
+	for i := range a.shards {
+		shard := &actorShard{
+			inbox: make(chan actorMessage, inboxSize),
+			data:  make(map[index]actorEntry),
+		}
+
+		var flushTicker *time.Ticker
+		if ttl {
+			shard.ttl = map[BarLength]time.Duration{
+				BarLengthSecond: time.Minute * 15,
+				BarLengthMinute: time.Minute * 15,
+				BarLengthHour:   time.Hour,
+				BarLengthDay:    time.Hour * 24,
+				BarLengthWeek:   time.Hour * 24 * 7,
+			}
+			flushTicker = time.NewTicker(time.Minute * 15)
+		}
+
+		a.shards[i] = shard
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			shard.run(flushTicker)
+		}()
+	}
+
+	return a
+}
+
+// Update applies fn to the aggregate with the given ticker and bar length that contains the requested timestamp,
+// and waits for the result. updated reports whether fn changed the aggregate.
+func (a *ActorDB) Update(ctx context.Context, ticker string, timestamp ptime.INanoseconds, barLength BarLength, fn UpdateFunc) (globals.Aggregate, bool, error) {
+	results := make(chan actorResult, 1)
+	if err := a.Send(ctx, ticker, timestamp, barLength, fn, func(agg globals.Aggregate, updated bool, err error) {
+		results <- actorResult{aggregate: agg, updated: updated, err: err}
+	}); err != nil {
+		return globals.Aggregate{}, false, err
+	}
+
+	select {
+	case result := <-results:
+		return result.aggregate, result.updated, result.err
+	case <-ctx.Done():
+		return globals.Aggregate{}, false, ctx.Err()
+	}
+}
+
+// Send enqueues an update without waiting for it to be applied. reply, if not nil, is called
+// from the shard goroutine once the update is applied, so it must not block for long.
+// Updates sent from a single goroutine are applied in the order they were sent.
+// Send only blocks if the owning shard's inbox is full, in which case it returns ctx.Err() if ctx is done first.
+func (a *ActorDB) Send(ctx context.Context, ticker string, timestamp ptime.INanoseconds, barLength BarLength, fn UpdateFunc, reply func(agg globals.Aggregate, updated bool, err error)) error {
+	msg := actorMessage{update: &actorUpdate{
+		ticker:    ticker,
+		timestamp: timestamp,
+		barLength: barLength,
+		fn:        fn,
+		reply:     reply,
+	}}
+
+	select {
+	case a.shardFor(ticker).inbox <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Range calls fn on every aggregate, one shard at a time. Each shard is paused while fn is iterating over it.
+func (a *ActorDB) Range(fn func(globals.Aggregate) bool) {
+	for _, shard := range a.shards {
+		stopped := false
+		done := make(chan struct{})
+		shard.inbox <- actorMessage{
+			rangeFn: func(agg globals.Aggregate) bool {
+				if !fn(agg) {
+					stopped = true
+					return false
+				}
+
+				return true
+			},
+			done: done,
+		}
+		<-done
+
+		if stopped {
+			return
+		}
+	}
+}
+
+// Close stops every shard after draining its inbox. No messages may be sent after Close is called.
+func (a *ActorDB) Close() {
+	for _, shard := range a.shards {
+		close(shard.inbox)
+	}
+
+	a.wg.Wait()
+}
+
+func (a *ActorDB) shardFor(ticker string) *actorShard {
+	// inlined FNV-1a, to avoid allocating a hash.Hash for every message
+	h := uint32(2166136261)
+	for i := 0; i < len(ticker); i++ {
+		h ^= uint32(ticker[i])
+		h *= 16777619
+	}
+
+	return a.shards[h%uint32(len(a.shards))]
+}
+
+func (s *actorShard) run(flushTicker *time.Ticker) {
+	var flush <-chan time.Time
+	if flushTicker != nil {
+		defer flushTicker.Stop()
+		flush = flushTicker.C
+	}
+
+	for {
+		select {
+		case msg, ok := <-s.inbox:
+			if !ok {
+				return
+			}
+
+			if msg.update != nil {
+				s.apply(msg.update)
+				continue
+			}
+
+			for _, entry := range s.data {
+				if !msg.rangeFn(entry.aggregate) {
+					break
+				}
+			}
+			close(msg.done)
+		case <-flush:
+			s.flush()
+		}
+	}
+}
+
+func (s *actorShard) apply(u *actorUpdate) {
+	barLength, err := resolveBarLength(u.ticker, u.barLength)
+	if err != nil {
+		if u.reply != nil {
+			u.reply(globals.Aggregate{}, false, err)
+		}
+
+		return
+	}
+
+	index := index{
+		ticker:    u.ticker,
+		timestamp: snapTimestamp(u.ticker, u.timestamp, barLength),
+		barLength: barLength,
+	}
+
+	entry, ok := s.data[index]
+	if !ok {
+		entry.aggregate = globals.Aggregate{
+			Ticker:         index.ticker,
+			Timestamp:      index.timestamp,
+			StartTimestamp: index.timestamp,
+			EndTimestamp:   barEnd(index.ticker, index.timestamp, index.barLength),
+		}
+	}
+
+	newAggregate, newState := u.fn(entry.aggregate, entry.state)
+	updated := newAggregate != entry.aggregate
+
+	s.data[index] = actorEntry{
+		aggregate:   newAggregate,
+		state:       newState,
+		lastUpdated: time.Now(),
+	}
+
+	if u.reply != nil {
+		u.reply(newAggregate, updated, nil)
+	}
+}
+
+func (s *actorShard) flush() {
+	for index, entry := range s.data {
+		ttl, ok := lookupTTL(s.ttl, index.barLength)
+		if ok && time.Since(entry.lastUpdated) > ttl {
+			delete(s.data, index)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/polygon-io/ptime"
+	"github.com/suremarc/go-lib-aggregates/calendar"
+)
+
+// AssetClass is the kind of market a ticker trades in, which decides the timezone in which its bars are aligned.
+type AssetClass string
+
+const (
+	AssetClassStocks  AssetClass = "stocks"
+	AssetClassOptions AssetClass = "options"
+	AssetClassIndices AssetClass = "indices"
+	AssetClassForex   AssetClass = "fx"
+	AssetClassCrypto  AssetClass = "crypto"
+)
+
+// AssetClassOf infers the asset class of a ticker from its prefix, e.g. X: for crypto. Tickers without one are stocks.
+func AssetClassOf(ticker string) AssetClass {
+	switch {
+	case strings.HasPrefix(ticker, "O:"):
+		return AssetClassOptions
+	case strings.HasPrefix(ticker, "I:"):
+		return AssetClassIndices
+	case strings.HasPrefix(ticker, "C:"):
+		return AssetClassForex
+	case strings.HasPrefix(ticker, "X:"):
+		return AssetClassCrypto
+	default:
+		return AssetClassStocks
+	}
+}
+
+var newYork = mustLoadLocation("America/New_York")
+
+// MarketTimezones are the timezones in which the hour, day and week bars of each asset class are aligned,
+// so that they line up with local trading days, across DST transitions. Asset classes missing from it are aligned
+// in UTC. It must not be modified while any store is in use, since bars would no longer be found under their keys.
+var MarketTimezones = map[AssetClass]*time.Location{
+	AssetClassStocks:  newYork,
+	AssetClassOptions: newYork,
+	AssetClassIndices: newYork,
+}
+
+func marketTimezone(ticker string) *time.Location {
+	if loc, ok := MarketTimezones[AssetClassOf(ticker)]; ok {
+		return loc
+	}
+
+	return time.UTC
+}
+
+// MarketCalendars are the trading calendars of the asset classes whose bars are tagged with the session they fall in
+// (see BarKey.Session). Asset classes missing from it, such as crypto, trade around the clock.
+var MarketCalendars = map[AssetClass]*calendar.Calendar{
+	AssetClassStocks:  calendar.NYSE,
+	AssetClassOptions: calendar.NYSE,
+}
+
+// MarketCalendar returns the trading calendar of a ticker's asset class, or nil if it trades around the clock.
+func MarketCalendar(ticker string) *calendar.Calendar {
+	return MarketCalendars[AssetClassOf(ticker)]
+}
+
+// BarBounds returns the bounds of the bar of a ticker with the given length that contains ts.
+// Second and minute bars are aligned in UTC, which every timezone agrees with; longer bars are aligned in the
+// ticker's market timezone: hour bars on the hour, day bars at midnight, week bars at midnight on Monday,
+// and the bars of a BarSpec to its anchor. Day and week bars are an hour shorter or longer across DST transitions.
+func BarBounds(ticker string, ts ptime.INanoseconds, barLength BarLength) (start, end ptime.IMilliseconds, err error) {
+	switch barLength {
+	case BarLengthSecond, BarLengthMinute:
+		duration, _ := getBarLengthDuration(barLength)
+		start = ptime.IMillisecondsFromDuration(ts.ToDuration().Truncate(duration))
+		return start, start + ptime.IMillisecondsFromDuration(duration), nil
+	}
+
+	t := time.Unix(0, int64(ts)).In(marketTimezone(ticker))
+	year, month, day := t.Date()
+
+	var from, to time.Time
+	switch barLength {
+	case BarLengthDay:
+		from = time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+		to = time.Date(year, month, day+1, 0, 0, 0, 0, t.Location())
+	case BarLengthWeek:
+		// weeks start on Monday
+		day -= (int(t.Weekday()) + 6) % 7
+		from = time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+		to = time.Date(year, month, day+7, 0, 0, 0, 0, t.Location())
+	default:
+		resolved, err := resolveBarLength(ticker, barLength)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		// hour bars are the bars of an hour long spec aligned to midnight
+		spec, err := ParseBarSpec(resolved)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		// since bars divide an hour, truncating the local time, rather than constructing it, keeps the repeated hour
+		// of a DST transition apart, and every bar is as long as its spec
+		offset := (timeOfDay(t) - spec.Offset) % spec.Length
+		if offset < 0 {
+			offset += spec.Length
+		}
+
+		from = t.Add(-offset)
+		to = from.Add(spec.Length)
+	}
+
+	return ptime.IMillisecondsFromTime(from), ptime.IMillisecondsFromTime(to), nil
+}
+
+// BarSpec describes intraday bars aligned to an anchor in the ticker's market timezone: midnight, the regular open
+// of its market, or any other time of day, e.g. 30-minute or hourly bars starting at 9:30. Its bar length can be used
+// with every store, which stores its bars under the bar length of the spec resolved for the ticker (see resolveBarLength).
+type BarSpec struct {
+	// Length must be a whole number of minutes that divides an hour.
+	Length time.Duration
+	// Offset is the local time of day that bars are aligned to, in whole minutes. The zero value is midnight.
+	Offset time.Duration
+	// SessionOpen aligns bars to the regular open of the ticker's market calendar instead (see MarketCalendars),
+	// e.g. 9:30 for stocks. Bars of tickers without a calendar are aligned to Offset.
+	SessionOpen bool
+}
+
+// BarLength encodes the spec as a bar length, e.g. "30m" for 30-minute bars aligned to midnight,
+// "60m@open" for hourly bars aligned to the regular open, and "60m@0930" for hourly bars aligned to 9:30.
+func (s BarSpec) BarLength() (BarLength, error) {
+	if err := s.validate(); err != nil {
+		return "", err
+	}
+
+	minutes := int(s.Length / time.Minute)
+	switch {
+	case s.SessionOpen:
+		return BarLength(fmt.Sprintf("%dm@open", minutes)), nil
+	case s.Offset != 0:
+		return BarLength(fmt.Sprintf("%dm@%02d%02d", minutes, s.Offset/time.Hour, s.Offset%time.Hour/time.Minute)), nil
+	default:
+		return BarLength(fmt.Sprintf("%dm", minutes)), nil
+	}
+}
+
+func (s BarSpec) validate() error {
+	if s.Length < time.Minute || s.Length%time.Minute != 0 || time.Hour%s.Length != 0 {
+		return fmt.Errorf("%w: %s isn't a whole number of minutes that divides an hour", ErrInvalidBarLength, s.Length)
+	}
+
+	if s.Offset < 0 || s.Offset >= 24*time.Hour || s.Offset%time.Minute != 0 {
+		return fmt.Errorf("%w: %s isn't a whole number of minutes within a day", ErrInvalidBarLength, s.Offset)
+	}
+
+	return nil
+}
+
+// ParseBarSpec parses a bar length encoded by BarSpec.BarLength. Minute and hour bars are the specs
+// of such bars aligned to midnight.
+func ParseBarSpec(barLength BarLength) (BarSpec, error) {
+	switch barLength {
+	case BarLengthMinute:
+		return BarSpec{Length: time.Minute}, nil
+	case BarLengthHour:
+		return BarSpec{Length: time.Hour}, nil
+	}
+
+	length, anchor, anchored := strings.Cut(string(barLength), "@")
+	minutes, err := strconv.Atoi(strings.TrimSuffix(length, "m"))
+	if err != nil || !strings.HasSuffix(length, "m") {
+		return BarSpec{}, fmt.Errorf("%w: %q", ErrInvalidBarLength, barLength)
+	}
+
+	spec := BarSpec{Length: time.Duration(minutes) * time.Minute}
+	switch {
+	case !anchored:
+	case anchor == "open":
+		spec.SessionOpen = true
+	default:
+		hhmm, err := strconv.Atoi(anchor)
+		if err != nil || len(anchor) != 4 || hhmm%100 >= 60 {
+			return BarSpec{}, fmt.Errorf("%w: %q", ErrInvalidBarLength, barLength)
+		}
+
+		spec.Offset = time.Duration(hhmm/100)*time.Hour + time.Duration(hhmm%100)*time.Minute
+	}
+
+	return spec, spec.validate()
+}
+
+// resolveBarLength returns the bar length under which the bars of a ticker with the given length are stored,
+// which is also the one barLengthFromBounds infers from their bounds. Bar specs that produce the same bars for
+// the ticker resolve to the same bar length: minute and hour bars for bars aligned to the hour, or else the spec
+// aligned to the earliest time of day on the same grid. For stocks, "60m@open" and "60m@0930" both resolve to
+// "60m@0030", and "30m@open" resolves to "30m".
+func resolveBarLength(ticker string, barLength BarLength) (BarLength, error) {
+	switch barLength {
+	case BarLengthSecond, BarLengthMinute, BarLengthHour, BarLengthDay, BarLengthWeek:
+		return barLength, nil
+	}
+
+	spec, err := ParseBarSpec(barLength)
+	if err != nil {
+		return "", err
+	}
+
+	offset := spec.Offset
+	if c := MarketCalendar(ticker); spec.SessionOpen && c != nil {
+		offset = c.RegularOpen()
+	}
+
+	return alignedBarLength(spec.Length, offset%spec.Length)
+}
+
+// alignedBarLength returns the resolved bar length of bars of the given length that start offset past the hour.
+func alignedBarLength(length, offset time.Duration) (BarLength, error) {
+	switch {
+	case offset == 0 && length == time.Minute:
+		return BarLengthMinute, nil
+	case offset == 0 && length == time.Hour:
+		return BarLengthHour, nil
+	default:
+		return BarSpec{Length: length, Offset: offset}.BarLength()
+	}
+}
+
+func timeOfDay(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+}
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+
+	return loc
+}
+
+// barEnd returns the end of the bar of a ticker with the given length that starts at start.
+// Callers validate the bar length.
+func barEnd(ticker string, start ptime.IMilliseconds, barLength BarLength) ptime.IMilliseconds {
+	_, end, _ := BarBounds(ticker, start.ToINanoseconds(), barLength)
+	return end
+}
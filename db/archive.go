@@ -0,0 +1,339 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/ptime"
+)
+
+// An archive is a read-only directory of historical bars, laid out as one file per ticker and bar length:
+//
+//	<dir>/<bar length>/<escaped ticker>.bars
+//
+// Each file starts with a header, followed by fixed-width records sorted by timestamp.
+// All integers are little-endian.
+//
+//	header (archiveHeaderSize bytes):
+//	  magic       [4]byte "AGGA"
+//	  version     uint16
+//	  record size uint16
+//	  bar length  uint8 (see barLengthID)
+//	  reserved    [7]byte
+//	record (archiveRecordSize bytes):
+//	  timestamp    int64
+//	  open, high, low, close, volume, vwap float64
+//	  transactions int64
+const (
+	archiveMagic      = "AGGA"
+	archiveVersion    = 1
+	archiveHeaderSize = 16
+	archiveRecordSize = 8 * 8
+	archiveExtension  = ".bars"
+)
+
+var ErrInvalidArchive = errors.New("invalid archive file")
+
+// Archive reads bars from an archive directory. Files are memory-mapped the first time they are scanned,
+// and stay mapped until Close is called, so files rewritten after that are not observed.
+type Archive struct {
+	dir string
+
+	mu    sync.Mutex
+	files map[string]*archiveFile
+}
+
+var _ Scanner = &Archive{}
+
+type archiveFile struct {
+	data    []byte
+	records []byte
+	mapped  bool
+}
+
+func OpenArchive(dir string) *Archive {
+	return &Archive{
+		dir:   dir,
+		files: make(map[string]*archiveFile),
+	}
+}
+
+// Scan implements Scanner. A ticker without a file has no bars.
+func (a *Archive) Scan(ctx context.Context, ticker string, barLength BarLength, from, to ptime.IMilliseconds, fn func(globals.Aggregate) bool) error {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		return err
+	}
+
+	f, err := a.open(archivePath(a.dir, ticker, barLength))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	n := len(f.records) / archiveRecordSize
+	i := sort.Search(n, func(i int) bool { return archiveTimestamp(f.records, i) >= from })
+	for ; i < n; i++ {
+		if i%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		ts := archiveTimestamp(f.records, i)
+		if ts >= to {
+			return nil
+		}
+
+		agg := globals.Aggregate{
+			Ticker:         ticker,
+			Timestamp:      ts,
+			StartTimestamp: ts,
+			EndTimestamp:   barEnd(ticker, ts, barLength),
+		}
+		decodeArchiveRecord(f.records[i*archiveRecordSize:], &agg)
+
+		if !fn(agg) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Close unmaps every file opened by the archive.
+func (a *Archive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var firstErr error
+	for path, f := range a.files {
+		if f.mapped {
+			if err := munmap(f.data); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		delete(a.files, path)
+	}
+
+	return firstErr
+}
+
+func (a *Archive) open(path string) (*archiveFile, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if f, ok := a.files[path]; ok {
+		return f, nil
+	}
+
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	info, err := fi.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() < archiveHeaderSize || (info.Size()-archiveHeaderSize)%archiveRecordSize != 0 {
+		return nil, fmt.Errorf("%w: %s has size %d", ErrInvalidArchive, path, info.Size())
+	}
+
+	data, mapped, err := mmap(fi, int(info.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("mmap %s: %w", path, err)
+	}
+
+	if err := checkArchiveHeader(data); err != nil {
+		if mapped {
+			munmap(data)
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	f := &archiveFile{
+		data:    data,
+		records: data[archiveHeaderSize:],
+		mapped:  mapped,
+	}
+	a.files[path] = f
+
+	return f, nil
+}
+
+// ArchiveWriter writes bars to an archive directory. Bars can be added in any order;
+// they are buffered in memory until Flush, which merges them into any existing files.
+// Added bars replace archived bars with the same timestamp.
+type ArchiveWriter struct {
+	dir    string
+	series map[diskSeries][]globals.Aggregate
+}
+
+func NewArchiveWriter(dir string) *ArchiveWriter {
+	return &ArchiveWriter{
+		dir:    dir,
+		series: make(map[diskSeries][]globals.Aggregate),
+	}
+}
+
+// Add buffers an aggregate to be written.
+func (w *ArchiveWriter) Add(agg globals.Aggregate) error {
+	barLength, err := getBarLength(agg)
+	if err != nil {
+		return err
+	}
+
+	key := diskSeries{ticker: agg.Ticker, barLength: barLength}
+	w.series[key] = append(w.series[key], agg)
+
+	return nil
+}
+
+// Flush writes every buffered aggregate. Each file is replaced atomically,
+// so readers see either the old or the new contents.
+func (w *ArchiveWriter) Flush() error {
+	for key, aggs := range w.series {
+		if err := w.writeSeries(key, aggs); err != nil {
+			return fmt.Errorf("write %s/%s: %w", key.ticker, key.barLength, err)
+		}
+
+		delete(w.series, key)
+	}
+
+	return nil
+}
+
+func (w *ArchiveWriter) writeSeries(key diskSeries, aggs []globals.Aggregate) error {
+	path := archivePath(w.dir, key.ticker, key.barLength)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	existing, err := readArchiveFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// stable, so that later additions win over earlier ones and over existing records
+	sort.SliceStable(aggs, func(i, j int) bool { return aggs[i].StartTimestamp < aggs[j].StartTimestamp })
+
+	buf := make([]byte, archiveHeaderSize, archiveHeaderSize+(len(existing)+len(aggs)*archiveRecordSize))
+	copy(buf, archiveMagic)
+	binary.LittleEndian.PutUint16(buf[4:], archiveVersion)
+	binary.LittleEndian.PutUint16(buf[6:], archiveRecordSize)
+	buf[8] = barLengthID(key.barLength)
+
+	// merge the existing records with the new ones
+	n := len(existing) / archiveRecordSize
+	i, j := 0, 0
+	for i < n || j < len(aggs) {
+		if j+1 < len(aggs) && aggs[j+1].StartTimestamp == aggs[j].StartTimestamp {
+			j++
+			continue
+		}
+
+		switch {
+		case j == len(aggs) || (i < n && archiveTimestamp(existing, i) < aggs[j].StartTimestamp):
+			buf = append(buf, existing[i*archiveRecordSize:(i+1)*archiveRecordSize]...)
+			i++
+		default:
+			if i < n && archiveTimestamp(existing, i) == aggs[j].StartTimestamp {
+				i++
+			}
+			buf = appendArchiveRecord(buf, aggs[j])
+			j++
+		}
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func archivePath(dir, ticker string, barLength BarLength) string {
+	return filepath.Join(dir, string(barLength), url.PathEscape(ticker)+archiveExtension)
+}
+
+// readArchiveFile reads the records of an archive file without mapping it.
+func readArchiveFile(path string) ([]byte, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	data, err := io.ReadAll(fi)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < archiveHeaderSize || (len(data)-archiveHeaderSize)%archiveRecordSize != 0 {
+		return nil, fmt.Errorf("%w: %s has size %d", ErrInvalidArchive, path, len(data))
+	}
+
+	if err := checkArchiveHeader(data); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return data[archiveHeaderSize:], nil
+}
+
+func checkArchiveHeader(data []byte) error {
+	if string(data[:4]) != archiveMagic {
+		return fmt.Errorf("%w: bad magic", ErrInvalidArchive)
+	}
+
+	if v := binary.LittleEndian.Uint16(data[4:]); v != archiveVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidArchive, v)
+	}
+
+	if size := binary.LittleEndian.Uint16(data[6:]); size != archiveRecordSize {
+		return fmt.Errorf("%w: unexpected record size %d", ErrInvalidArchive, size)
+	}
+
+	return nil
+}
+
+func archiveTimestamp(records []byte, i int) ptime.IMilliseconds {
+	return ptime.IMilliseconds(binary.LittleEndian.Uint64(records[i*archiveRecordSize:]))
+}
+
+func decodeArchiveRecord(record []byte, agg *globals.Aggregate) {
+	agg.Open = math.Float64frombits(binary.LittleEndian.Uint64(record[8:]))
+	agg.High = math.Float64frombits(binary.LittleEndian.Uint64(record[16:]))
+	agg.Low = math.Float64frombits(binary.LittleEndian.Uint64(record[24:]))
+	agg.Close = math.Float64frombits(binary.LittleEndian.Uint64(record[32:]))
+	agg.Volume = math.Float64frombits(binary.LittleEndian.Uint64(record[40:]))
+	agg.VWAP = math.Float64frombits(binary.LittleEndian.Uint64(record[48:]))
+	setInteger(&agg.Transactions, int64(binary.LittleEndian.Uint64(record[56:])))
+}
+
+func appendArchiveRecord(buf []byte, agg globals.Aggregate) []byte {
+	buf = appendUint64(buf, uint64(agg.StartTimestamp))
+	buf = appendUint64(buf, math.Float64bits(agg.Open))
+	buf = appendUint64(buf, math.Float64bits(agg.High))
+	buf = appendUint64(buf, math.Float64bits(agg.Low))
+	buf = appendUint64(buf, math.Float64bits(agg.Close))
+	buf = appendUint64(buf, math.Float64bits(agg.Volume))
+	buf = appendUint64(buf, math.Float64bits(agg.VWAP))
+	buf = appendUint64(buf, uint64(agg.Transactions))
+
+	return buf
+}
@@ -0,0 +1,171 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/ptime"
+)
+
+type CheckOptions struct {
+	Filter Filter
+	// Tolerance is the relative difference allowed between float fields. The default is 1e-9.
+	Tolerance float64
+}
+
+// CheckReport describes how two stores differ. Bars are listed ordered by ticker, bar length and timestamp.
+type CheckReport struct {
+	// Compared counts the bars present in both stores, and Matched those that agree.
+	Compared  int64     `json:"compared"`
+	Matched   int64     `json:"matched"`
+	Missing   []BarDiff `json:"missing"`
+	Extra     []BarDiff `json:"extra"`
+	Divergent []BarDiff `json:"divergent"`
+}
+
+// OK reports whether the stores agree.
+func (r CheckReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Divergent) == 0
+}
+
+// BarDiff is a bar that is missing from one of the stores, or differs between them.
+type BarDiff struct {
+	Ticker    string              `json:"ticker"`
+	BarLength BarLength           `json:"barLength"`
+	Timestamp ptime.IMilliseconds `json:"timestamp"`
+	// Fields lists the fields that differ, for divergent bars.
+	Fields   []string           `json:"fields,omitempty"`
+	Expected *globals.Aggregate `json:"expected,omitempty"`
+	Actual   *globals.Aggregate `json:"actual,omitempty"`
+}
+
+// Check compares the bars matching the filter in two stores. Bars in expected but not in actual are missing,
+// and bars in actual but not in expected are extra. The matching bars of expected are held in memory,
+// so the filter should be narrow enough for them to fit.
+func Check(ctx context.Context, expected, actual Source, opts CheckOptions) (CheckReport, error) {
+	if opts.Tolerance == 0 {
+		opts.Tolerance = 1e-9
+	}
+
+	// empty rather than nil, so that they're encoded as empty lists
+	report := CheckReport{
+		Missing:   []BarDiff{},
+		Extra:     []BarDiff{},
+		Divergent: []BarDiff{},
+	}
+	var sourceErr error
+
+	want := make(map[copyKey]globals.Aggregate)
+	if err := expected(ctx, func(agg globals.Aggregate) bool {
+		key, ok, err := checkKey(agg, opts.Filter)
+		if err != nil {
+			sourceErr = err
+			return false
+		}
+
+		if ok {
+			want[key] = agg
+		}
+
+		return true
+	}); err != nil {
+		return report, fmt.Errorf("read expected: %w", err)
+	} else if sourceErr != nil {
+		return report, fmt.Errorf("read expected: %w", sourceErr)
+	}
+
+	if err := actual(ctx, func(agg globals.Aggregate) bool {
+		key, ok, err := checkKey(agg, opts.Filter)
+		if err != nil {
+			sourceErr = err
+			return false
+		} else if !ok {
+			return true
+		}
+
+		w, found := want[key]
+		if !found {
+			report.Extra = append(report.Extra, BarDiff{Ticker: key.Ticker, BarLength: key.BarLength, Timestamp: key.Timestamp, Actual: &agg})
+			return true
+		}
+		delete(want, key)
+
+		report.Compared++
+		if fields := divergentFields(w, agg, opts.Tolerance); len(fields) > 0 {
+			report.Divergent = append(report.Divergent, BarDiff{
+				Ticker:    key.Ticker,
+				BarLength: key.BarLength,
+				Timestamp: key.Timestamp,
+				Fields:    fields,
+				Expected:  &w,
+				Actual:    &agg,
+			})
+		} else {
+			report.Matched++
+		}
+
+		return true
+	}); err != nil {
+		return report, fmt.Errorf("read actual: %w", err)
+	} else if sourceErr != nil {
+		return report, fmt.Errorf("read actual: %w", sourceErr)
+	}
+
+	for key, agg := range want {
+		agg := agg
+		report.Missing = append(report.Missing, BarDiff{Ticker: key.Ticker, BarLength: key.BarLength, Timestamp: key.Timestamp, Expected: &agg})
+	}
+
+	for _, diffs := range [][]BarDiff{report.Missing, report.Extra, report.Divergent} {
+		sort.Slice(diffs, func(i, j int) bool {
+			return compareCopyKeys(diffs[i].key(), diffs[j].key()) < 0
+		})
+	}
+
+	return report, nil
+}
+
+func (d BarDiff) key() copyKey {
+	return copyKey{Ticker: d.Ticker, BarLength: d.BarLength, Timestamp: d.Timestamp}
+}
+
+func checkKey(agg globals.Aggregate, filter Filter) (copyKey, bool, error) {
+	barLength, err := getBarLength(agg)
+	if err != nil {
+		return copyKey{}, false, fmt.Errorf("aggregate %s/%d: %w", agg.Ticker, agg.Timestamp, err)
+	}
+
+	return copyKey{Ticker: agg.Ticker, BarLength: barLength, Timestamp: agg.Timestamp}, filter.match(agg, barLength), nil
+}
+
+func divergentFields(a, b globals.Aggregate, tolerance float64) []string {
+	closeEnough := func(x, y float64) bool {
+		return x == y || math.Abs(x-y) <= tolerance*math.Max(math.Abs(x), math.Abs(y))
+	}
+
+	var fields []string
+	for _, f := range []struct {
+		name string
+		a, b float64
+	}{
+		{"open", a.Open, b.Open},
+		{"high", a.High, b.High},
+		{"low", a.Low, b.Low},
+		{"close", a.Close, b.Close},
+		{"volume", a.Volume, b.Volume},
+		{"vwap", a.VWAP, b.VWAP},
+	} {
+		if !closeEnough(f.a, f.b) {
+			fields = append(fields, f.name)
+		}
+	}
+
+	if int64(a.Transactions) != int64(b.Transactions) {
+		fields = append(fields, "transactions")
+	}
+
+	return fields
+}
@@ -0,0 +1,282 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/ptime"
+)
+
+// Codec serializes aggregates for backends that store them as opaque values.
+type Codec interface {
+	// ID identifies the codec and its version in the header of every value it encodes.
+	// It must never be reused for a different format.
+	ID() uint8
+	Marshal(globals.Aggregate) ([]byte, error)
+	Unmarshal([]byte, *globals.Aggregate) error
+}
+
+var (
+	JSONCodec     Codec = jsonCodec{}
+	BinaryCodec   Codec = binaryCodec{}
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+var codecs = map[uint8]Codec{
+	JSONCodec.ID():     JSONCodec,
+	BinaryCodec.ID():   BinaryCodec,
+	ProtobufCodec.ID(): ProtobufCodec,
+}
+
+var ErrUnknownCodec = errors.New("unknown codec")
+
+// Every encoded value starts with a two-byte header: codecMagic, followed by the codec's ID.
+// Values written before codecs existed are bare JSON objects, which never start with codecMagic,
+// so they are still decoded as JSON. This allows a keyspace to be migrated between codecs in place:
+// values are read with whichever codec wrote them, and rewritten with the current one.
+const (
+	codecMagic      = 0xA6
+	codecHeaderSize = 2
+
+	// fieldsCodecID identifies the values of custom schemas, which aren't globals.Aggregate and so have no Codec:
+	// their fields as a JSON object (see Schema.marshalFields).
+	fieldsCodecID = 4
+)
+
+// EncodeAggregate serializes the aggregate with the given codec, prefixed by its header.
+func EncodeAggregate(codec Codec, agg globals.Aggregate) ([]byte, error) {
+	body, err := codec.Marshal(agg)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{codecMagic, codec.ID()}, body...), nil
+}
+
+// DecodeAggregate deserializes a value written by EncodeAggregate with any known codec, or a bare JSON value.
+func DecodeAggregate(buf []byte, agg *globals.Aggregate) error {
+	if len(buf) < codecHeaderSize || buf[0] != codecMagic {
+		return json.Unmarshal(buf, agg)
+	}
+
+	codec, ok := codecs[buf[1]]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownCodec, buf[1])
+	}
+
+	return codec.Unmarshal(buf[codecHeaderSize:], agg)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() uint8 { return 1 }
+
+func (jsonCodec) Marshal(agg globals.Aggregate) ([]byte, error) {
+	return agg.MarshalJSON()
+}
+
+func (jsonCodec) Unmarshal(buf []byte, agg *globals.Aggregate) error {
+	return json.Unmarshal(buf, agg)
+}
+
+// binaryCodec is a fixed-width little-endian encoding:
+//
+//	ticker       uint8 length, then bytes
+//	timestamp, start timestamp, end timestamp int64
+//	open, high, low, close, volume, vwap float64
+//	transactions int64
+type binaryCodec struct{}
+
+const binaryCodecSize = 10 * 8
+
+func (binaryCodec) ID() uint8 { return 2 }
+
+func (binaryCodec) Marshal(agg globals.Aggregate) ([]byte, error) {
+	if len(agg.Ticker) > math.MaxUint8 {
+		return nil, fmt.Errorf("ticker %q is too long", agg.Ticker)
+	}
+
+	buf := make([]byte, 0, 1+len(agg.Ticker)+binaryCodecSize)
+	buf = append(buf, uint8(len(agg.Ticker)))
+	buf = append(buf, agg.Ticker...)
+	buf = appendUint64(buf, uint64(agg.Timestamp))
+	buf = appendUint64(buf, uint64(agg.StartTimestamp))
+	buf = appendUint64(buf, uint64(agg.EndTimestamp))
+	buf = appendUint64(buf, math.Float64bits(agg.Open))
+	buf = appendUint64(buf, math.Float64bits(agg.High))
+	buf = appendUint64(buf, math.Float64bits(agg.Low))
+	buf = appendUint64(buf, math.Float64bits(agg.Close))
+	buf = appendUint64(buf, math.Float64bits(agg.Volume))
+	buf = appendUint64(buf, math.Float64bits(agg.VWAP))
+	buf = appendUint64(buf, uint64(agg.Transactions))
+
+	return buf, nil
+}
+
+func (binaryCodec) Unmarshal(buf []byte, agg *globals.Aggregate) error {
+	if len(buf) < 1 || len(buf) != 1+int(buf[0])+binaryCodecSize {
+		return fmt.Errorf("binary codec: unexpected length %d", len(buf))
+	}
+
+	tickerLen := int(buf[0])
+	agg.Ticker = string(buf[1 : 1+tickerLen])
+	buf = buf[1+tickerLen:]
+
+	next := func() uint64 {
+		v := binary.LittleEndian.Uint64(buf)
+		buf = buf[8:]
+		return v
+	}
+
+	agg.Timestamp = ptime.IMilliseconds(next())
+	agg.StartTimestamp = ptime.IMilliseconds(next())
+	agg.EndTimestamp = ptime.IMilliseconds(next())
+	agg.Open = math.Float64frombits(next())
+	agg.High = math.Float64frombits(next())
+	agg.Low = math.Float64frombits(next())
+	agg.Close = math.Float64frombits(next())
+	agg.Volume = math.Float64frombits(next())
+	agg.VWAP = math.Float64frombits(next())
+	setInteger(&agg.Transactions, int64(next()))
+
+	return nil
+}
+
+// protobufCodec encodes aggregates as the following protobuf message, so that they can be read by other languages:
+//
+//	message Aggregate {
+//	  string ticker = 1;
+//	  double volume = 2;
+//	  double vwap = 3;
+//	  double open = 4;
+//	  double close = 5;
+//	  double high = 6;
+//	  double low = 7;
+//	  int64 timestamp = 8;
+//	  int64 transactions = 9;
+//	  int64 start_timestamp = 10;
+//	  int64 end_timestamp = 11;
+//	}
+type protobufCodec struct{}
+
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+var errProtobufTruncated = errors.New("protobuf codec: truncated message")
+
+func (protobufCodec) ID() uint8 { return 3 }
+
+func (protobufCodec) Marshal(agg globals.Aggregate) ([]byte, error) {
+	p := proto.NewBuffer(make([]byte, 0, 96))
+
+	if agg.Ticker != "" {
+		p.EncodeVarint(1<<3 | protoWireBytes)
+		p.EncodeStringBytes(agg.Ticker)
+	}
+
+	for _, f := range []struct {
+		field uint64
+		value float64
+	}{{2, agg.Volume}, {3, agg.VWAP}, {4, agg.Open}, {5, agg.Close}, {6, agg.High}, {7, agg.Low}} {
+		if f.value != 0 {
+			p.EncodeVarint(f.field<<3 | protoWireFixed64)
+			p.EncodeFixed64(math.Float64bits(f.value))
+		}
+	}
+
+	for _, f := range []struct {
+		field uint64
+		value int64
+	}{{8, int64(agg.Timestamp)}, {9, int64(agg.Transactions)}, {10, int64(agg.StartTimestamp)}, {11, int64(agg.EndTimestamp)}} {
+		if f.value != 0 {
+			p.EncodeVarint(f.field<<3 | protoWireVarint)
+			p.EncodeVarint(uint64(f.value))
+		}
+	}
+
+	return p.Bytes(), nil
+}
+
+func (protobufCodec) Unmarshal(buf []byte, agg *globals.Aggregate) error {
+	*agg = globals.Aggregate{}
+
+	for len(buf) > 0 {
+		tag, n := proto.DecodeVarint(buf)
+		if n == 0 {
+			return errProtobufTruncated
+		}
+		buf = buf[n:]
+
+		field, wireType := tag>>3, tag&7
+		switch wireType {
+		case protoWireVarint:
+			v, n := proto.DecodeVarint(buf)
+			if n == 0 {
+				return errProtobufTruncated
+			}
+			buf = buf[n:]
+
+			switch field {
+			case 8:
+				agg.Timestamp = ptime.IMilliseconds(v)
+			case 9:
+				setInteger(&agg.Transactions, int64(v))
+			case 10:
+				agg.StartTimestamp = ptime.IMilliseconds(v)
+			case 11:
+				agg.EndTimestamp = ptime.IMilliseconds(v)
+			}
+		case protoWireFixed64:
+			if len(buf) < 8 {
+				return errProtobufTruncated
+			}
+			v := math.Float64frombits(binary.LittleEndian.Uint64(buf))
+			buf = buf[8:]
+
+			switch field {
+			case 2:
+				agg.Volume = v
+			case 3:
+				agg.VWAP = v
+			case 4:
+				agg.Open = v
+			case 5:
+				agg.Close = v
+			case 6:
+				agg.High = v
+			case 7:
+				agg.Low = v
+			}
+		case protoWireBytes:
+			length, n := proto.DecodeVarint(buf)
+			if n == 0 || uint64(len(buf)-n) < length {
+				return errProtobufTruncated
+			}
+			v := buf[n : n+int(length)]
+			buf = buf[n+int(length):]
+
+			if field == 1 {
+				agg.Ticker = string(v)
+			}
+		case protoWireFixed32:
+			// unknown field from a newer schema
+			if len(buf) < 4 {
+				return errProtobufTruncated
+			}
+			buf = buf[4:]
+		default:
+			return fmt.Errorf("protobuf codec: unsupported wire type %d", wireType)
+		}
+	}
+
+	return nil
+}
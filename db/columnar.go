@@ -0,0 +1,487 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/ptime"
+	"github.com/sirupsen/logrus"
+)
+
+// ColumnarDB is an in-memory DB that stores the bars for each ticker and bar length in time-ordered columns,
+// rather than as one boxed aggregate per bar. Tickers are interned, so a ticker's name is stored only once.
+// It uses the same transactions as NativeDB.
+//
+// If a memory limit is set, then whenever the footprint exceeds it after a commit,
+// whole series are evicted, least recently updated first, until it no longer does.
+type ColumnarDB struct {
+	lockManager lockManager
+	memoryLimit int64
+	memoryUsage int64
+	evicting    int32
+
+	mu        sync.RWMutex
+	tickerIDs map[string]uint32
+	tickers   []string
+	freeIDs   []uint32
+	series    map[seriesKey]*columnarSeries
+	// the number of series of each ticker, by ID
+	tickerSeries []int
+}
+
+var _ DB[Tx] = &ColumnarDB{}
+
+type seriesKey struct {
+	ticker    uint32
+	barLength BarLength
+}
+
+// columnarSeries holds every bar for a single ticker and bar length, sorted by timestamp.
+// It is guarded by the lock for its ticker.
+type columnarSeries struct {
+	barLength    BarLength
+	timestamps   []ptime.IMilliseconds
+	open         []float64
+	high         []float64
+	low          []float64
+	close        []float64
+	volume       []float64
+	vwap         []float64
+	transactions []int64
+	states       [][]byte
+	// total length of the states
+	stateBytes  int64
+	lastUpdated int64
+}
+
+// approximate size of the bookkeeping for a series, in bytes
+const columnarSeriesOverhead = int64(unsafe.Sizeof(columnarSeries{})) + int64(unsafe.Sizeof(seriesKey{})) + 16
+
+// NewColumnarDB creates a ColumnarDB. A memoryLimit of 0 means no limit.
+func NewColumnarDB(memoryLimit int64) *ColumnarDB {
+	return &ColumnarDB{
+		memoryLimit: memoryLimit,
+		tickerIDs:   make(map[string]uint32),
+		series:      make(map[seriesKey]*columnarSeries),
+	}
+}
+
+func (c *ColumnarDB) Get(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) (globals.Aggregate, error) {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		return globals.Aggregate{}, err
+	}
+
+	if err := c.lockManager.maybeAcquire(tx, ticker); err != nil {
+		return globals.Aggregate{}, err
+	}
+
+	ts := snapTimestamp(ticker, timestamp, barLength)
+	agg := globals.Aggregate{
+		Ticker:         ticker,
+		Timestamp:      ts,
+		StartTimestamp: ts,
+		EndTimestamp:   barEnd(ticker, ts, barLength),
+	}
+
+	s := c.lookupSeries(ticker, barLength, false)
+	if s == nil {
+		return agg, nil
+	}
+
+	if i, ok := s.search(ts); ok {
+		s.load(i, &agg)
+	}
+
+	return agg, nil
+}
+
+func (c *ColumnarDB) Upsert(tx *Tx, aggregate globals.Aggregate) error {
+	key := AggregateSchema.Key(aggregate)
+	barLength, err := key.BarLength()
+	if err != nil {
+		return err
+	}
+
+	if err := c.lockManager.maybeAcquire(tx, key.Ticker); err != nil {
+		return err
+	}
+
+	s := c.lookupSeries(key.Ticker, barLength, true)
+	before := s.size()
+
+	i, ok := s.search(key.Start)
+	if !ok {
+		s.insert(i, key.Start)
+	}
+	s.store(i, aggregate)
+	atomic.StoreInt64(&s.lastUpdated, time.Now().UnixNano())
+
+	atomic.AddInt64(&c.memoryUsage, s.size()-before)
+
+	return nil
+}
+
+func (c *ColumnarDB) GetState(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) ([]byte, error) {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.lockManager.maybeAcquire(tx, ticker); err != nil {
+		return nil, err
+	}
+
+	s := c.lookupSeries(ticker, barLength, false)
+	if s == nil {
+		return nil, nil
+	}
+
+	if i, ok := s.search(snapTimestamp(ticker, timestamp, barLength)); ok {
+		return s.states[i], nil
+	}
+
+	return nil, nil
+}
+
+// UpsertState implements DB. If the bar doesn't exist yet, it's created empty.
+func (c *ColumnarDB) UpsertState(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength, state []byte) error {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		return err
+	}
+
+	if err := c.lockManager.maybeAcquire(tx, ticker); err != nil {
+		return err
+	}
+
+	s := c.lookupSeries(ticker, barLength, true)
+	before := s.size()
+
+	ts := snapTimestamp(ticker, timestamp, barLength)
+	i, ok := s.search(ts)
+	if !ok {
+		s.insert(i, ts)
+	}
+	s.stateBytes += int64(len(state) - len(s.states[i]))
+	// the caller may reuse its buffer
+	s.states[i] = append([]byte(nil), state...)
+	atomic.StoreInt64(&s.lastUpdated, time.Now().UnixNano())
+
+	atomic.AddInt64(&c.memoryUsage, s.size()-before)
+
+	return nil
+}
+
+func (c *ColumnarDB) Delete(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) error {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		return err
+	}
+
+	if err := c.lockManager.maybeAcquire(tx, ticker); err != nil {
+		return err
+	}
+
+	s := c.lookupSeries(ticker, barLength, false)
+	if s == nil {
+		return nil
+	}
+
+	before := s.size()
+	if i, ok := s.search(snapTimestamp(ticker, timestamp, barLength)); ok {
+		s.remove(i)
+	}
+	atomic.AddInt64(&c.memoryUsage, s.size()-before)
+
+	return nil
+}
+
+func (c *ColumnarDB) NewTx(ctx context.Context) (*Tx, error) {
+	return &Tx{ctx: ctx}, nil
+}
+
+func (c *ColumnarDB) Commit(tx *Tx) error {
+	if !tx.Empty() {
+		tx.lock.release()
+	}
+	*tx = Tx{}
+
+	if c.memoryLimit > 0 && atomic.LoadInt64(&c.memoryUsage) > c.memoryLimit {
+		c.evict()
+	}
+
+	return nil
+}
+
+// Range calls fn on every aggregate, in timestamp order for each series.
+func (c *ColumnarDB) Range(fn func(globals.Aggregate) bool) {
+	c.mu.RLock()
+	keys := make([]seriesKey, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	c.mu.RUnlock()
+
+	for _, key := range keys {
+		if !c.rangeSeries(key, fn) {
+			return
+		}
+	}
+}
+
+// MemoryUsage returns the approximate number of bytes used to store aggregates.
+func (c *ColumnarDB) MemoryUsage() int64 {
+	return atomic.LoadInt64(&c.memoryUsage)
+}
+
+func (c *ColumnarDB) rangeSeries(key seriesKey, fn func(globals.Aggregate) bool) bool {
+	c.mu.RLock()
+	ticker := c.tickers[key.ticker]
+	c.mu.RUnlock()
+
+	var tx Tx
+	if err := c.lockManager.maybeAcquire(&tx, ticker); err != nil {
+		return true
+	}
+	defer tx.lock.release()
+
+	c.mu.RLock()
+	var s *columnarSeries
+	// the ticker's ID may have been released and reused before we acquired the lock
+	if c.tickers[key.ticker] == ticker {
+		s = c.series[key]
+	}
+	c.mu.RUnlock()
+	if s == nil {
+		return true
+	}
+
+	_, err := getBarLengthDuration(s.barLength)
+	if err != nil {
+		return true
+	}
+
+	for i := range s.timestamps {
+		agg := globals.Aggregate{
+			Ticker:         ticker,
+			Timestamp:      s.timestamps[i],
+			StartTimestamp: s.timestamps[i],
+			EndTimestamp:   barEnd(ticker, s.timestamps[i], s.barLength),
+		}
+		s.load(i, &agg)
+
+		if !fn(agg) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lookupSeries finds the series for the ticker and bar length, creating it if create is set.
+// The caller must hold the lock for the ticker.
+func (c *ColumnarDB) lookupSeries(ticker string, barLength BarLength, create bool) *columnarSeries {
+	c.mu.RLock()
+	var s *columnarSeries
+	if id, ok := c.tickerIDs[ticker]; ok {
+		s = c.series[seriesKey{ticker: id, barLength: barLength}]
+	}
+	c.mu.RUnlock()
+
+	if s != nil || !create {
+		return s
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, ok := c.tickerIDs[ticker]
+	if !ok {
+		if n := len(c.freeIDs); n > 0 {
+			id = c.freeIDs[n-1]
+			c.freeIDs = c.freeIDs[:n-1]
+			c.tickers[id] = ticker
+		} else {
+			id = uint32(len(c.tickers))
+			c.tickers = append(c.tickers, ticker)
+			c.tickerSeries = append(c.tickerSeries, 0)
+		}
+		c.tickerIDs[ticker] = id
+		atomic.AddInt64(&c.memoryUsage, tickerOverhead(ticker))
+	}
+
+	key := seriesKey{ticker: id, barLength: barLength}
+	if s = c.series[key]; s == nil {
+		s = &columnarSeries{barLength: barLength}
+		c.series[key] = s
+		c.tickerSeries[id]++
+		atomic.AddInt64(&c.memoryUsage, columnarSeriesOverhead)
+	}
+
+	return s
+}
+
+func (c *ColumnarDB) evict() {
+	if !atomic.CompareAndSwapInt32(&c.evicting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&c.evicting, 0)
+
+	type candidate struct {
+		key         seriesKey
+		ticker      string
+		lastUpdated int64
+	}
+
+	c.mu.RLock()
+	candidates := make([]candidate, 0, len(c.series))
+	for key, s := range c.series {
+		candidates = append(candidates, candidate{
+			key:         key,
+			ticker:      c.tickers[key.ticker],
+			lastUpdated: atomic.LoadInt64(&s.lastUpdated),
+		})
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUpdated < candidates[j].lastUpdated
+	})
+
+	for _, cand := range candidates {
+		if atomic.LoadInt64(&c.memoryUsage) <= c.memoryLimit {
+			return
+		}
+
+		// don't wait long on a ticker that's in use; it's a poor candidate for eviction anyway
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		tx := Tx{ctx: ctx}
+		err := c.lockManager.maybeAcquire(&tx, cand.ticker)
+		cancel()
+		if err != nil {
+			logrus.WithField("ticker", cand.ticker).WithError(err).Debug("skipping eviction")
+			continue
+		}
+
+		c.mu.Lock()
+		if s := c.series[cand.key]; s != nil && c.tickers[cand.key.ticker] == cand.ticker {
+			delete(c.series, cand.key)
+			c.tickerSeries[cand.key.ticker]--
+			atomic.AddInt64(&c.memoryUsage, -s.size()-columnarSeriesOverhead)
+			c.maybeReleaseTicker(cand.key.ticker)
+		}
+		c.mu.Unlock()
+
+		tx.lock.release()
+	}
+}
+
+// maybeReleaseTicker frees the ticker's ID for reuse if it has no series left.
+// The caller must hold c.mu for writing, as well as the lock for the ticker.
+func (c *ColumnarDB) maybeReleaseTicker(id uint32) {
+	if c.tickerSeries[id] > 0 {
+		return
+	}
+
+	ticker := c.tickers[id]
+	delete(c.tickerIDs, ticker)
+	c.tickers[id] = ""
+	c.freeIDs = append(c.freeIDs, id)
+	atomic.AddInt64(&c.memoryUsage, -tickerOverhead(ticker))
+}
+
+func tickerOverhead(ticker string) int64 {
+	return int64(len(ticker)) + int64(unsafe.Sizeof(ticker)) + 4
+}
+
+// search returns the position of the bar with the given timestamp, and whether it exists.
+// If it doesn't exist, the position is where it would be inserted.
+func (s *columnarSeries) search(ts ptime.IMilliseconds) (int, bool) {
+	n := len(s.timestamps)
+	// fast path: bars are almost always appended or updated at the end
+	if n > 0 && s.timestamps[n-1] == ts {
+		return n - 1, true
+	} else if n == 0 || s.timestamps[n-1] < ts {
+		return n, false
+	}
+
+	i := sort.Search(n, func(i int) bool { return s.timestamps[i] >= ts })
+	return i, i < n && s.timestamps[i] == ts
+}
+
+func (s *columnarSeries) insert(i int, ts ptime.IMilliseconds) {
+	s.timestamps = insertAt(s.timestamps, i, ts)
+	s.open = insertAt(s.open, i, 0)
+	s.high = insertAt(s.high, i, 0)
+	s.low = insertAt(s.low, i, 0)
+	s.close = insertAt(s.close, i, 0)
+	s.volume = insertAt(s.volume, i, 0)
+	s.vwap = insertAt(s.vwap, i, 0)
+	s.transactions = insertAt(s.transactions, i, 0)
+	s.states = insertAt(s.states, i, nil)
+}
+
+func (s *columnarSeries) remove(i int) {
+	s.timestamps = removeAt(s.timestamps, i)
+	s.open = removeAt(s.open, i)
+	s.high = removeAt(s.high, i)
+	s.low = removeAt(s.low, i)
+	s.close = removeAt(s.close, i)
+	s.volume = removeAt(s.volume, i)
+	s.vwap = removeAt(s.vwap, i)
+	s.stateBytes -= int64(len(s.states[i]))
+	s.transactions = removeAt(s.transactions, i)
+	s.states = removeAt(s.states, i)
+}
+
+func (s *columnarSeries) load(i int, agg *globals.Aggregate) {
+	agg.Open = s.open[i]
+	agg.High = s.high[i]
+	agg.Low = s.low[i]
+	agg.Close = s.close[i]
+	agg.Volume = s.volume[i]
+	agg.VWAP = s.vwap[i]
+	setInteger(&agg.Transactions, s.transactions[i])
+}
+
+func (s *columnarSeries) store(i int, agg globals.Aggregate) {
+	s.open[i] = agg.Open
+	s.high[i] = agg.High
+	s.low[i] = agg.Low
+	s.close[i] = agg.Close
+	s.volume[i] = agg.Volume
+	s.vwap[i] = agg.VWAP
+	s.transactions[i] = int64(agg.Transactions)
+}
+
+// size returns the number of bytes allocated for the columns of the series, including its states.
+func (s *columnarSeries) size() int64 {
+	return int64(cap(s.timestamps))*int64(unsafe.Sizeof(ptime.IMilliseconds(0))) +
+		int64(cap(s.open)+cap(s.high)+cap(s.low)+cap(s.close)+cap(s.volume)+cap(s.vwap))*8 +
+		int64(cap(s.transactions))*8 +
+		int64(cap(s.states))*int64(unsafe.Sizeof([]byte(nil))) + s.stateBytes
+}
+
+func insertAt[T any](s []T, i int, v T) []T {
+	var zero T
+	s = append(s, zero)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+
+	return s
+}
+
+func removeAt[T any](s []T, i int) []T {
+	copy(s[i:], s[i+1:])
+	// don't keep the removed value reachable
+	var zero T
+	s[len(s)-1] = zero
+
+	return s[:len(s)-1]
+}
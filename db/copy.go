@@ -0,0 +1,379 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/ptime"
+)
+
+// A Source enumerates the aggregates in a store, stopping early if fn returns false.
+// Stores with a Range method can be adapted to it with a closure.
+type Source func(ctx context.Context, fn func(globals.Aggregate) bool) error
+
+// SortedSource reads every aggregate from src and yields them ordered by ticker, bar length and timestamp,
+// which Copy requires in order to resume from a checkpoint. It holds every aggregate in memory.
+func SortedSource(src Source) Source {
+	return func(ctx context.Context, fn func(globals.Aggregate) bool) error {
+		var aggs []globals.Aggregate
+		var barLengths []BarLength
+		if err := src(ctx, func(agg globals.Aggregate) bool {
+			barLength, err := getBarLength(agg)
+			if err != nil {
+				// sorted first, so Copy reports it right away
+				barLength = ""
+			}
+
+			aggs = append(aggs, agg)
+			barLengths = append(barLengths, barLength)
+
+			return true
+		}); err != nil {
+			return err
+		}
+
+		idx := make([]int, len(aggs))
+		for i := range idx {
+			idx[i] = i
+		}
+
+		sort.Slice(idx, func(i, j int) bool {
+			a, b := idx[i], idx[j]
+			return compareCopyKeys(
+				copyKey{aggs[a].Ticker, barLengths[a], aggs[a].Timestamp},
+				copyKey{aggs[b].Ticker, barLengths[b], aggs[b].Timestamp},
+			) < 0
+		})
+
+		for _, i := range idx {
+			if !fn(aggs[i]) {
+				return nil
+			}
+		}
+
+		return nil
+	}
+}
+
+// Filter selects aggregates. Empty fields match everything.
+type Filter struct {
+	Tickers    []string
+	BarLengths []BarLength
+	// From and To bound the timestamp to [From, To); a To of 0 is unbounded.
+	From, To ptime.IMilliseconds
+}
+
+func (f Filter) match(agg globals.Aggregate, barLength BarLength) bool {
+	if len(f.Tickers) > 0 && !contains(f.Tickers, agg.Ticker) {
+		return false
+	}
+
+	if len(f.BarLengths) > 0 && !f.matchBarLength(agg.Ticker, barLength) {
+		return false
+	}
+
+	return agg.Timestamp >= f.From && (f.To == 0 || agg.Timestamp < f.To)
+}
+
+// matchBarLength reports whether one of the filter's bar lengths, resolved for the ticker, is barLength.
+func (f Filter) matchBarLength(ticker string, barLength BarLength) bool {
+	for _, b := range f.BarLengths {
+		if resolved, err := resolveBarLength(ticker, b); err == nil && resolved == barLength {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains[T comparable](s []T, v T) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+type CopyOptions struct {
+	Filter Filter
+	// BatchSize is the number of aggregates written between checkpoints. The default is 1000.
+	BatchSize int
+	// Checkpoint is the path of a file recording the progress of the copy. If it exists, the copy resumes after the
+	// last aggregate it records, which requires the source to be ordered (see SortedSource). It's removed on success.
+	Checkpoint string
+	// Verify reads back every batch after writing it, and counts the aggregates that differ from the source.
+	Verify bool
+	// OnMismatch, if set, is called with every aggregate that failed verification, and the one that was read back.
+	OnMismatch func(want, got globals.Aggregate)
+}
+
+// CopyStats counts the aggregates handled by Copy. When resuming from a checkpoint, they include the previous runs.
+type CopyStats struct {
+	Read       int64 `json:"read"`
+	Skipped    int64 `json:"skipped"`
+	Copied     int64 `json:"copied"`
+	Mismatches int64 `json:"mismatches"`
+}
+
+var ErrUnorderedSource = errors.New("source is not ordered by ticker, bar length and timestamp")
+
+type copyKey struct {
+	Ticker    string              `json:"ticker"`
+	BarLength BarLength           `json:"barLength"`
+	Timestamp ptime.IMilliseconds `json:"timestamp"`
+}
+
+func compareCopyKeys(a, b copyKey) int {
+	switch {
+	case a.Ticker != b.Ticker:
+		return compareOrdered(a.Ticker, b.Ticker)
+	case a.BarLength != b.BarLength:
+		return compareOrdered(a.BarLength, b.BarLength)
+	default:
+		return compareOrdered(a.Timestamp, b.Timestamp)
+	}
+}
+
+func compareOrdered[T ~string | ~int64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+type copyCheckpoint struct {
+	Last  copyKey   `json:"last"`
+	Stats CopyStats `json:"stats"`
+}
+
+// Copy writes every aggregate from src that matches the filter to dst, in batches, replacing existing bars.
+// Each batch is written in one transaction per ticker, since some stores lock a single ticker per transaction.
+// Bars' states are not copied; logic that keeps state must be able to rebuild it from the aggregate.
+func Copy[Tx any](ctx context.Context, src Source, dst DB[Tx], opts CopyOptions) (CopyStats, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+
+	var checkpoint *copyCheckpoint
+	var stats CopyStats
+	if opts.Checkpoint != "" {
+		var err error
+		if checkpoint, err = readCopyCheckpoint(opts.Checkpoint); err != nil {
+			return stats, err
+		}
+
+		if checkpoint != nil {
+			stats = checkpoint.Stats
+		}
+	}
+
+	var (
+		batch   []globals.Aggregate
+		last    copyKey
+		started bool
+		copyErr error
+	)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := writeCopyBatch(ctx, dst, batch); err != nil {
+			return err
+		}
+		stats.Copied += int64(len(batch))
+
+		if opts.Verify {
+			mismatches, err := verifyCopyBatch(ctx, dst, batch, opts.OnMismatch)
+			if err != nil {
+				return fmt.Errorf("verify: %w", err)
+			}
+			stats.Mismatches += mismatches
+		}
+
+		batch = batch[:0]
+
+		if opts.Checkpoint != "" {
+			return writeCopyCheckpoint(opts.Checkpoint, copyCheckpoint{Last: last, Stats: stats})
+		}
+
+		return nil
+	}
+
+	err := src(ctx, func(agg globals.Aggregate) bool {
+		barLength, err := getBarLength(agg)
+		if err != nil {
+			copyErr = fmt.Errorf("aggregate %s/%d: %w", agg.Ticker, agg.Timestamp, err)
+			return false
+		}
+
+		key := copyKey{Ticker: agg.Ticker, BarLength: barLength, Timestamp: agg.Timestamp}
+		if opts.Checkpoint != "" && started && compareCopyKeys(key, last) <= 0 {
+			copyErr = ErrUnorderedSource
+			return false
+		}
+		started = true
+		last = key
+
+		if checkpoint != nil && compareCopyKeys(key, checkpoint.Last) <= 0 {
+			// copied by a previous run
+			return true
+		}
+
+		stats.Read++
+		if !opts.Filter.match(agg, barLength) {
+			stats.Skipped++
+			return true
+		}
+
+		batch = append(batch, agg)
+		if len(batch) >= opts.BatchSize {
+			if copyErr = flush(); copyErr != nil {
+				return false
+			}
+		}
+
+		return ctx.Err() == nil
+	})
+	if copyErr != nil {
+		return stats, copyErr
+	} else if err != nil {
+		return stats, fmt.Errorf("read source: %w", err)
+	} else if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+
+	if err := flush(); err != nil {
+		return stats, err
+	}
+
+	if opts.Checkpoint != "" {
+		if err := os.Remove(opts.Checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
+func writeCopyBatch[Tx any](ctx context.Context, dst DB[Tx], batch []globals.Aggregate) error {
+	return forEachTicker(ctx, dst, batch, func(tx *Tx, agg globals.Aggregate) error {
+		if err := dst.Upsert(tx, agg); err != nil {
+			return fmt.Errorf("upsert %s/%d: %w", agg.Ticker, agg.Timestamp, err)
+		}
+
+		return nil
+	})
+}
+
+func verifyCopyBatch[Tx any](ctx context.Context, dst DB[Tx], batch []globals.Aggregate, onMismatch func(want, got globals.Aggregate)) (int64, error) {
+	var mismatches int64
+	err := forEachTicker(ctx, dst, batch, func(tx *Tx, want globals.Aggregate) error {
+		barLength, err := getBarLength(want)
+		if err != nil {
+			return err
+		}
+
+		got, err := dst.Get(tx, want.Ticker, ptime.INanoseconds(want.Timestamp.ToDuration()), barLength)
+		if err != nil {
+			return fmt.Errorf("get %s/%d: %w", want.Ticker, want.Timestamp, err)
+		}
+
+		if !aggregatesEqual(want, got) {
+			mismatches++
+			if onMismatch != nil {
+				onMismatch(want, got)
+			}
+		}
+
+		return nil
+	})
+
+	return mismatches, err
+}
+
+// forEachTicker calls fn with every aggregate, in one transaction per run of aggregates with the same ticker.
+func forEachTicker[Tx any](ctx context.Context, dst DB[Tx], aggs []globals.Aggregate, fn func(*Tx, globals.Aggregate) error) error {
+	for start := 0; start < len(aggs); {
+		end := start + 1
+		for end < len(aggs) && aggs[end].Ticker == aggs[start].Ticker {
+			end++
+		}
+
+		tx, err := dst.NewTx(ctx)
+		if err != nil {
+			return fmt.Errorf("new tx: %w", err)
+		}
+
+		for _, agg := range aggs[start:end] {
+			if err := fn(tx, agg); err != nil {
+				// release anything the transaction holds
+				dst.Commit(tx)
+				return err
+			}
+		}
+
+		if err := dst.Commit(tx); err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+
+		start = end
+	}
+
+	return nil
+}
+
+func aggregatesEqual(a, b globals.Aggregate) bool {
+	return a.Ticker == b.Ticker &&
+		a.Timestamp == b.Timestamp &&
+		a.Open == b.Open &&
+		a.High == b.High &&
+		a.Low == b.Low &&
+		a.Close == b.Close &&
+		a.Volume == b.Volume &&
+		a.VWAP == b.VWAP &&
+		int64(a.Transactions) == int64(b.Transactions)
+}
+
+// readCopyCheckpoint returns nil if there is no checkpoint.
+func readCopyCheckpoint(path string) (*copyCheckpoint, error) {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var checkpoint copyCheckpoint
+	if err := json.Unmarshal(buf, &checkpoint); err != nil {
+		return nil, fmt.Errorf("read checkpoint %s: %w", path, err)
+	}
+
+	return &checkpoint, nil
+}
+
+func writeCopyCheckpoint(path string, checkpoint copyCheckpoint) error {
+	buf, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"context"
+	"errors"
 
 	"github.com/polygon-io/go-lib-models/v2/globals"
 	"github.com/polygon-io/ptime"
@@ -12,15 +13,30 @@ type BarLength string
 const (
 	BarLengthSecond BarLength = "sec"
 	BarLengthMinute BarLength = "min"
+	BarLengthHour   BarLength = "hr"
 	BarLengthDay    BarLength = "day"
+	BarLengthWeek   BarLength = "wk"
 )
 
-// DB stores aggregates and exposes composable primitives that can be called concurrently.
+// Intraday reports whether bars of this length are shorter than a trading day, which the bars of BarSpecs all are.
+func (b BarLength) Intraday() bool {
+	switch b {
+	case BarLengthSecond, BarLengthMinute, BarLengthHour:
+		return true
+	default:
+		_, err := ParseBarSpec(b)
+		return err == nil
+	}
+}
+
+// Store stores aggregates of type A and exposes composable primitives that can be called concurrently.
 // Tx denotes a transaction. Any two transactions must be completely read/write isolated
-// from one another until DB.Commit is called on the transaction.
+// from one another until Store.Commit is called on the transaction.
 // Any implementation of this interface MUST roll back the transaction *automatically* if any
 // error occurs during one of the operations.
-type DB[Tx any] interface {
+//
+// Most code uses DB, which stores globals.Aggregate; Store is for custom aggregate types (see Schema).
+type Store[Tx any, A comparable] interface {
 	// NewTx creates a fresh transaction with no operations associated with it.
 	// Semantically, every operation in the transaction is guaranteed exclusive access to all rows it touches.
 	// If any of these operations fail, the transaction must automatically be rolled back.
@@ -28,12 +44,20 @@ type DB[Tx any] interface {
 	NewTx(context.Context) (*Tx, error)
 
 	// Get retrieves the aggregate with the given ticker and bar length that contains the requested timestamp.
-	Get(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) (globals.Aggregate, error)
+	Get(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) (A, error)
 
 	// Upsert upserts an aggregate.
-	Upsert(tx *Tx, aggregate globals.Aggregate) error
+	Upsert(tx *Tx, aggregate A) error
 
-	// Delete deletes an aggregate.
+	// GetState retrieves the auxiliary state stored alongside the aggregate with the given ticker and bar length
+	// that contains the requested timestamp, such as running sums that can't be derived from the aggregate itself.
+	// The state is opaque to the DB. It returns nil if the bar has no state.
+	GetState(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) ([]byte, error)
+
+	// UpsertState upserts the auxiliary state of a bar. The state is deleted along with the bar, and expires with it.
+	UpsertState(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength, state []byte) error
+
+	// Delete deletes an aggregate, along with its state.
 	Delete(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) error
 
 	// Commit commits the transaction to the database.
@@ -41,3 +65,20 @@ type DB[Tx any] interface {
 	// and Commit returns the error.
 	Commit(tx *Tx) error
 }
+
+// ErrConflict is returned by Commit when another transaction changed what the transaction read, so that it was rolled
+// back instead. Stores that lock what their transactions touch never return it; for those that don't, such as
+// RedisStore, the transaction can be retried from the start.
+var ErrConflict = errors.New("transaction conflict")
+
+// DB is a Store of globals.Aggregate, the default aggregate type.
+type DB[Tx any] interface {
+	Store[Tx, globals.Aggregate]
+}
+
+// Scanner is implemented by stores that can efficiently list a ticker's bars over a range of time.
+type Scanner interface {
+	// Scan calls fn on every aggregate with the given ticker and bar length whose timestamp is in [from, to),
+	// in timestamp order, until fn returns false.
+	Scan(ctx context.Context, ticker string, barLength BarLength, from, to ptime.IMilliseconds, fn func(globals.Aggregate) bool) error
+}
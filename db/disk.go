@@ -0,0 +1,838 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/ptime"
+	"github.com/sirupsen/logrus"
+)
+
+// DiskDB is an embedded DB that persists aggregates to a single local file, without any external service.
+//
+// The file is an append-only log of committed transactions. Each transaction is written as one checksummed entry,
+// so a crash can only ever lose whole transactions: on open, the log is replayed and any torn entry at the end is truncated.
+// An index from (ticker, bar length, timestamp) to the location of the latest value in the file is kept in memory,
+// along with each series' timestamps in sorted order for range scans. Bars' states are logged and indexed the same way,
+// separately from their values. Compact rewrites the log without overwritten or deleted values.
+//
+// Transactions lock their ticker the same way NativeDB's do, and buffer their writes until Commit.
+type DiskDB struct {
+	lockManager lockManager
+	path        string
+	sync        bool
+
+	mu      sync.RWMutex
+	file    *os.File
+	size    int64
+	garbage int64
+	index   map[diskKey]int64
+	states  map[diskKey]diskStateRef
+	series  map[diskSeries][]ptime.IMilliseconds
+}
+
+type DiskTx struct {
+	Tx
+	ops []diskOp
+}
+
+var _ DB[DiskTx] = &DiskDB{}
+var _ Scanner = &DiskDB{}
+
+// ErrCorruptLog is returned when a DiskDB's log contains an entry that cannot be decoded.
+var ErrCorruptLog = errors.New("corrupt log")
+
+type diskSeries struct {
+	ticker    string
+	barLength BarLength
+}
+
+type diskKey struct {
+	diskSeries
+	timestamp ptime.IMilliseconds
+}
+
+type diskOp struct {
+	key       diskKey
+	kind      uint8
+	aggregate globals.Aggregate
+	// only set for diskOpState
+	state []byte
+}
+
+// diskStateRef locates a bar's state in the log.
+type diskStateRef struct {
+	offset int64
+	length uint32
+}
+
+const (
+	diskOpUpsert = 1
+	diskOpDelete = 2
+	diskOpState  = 3
+
+	// length and checksum
+	diskEntryHeaderSize = 8
+	// open, high, low, close, volume, vwap, transactions
+	diskValueSize = 7 * 8
+)
+
+// OpenDiskDB opens the DiskDB stored at path, creating it if it doesn't exist.
+// If sync is set, every commit is flushed to stable storage before Commit returns.
+func OpenDiskDB(path string, sync bool) (*DiskDB, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	d := &DiskDB{
+		path:   path,
+		sync:   sync,
+		file:   file,
+		index:  make(map[diskKey]int64),
+		states: make(map[diskKey]diskStateRef),
+		series: make(map[diskSeries][]ptime.IMilliseconds),
+	}
+
+	if err := d.recover(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("recover: %w", err)
+	}
+
+	return d, nil
+}
+
+func (d *DiskDB) Get(tx *DiskTx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) (globals.Aggregate, error) {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		d.rollback(tx)
+		return globals.Aggregate{}, err
+	}
+
+	if err := d.lockManager.maybeAcquire(&tx.Tx, ticker); err != nil {
+		return globals.Aggregate{}, err
+	}
+
+	ts := snapTimestamp(ticker, timestamp, barLength)
+	key := diskKey{diskSeries: diskSeries{ticker: ticker, barLength: barLength}, timestamp: ts}
+	agg := globals.Aggregate{
+		Ticker:         ticker,
+		Timestamp:      ts,
+		StartTimestamp: ts,
+		EndTimestamp:   barEnd(ticker, ts, barLength),
+	}
+
+	// read our own writes first
+	for i := len(tx.ops) - 1; i >= 0; i-- {
+		if tx.ops[i].key == key {
+			switch tx.ops[i].kind {
+			case diskOpDelete:
+				return agg, nil
+			case diskOpUpsert:
+				return tx.ops[i].aggregate, nil
+			}
+		}
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	offset, ok := d.index[key]
+	if !ok {
+		return agg, nil
+	}
+
+	if err := d.readValue(offset, &agg); err != nil {
+		d.rollback(tx)
+		return globals.Aggregate{}, err
+	}
+
+	return agg, nil
+}
+
+func (d *DiskDB) Upsert(tx *DiskTx, aggregate globals.Aggregate) error {
+	key := AggregateSchema.Key(aggregate)
+	barLength, err := key.BarLength()
+	if err != nil {
+		d.rollback(tx)
+		return err
+	}
+
+	if len(key.Ticker) > math.MaxUint8 {
+		d.rollback(tx)
+		return fmt.Errorf("ticker %q is too long", key.Ticker)
+	}
+
+	if err := d.lockManager.maybeAcquire(&tx.Tx, key.Ticker); err != nil {
+		return err
+	}
+
+	tx.ops = append(tx.ops, diskOp{
+		key: diskKey{
+			diskSeries: diskSeries{ticker: key.Ticker, barLength: barLength},
+			timestamp:  key.Start,
+		},
+		kind:      diskOpUpsert,
+		aggregate: aggregate,
+	})
+
+	return nil
+}
+
+func (d *DiskDB) GetState(tx *DiskTx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) ([]byte, error) {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		d.rollback(tx)
+		return nil, err
+	}
+
+	if err := d.lockManager.maybeAcquire(&tx.Tx, ticker); err != nil {
+		return nil, err
+	}
+
+	key := diskKey{diskSeries: diskSeries{ticker: ticker, barLength: barLength}, timestamp: snapTimestamp(ticker, timestamp, barLength)}
+
+	// read our own writes first
+	for i := len(tx.ops) - 1; i >= 0; i-- {
+		if tx.ops[i].key == key {
+			switch tx.ops[i].kind {
+			case diskOpDelete:
+				return nil, nil
+			case diskOpState:
+				return tx.ops[i].state, nil
+			}
+		}
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	ref, ok := d.states[key]
+	if !ok {
+		return nil, nil
+	}
+
+	state := make([]byte, ref.length)
+	if _, err := d.file.ReadAt(state, ref.offset); err != nil {
+		d.rollback(tx)
+		return nil, fmt.Errorf("read state at offset %d: %w", ref.offset, err)
+	}
+
+	return state, nil
+}
+
+func (d *DiskDB) UpsertState(tx *DiskTx, ticker string, timestamp ptime.INanoseconds, barLength BarLength, state []byte) error {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		d.rollback(tx)
+		return err
+	}
+
+	if len(ticker) > math.MaxUint8 {
+		d.rollback(tx)
+		return fmt.Errorf("ticker %q is too long", ticker)
+	}
+
+	if err := d.lockManager.maybeAcquire(&tx.Tx, ticker); err != nil {
+		return err
+	}
+
+	tx.ops = append(tx.ops, diskOp{
+		key: diskKey{
+			diskSeries: diskSeries{ticker: ticker, barLength: barLength},
+			timestamp:  snapTimestamp(ticker, timestamp, barLength),
+		},
+		kind: diskOpState,
+		// the caller may reuse its buffer
+		state: append([]byte(nil), state...),
+	})
+
+	return nil
+}
+
+func (d *DiskDB) Delete(tx *DiskTx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) error {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		d.rollback(tx)
+		return err
+	}
+
+	if err := d.lockManager.maybeAcquire(&tx.Tx, ticker); err != nil {
+		return err
+	}
+
+	tx.ops = append(tx.ops, diskOp{
+		key: diskKey{
+			diskSeries: diskSeries{ticker: ticker, barLength: barLength},
+			timestamp:  snapTimestamp(ticker, timestamp, barLength),
+		},
+		kind: diskOpDelete,
+	})
+
+	return nil
+}
+
+func (d *DiskDB) NewTx(ctx context.Context) (*DiskTx, error) {
+	return &DiskTx{Tx: Tx{ctx: ctx}}, nil
+}
+
+func (d *DiskDB) Commit(tx *DiskTx) error {
+	defer d.rollback(tx)
+
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	entry := encodeDiskEntry(tx.ops)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.file.WriteAt(entry, d.size); err != nil {
+		// don't leave a partial entry behind for the next commit to append to
+		d.file.Truncate(d.size)
+		return fmt.Errorf("write: %w", err)
+	}
+
+	if d.sync {
+		if err := d.file.Sync(); err != nil {
+			d.file.Truncate(d.size)
+			return fmt.Errorf("sync: %w", err)
+		}
+	}
+
+	d.apply(tx.ops, d.size)
+	d.size += int64(len(entry))
+
+	return nil
+}
+
+// Scan implements Scanner.
+func (d *DiskDB) Scan(ctx context.Context, ticker string, barLength BarLength, from, to ptime.IMilliseconds, fn func(globals.Aggregate) bool) error {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		return err
+	}
+
+	series := diskSeries{ticker: ticker, barLength: barLength}
+
+	// read in batches, so fn can use the DB without deadlocking
+	const batchSize = 1024
+	batch := make([]globals.Aggregate, 0, batchSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		batch = batch[:0]
+
+		d.mu.RLock()
+		timestamps := d.series[series]
+		i := sort.Search(len(timestamps), func(i int) bool { return timestamps[i] >= from })
+		for ; i < len(timestamps) && timestamps[i] < to && len(batch) < batchSize; i++ {
+			ts := timestamps[i]
+			agg := globals.Aggregate{
+				Ticker:         ticker,
+				Timestamp:      ts,
+				StartTimestamp: ts,
+				EndTimestamp:   barEnd(ticker, ts, barLength),
+			}
+
+			if err := d.readValue(d.index[diskKey{diskSeries: series, timestamp: ts}], &agg); err != nil {
+				d.mu.RUnlock()
+				return err
+			}
+
+			batch = append(batch, agg)
+		}
+		d.mu.RUnlock()
+
+		for _, agg := range batch {
+			if !fn(agg) {
+				return nil
+			}
+		}
+
+		if len(batch) < batchSize {
+			return nil
+		}
+
+		from = batch[len(batch)-1].Timestamp + 1
+	}
+}
+
+// Range calls fn on every aggregate in the DB, in timestamp order for each ticker and bar length.
+func (d *DiskDB) Range(fn func(globals.Aggregate) bool) error {
+	d.mu.RLock()
+	series := make([]diskSeries, 0, len(d.series))
+	for s := range d.series {
+		series = append(series, s)
+	}
+	d.mu.RUnlock()
+
+	stopped := false
+	for _, s := range series {
+		if err := d.Scan(context.Background(), s.ticker, s.barLength, math.MinInt64, math.MaxInt64, func(agg globals.Aggregate) bool {
+			stopped = !fn(agg)
+			return !stopped
+		}); err != nil {
+			return err
+		}
+
+		if stopped {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Compact rewrites the log so that it only contains the latest value for every live key.
+// Commits and reads are blocked while it runs.
+func (d *DiskDB) Compact() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tmpPath := d.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	index := make(map[diskKey]int64, len(d.index))
+	states := make(map[diskKey]diskStateRef, len(d.states))
+	var size int64
+
+	bw := bufio.NewWriter(tmp)
+	flush := func(ops []diskOp) error {
+		entry := encodeDiskEntry(ops)
+		if _, err := bw.Write(entry); err != nil {
+			return err
+		}
+
+		for i, offset := range diskValueOffsets(ops) {
+			if ops[i].kind == diskOpState {
+				states[ops[i].key] = diskStateRef{offset: size + offset + 4, length: uint32(len(ops[i].state))}
+			} else {
+				index[ops[i].key] = size + offset
+			}
+		}
+		size += int64(len(entry))
+
+		return nil
+	}
+
+	const batchSize = 1024
+	ops := make([]diskOp, 0, batchSize)
+	add := func(op diskOp) error {
+		ops = append(ops, op)
+		if len(ops) < batchSize {
+			return nil
+		}
+
+		if err := flush(ops); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+		ops = ops[:0]
+
+		return nil
+	}
+
+	for key, offset := range d.index {
+		op := diskOp{key: key, kind: diskOpUpsert}
+		if err := d.readValue(offset, &op.aggregate); err != nil {
+			tmp.Close()
+			return err
+		}
+
+		op.aggregate.Ticker = key.ticker
+		op.aggregate.Timestamp = key.timestamp
+		if err := add(op); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	for key, ref := range d.states {
+		op := diskOp{key: key, kind: diskOpState, state: make([]byte, ref.length)}
+		if _, err := d.file.ReadAt(op.state, ref.offset); err != nil {
+			tmp.Close()
+			return fmt.Errorf("read state at offset %d: %w", ref.offset, err)
+		}
+
+		if err := add(op); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if len(ops) > 0 {
+		if err := flush(ops); err != nil {
+			tmp.Close()
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, d.path); err != nil {
+		tmp.Close()
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	d.file.Close()
+	d.file = tmp
+	d.size = size
+	d.garbage = 0
+	d.index = index
+	d.states = states
+
+	// the rename itself is only durable once the directory is synced
+	if err := syncDir(filepath.Dir(d.path)); err != nil {
+		return fmt.Errorf("sync directory: %w", err)
+	}
+
+	return nil
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// Garbage returns the number of bytes in the log that hold overwritten or deleted values,
+// which would be reclaimed by Compact.
+func (d *DiskDB) Garbage() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.garbage
+}
+
+// Close closes the underlying file. The DB must not be used afterwards.
+func (d *DiskDB) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.file.Close()
+}
+
+func (d *DiskDB) rollback(tx *DiskTx) {
+	if !tx.Empty() {
+		tx.lock.release()
+	}
+	*tx = DiskTx{}
+}
+
+// recover replays the log to rebuild the index, truncating any torn entry at the end. An entry that fails its
+// checksum can only be torn if it's the last one; anywhere else, the log is corrupt, and recover fails rather than
+// truncating the entries after it.
+func (d *DiskDB) recover() error {
+	info, err := d.file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	fileSize := info.Size()
+
+	br := bufio.NewReader(io.NewSectionReader(d.file, 0, math.MaxInt64))
+
+	var header [diskEntryHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			} else if errors.Is(err, io.ErrUnexpectedEOF) {
+				return d.truncateTornEntry()
+			}
+
+			return err
+		}
+
+		length := binary.LittleEndian.Uint32(header[0:4])
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+
+		// an entry that runs past the end of the file was torn, and its length can't be trusted to allocate it
+		end := d.size + diskEntryHeaderSize + int64(length)
+		if end > fileSize {
+			return d.truncateTornEntry()
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return err
+		}
+
+		if crc32.ChecksumIEEE(payload) != checksum {
+			if end == fileSize {
+				return d.truncateTornEntry()
+			}
+
+			return fmt.Errorf("%w: checksum mismatch in entry at offset %d", ErrCorruptLog, d.size)
+		}
+
+		ops, err := decodeDiskPayload(payload)
+		if err != nil {
+			return fmt.Errorf("entry at offset %d: %w", d.size, err)
+		}
+
+		d.apply(ops, d.size)
+		d.size = end
+	}
+}
+
+func (d *DiskDB) truncateTornEntry() error {
+	logrus.WithField("path", d.path).WithField("offset", d.size).Warn("truncating torn entry at end of log")
+
+	return d.file.Truncate(d.size)
+}
+
+// apply updates the index with the ops of the entry at the given offset. d.mu must be held for writing.
+func (d *DiskDB) apply(ops []diskOp, entryOffset int64) {
+	valueOffsets := diskValueOffsets(ops)
+	for i, op := range ops {
+		if op.kind == diskOpState {
+			if old, ok := d.states[op.key]; ok {
+				d.garbage += 4 + int64(old.length)
+			}
+			d.states[op.key] = diskStateRef{offset: entryOffset + valueOffsets[i] + 4, length: uint32(len(op.state))}
+
+			continue
+		}
+
+		_, exists := d.index[op.key]
+		if exists {
+			d.garbage += diskValueSize
+		}
+
+		if op.kind == diskOpDelete {
+			if old, ok := d.states[op.key]; ok {
+				d.garbage += 4 + int64(old.length)
+				delete(d.states, op.key)
+			}
+
+			if exists {
+				delete(d.index, op.key)
+				timestamps := d.series[op.key.diskSeries]
+				j := sort.Search(len(timestamps), func(j int) bool { return timestamps[j] >= op.key.timestamp })
+				d.series[op.key.diskSeries] = removeAt(timestamps, j)
+				if len(d.series[op.key.diskSeries]) == 0 {
+					delete(d.series, op.key.diskSeries)
+				}
+			}
+
+			continue
+		}
+
+		d.index[op.key] = entryOffset + valueOffsets[i]
+		if !exists {
+			timestamps := d.series[op.key.diskSeries]
+			j := sort.Search(len(timestamps), func(j int) bool { return timestamps[j] >= op.key.timestamp })
+			d.series[op.key.diskSeries] = insertAt(timestamps, j, op.key.timestamp)
+		}
+	}
+}
+
+func (d *DiskDB) readValue(offset int64, agg *globals.Aggregate) error {
+	var buf [diskValueSize]byte
+	if _, err := d.file.ReadAt(buf[:], offset); err != nil {
+		return fmt.Errorf("read value at offset %d: %w", offset, err)
+	}
+
+	agg.Open = math.Float64frombits(binary.LittleEndian.Uint64(buf[0:]))
+	agg.High = math.Float64frombits(binary.LittleEndian.Uint64(buf[8:]))
+	agg.Low = math.Float64frombits(binary.LittleEndian.Uint64(buf[16:]))
+	agg.Close = math.Float64frombits(binary.LittleEndian.Uint64(buf[24:]))
+	agg.Volume = math.Float64frombits(binary.LittleEndian.Uint64(buf[32:]))
+	agg.VWAP = math.Float64frombits(binary.LittleEndian.Uint64(buf[40:]))
+	setInteger(&agg.Transactions, int64(binary.LittleEndian.Uint64(buf[48:])))
+
+	return nil
+}
+
+// An entry is laid out as follows, with all integers little-endian:
+//
+//	length  uint32 (of the payload)
+//	crc32   uint32 (IEEE, of the payload)
+//	payload:
+//	  count uint32
+//	  count ops:
+//	    kind       uint8 (diskOpUpsert, diskOpDelete or diskOpState)
+//	    bar length uint8 (see barLengthID)
+//	    ticker     uint8 length, then bytes
+//	    bar spec   uint8 length, then bytes, if the bar length is barLengthSpecID
+//	    timestamp  int64
+//	    value      diskValueSize bytes, for upserts only
+//	    state      uint32 length, then bytes, for states only
+func encodeDiskEntry(ops []diskOp) []byte {
+	buf := make([]byte, diskEntryHeaderSize+4, diskEntryHeaderSize+4+len(ops)*(11+diskValueSize+8))
+	binary.LittleEndian.PutUint32(buf[diskEntryHeaderSize:], uint32(len(ops)))
+
+	for _, op := range ops {
+		id := barLengthID(op.key.barLength)
+		buf = append(buf, op.kind, id, uint8(len(op.key.ticker)))
+		buf = append(buf, op.key.ticker...)
+		if id == barLengthSpecID {
+			buf = append(buf, uint8(len(op.key.barLength)))
+			buf = append(buf, op.key.barLength...)
+		}
+		buf = appendUint64(buf, uint64(op.key.timestamp))
+
+		switch op.kind {
+		case diskOpState:
+			var length [4]byte
+			binary.LittleEndian.PutUint32(length[:], uint32(len(op.state)))
+			buf = append(buf, length[:]...)
+			buf = append(buf, op.state...)
+		case diskOpUpsert:
+			buf = appendUint64(buf, math.Float64bits(op.aggregate.Open))
+			buf = appendUint64(buf, math.Float64bits(op.aggregate.High))
+			buf = appendUint64(buf, math.Float64bits(op.aggregate.Low))
+			buf = appendUint64(buf, math.Float64bits(op.aggregate.Close))
+			buf = appendUint64(buf, math.Float64bits(op.aggregate.Volume))
+			buf = appendUint64(buf, math.Float64bits(op.aggregate.VWAP))
+			buf = appendUint64(buf, uint64(op.aggregate.Transactions))
+		}
+	}
+
+	payload := buf[diskEntryHeaderSize:]
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+
+	return buf
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+
+	return append(buf, b[:]...)
+}
+
+// diskValueOffsets returns the offset of each op's value, or state, relative to the start of its entry.
+func diskValueOffsets(ops []diskOp) []int64 {
+	offsets := make([]int64, len(ops))
+	offset := int64(diskEntryHeaderSize + 4)
+	for i, op := range ops {
+		offset += 3 + int64(len(op.key.ticker)) + 8
+		if barLengthID(op.key.barLength) == barLengthSpecID {
+			offset += 1 + int64(len(op.key.barLength))
+		}
+		offsets[i] = offset
+		switch op.kind {
+		case diskOpUpsert:
+			offset += diskValueSize
+		case diskOpState:
+			offset += 4 + int64(len(op.state))
+		}
+	}
+
+	return offsets
+}
+
+func decodeDiskPayload(payload []byte) ([]diskOp, error) {
+	if len(payload) < 4 {
+		return nil, ErrCorruptLog
+	}
+
+	count := binary.LittleEndian.Uint32(payload)
+	payload = payload[4:]
+
+	ops := make([]diskOp, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(payload) < 3 {
+			return nil, ErrCorruptLog
+		}
+
+		kind, barLengthID, tickerLen := payload[0], payload[1], int(payload[2])
+		payload = payload[3:]
+
+		if len(payload) < tickerLen {
+			return nil, ErrCorruptLog
+		}
+		ticker := string(payload[:tickerLen])
+		payload = payload[tickerLen:]
+
+		var barLength BarLength
+		if barLengthID == barLengthSpecID {
+			if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+				return nil, ErrCorruptLog
+			}
+			barLength = BarLength(payload[1 : 1+int(payload[0])])
+			payload = payload[1+int(payload[0]):]
+
+			if _, err := ParseBarSpec(barLength); err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrCorruptLog, err)
+			}
+		} else {
+			var err error
+			if barLength, err = barLengthFromID(barLengthID); err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrCorruptLog, err)
+			}
+		}
+
+		if len(payload) < 8 {
+			return nil, ErrCorruptLog
+		}
+
+		op := diskOp{
+			key: diskKey{
+				diskSeries: diskSeries{ticker: ticker, barLength: barLength},
+				timestamp:  ptime.IMilliseconds(binary.LittleEndian.Uint64(payload)),
+			},
+		}
+		payload = payload[8:]
+
+		op.kind = kind
+		switch kind {
+		case diskOpUpsert:
+			// the value is read back from the file on demand
+			if len(payload) < diskValueSize {
+				return nil, ErrCorruptLog
+			}
+			payload = payload[diskValueSize:]
+		case diskOpDelete:
+		case diskOpState:
+			if len(payload) < 4 {
+				return nil, ErrCorruptLog
+			}
+
+			length := binary.LittleEndian.Uint32(payload)
+			if uint64(len(payload)-4) < uint64(length) {
+				return nil, ErrCorruptLog
+			}
+			op.state = payload[4 : 4+length]
+			payload = payload[4+length:]
+		default:
+			return nil, fmt.Errorf("%w: unknown op %d", ErrCorruptLog, kind)
+		}
+
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
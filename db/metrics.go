@@ -0,0 +1,294 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/ptime"
+)
+
+// Metrics collects the latency, errors and transactions of instrumented DBs, and serves them over HTTP
+// in the Prometheus text format. One Metrics can be shared by several DBs, labeled by backend.
+type Metrics struct {
+	mu           sync.Mutex
+	latency      map[operationLabels]*histogram
+	errors       map[errorLabels]int64
+	transactions map[transactionLabels]int64
+	inFlight     map[string]int64
+}
+
+type operationLabels struct {
+	backend   string
+	operation string
+	barLength BarLength
+}
+
+type errorLabels struct {
+	operationLabels
+	errorType string
+}
+
+type transactionLabels struct {
+	backend string
+	outcome string
+}
+
+// Latency buckets, in seconds. They start much lower than is usual, since in-memory stores answer in microseconds.
+var metricsLatencyBuckets = []float64{1e-6, 4e-6, 16e-6, 64e-6, 256e-6, 1e-3, 4e-3, 16e-3, 64e-3, 256e-3, 1}
+
+type histogram struct {
+	counts []int64 // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+	count  int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		latency:      make(map[operationLabels]*histogram),
+		errors:       make(map[errorLabels]int64),
+		transactions: make(map[transactionLabels]int64),
+		inFlight:     make(map[string]int64),
+	}
+}
+
+func (m *Metrics) observe(labels operationLabels, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.latency[labels]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(metricsLatencyBuckets)+1)}
+		m.latency[labels] = h
+	}
+
+	seconds := elapsed.Seconds()
+	h.counts[sort.SearchFloat64s(metricsLatencyBuckets, seconds)]++
+	h.sum += seconds
+	h.count++
+
+	if err != nil {
+		m.errors[errorLabels{operationLabels: labels, errorType: errorType(err)}]++
+	}
+}
+
+func (m *Metrics) addInFlight(backend string, delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inFlight[backend] += delta
+}
+
+func (m *Metrics) countTransaction(backend string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	outcome := "committed"
+	if err != nil {
+		outcome = "failed"
+	}
+	m.transactions[transactionLabels{backend: backend, outcome: outcome}]++
+}
+
+// errorType classifies an error for the type label of the errors metric.
+func errorType(err error) string {
+	switch {
+	case errors.Is(err, ErrLockTimeout):
+		return "lock_timeout"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, ErrInvalidBarLength):
+		return "invalid_bar_length"
+	default:
+		return "other"
+	}
+}
+
+// ServeHTTP writes every metric in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	const latencyName = "aggregates_db_operation_duration_seconds"
+	fmt.Fprintf(bw, "# HELP %s Latency of DB operations.\n# TYPE %s histogram\n", latencyName, latencyName)
+	latencyKeys := make([]operationLabels, 0, len(m.latency))
+	for labels := range m.latency {
+		latencyKeys = append(latencyKeys, labels)
+	}
+	sort.Slice(latencyKeys, func(i, j int) bool { return latencyKeys[i].less(latencyKeys[j]) })
+	for _, labels := range latencyKeys {
+		h := m.latency[labels]
+		l := labels.String()
+
+		var cumulative int64
+		for i, bound := range metricsLatencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(bw, "%s_bucket{%s,le=\"%s\"} %d\n", latencyName, l, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(bw, "%s_bucket{%s,le=\"+Inf\"} %d\n", latencyName, l, h.count)
+		fmt.Fprintf(bw, "%s_sum{%s} %s\n", latencyName, l, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(bw, "%s_count{%s} %d\n", latencyName, l, h.count)
+	}
+
+	const errorsName = "aggregates_db_errors_total"
+	fmt.Fprintf(bw, "# HELP %s Errors returned by DB operations, by type.\n# TYPE %s counter\n", errorsName, errorsName)
+	errorKeys := make([]errorLabels, 0, len(m.errors))
+	for labels := range m.errors {
+		errorKeys = append(errorKeys, labels)
+	}
+	sort.Slice(errorKeys, func(i, j int) bool {
+		if errorKeys[i].operationLabels != errorKeys[j].operationLabels {
+			return errorKeys[i].operationLabels.less(errorKeys[j].operationLabels)
+		}
+		return errorKeys[i].errorType < errorKeys[j].errorType
+	})
+	for _, labels := range errorKeys {
+		fmt.Fprintf(bw, "%s{%s,type=%s} %d\n", errorsName, labels.operationLabels, quoteLabel(labels.errorType), m.errors[labels])
+	}
+
+	const transactionsName = "aggregates_db_transactions_total"
+	fmt.Fprintf(bw, "# HELP %s Committed transactions, by whether the commit failed.\n# TYPE %s counter\n", transactionsName, transactionsName)
+	transactionKeys := make([]transactionLabels, 0, len(m.transactions))
+	for labels := range m.transactions {
+		transactionKeys = append(transactionKeys, labels)
+	}
+	sort.Slice(transactionKeys, func(i, j int) bool {
+		if transactionKeys[i].backend != transactionKeys[j].backend {
+			return transactionKeys[i].backend < transactionKeys[j].backend
+		}
+		return transactionKeys[i].outcome < transactionKeys[j].outcome
+	})
+	for _, labels := range transactionKeys {
+		fmt.Fprintf(bw, "%s{backend=%s,outcome=%s} %d\n", transactionsName, quoteLabel(labels.backend), quoteLabel(labels.outcome), m.transactions[labels])
+	}
+
+	const inFlightName = "aggregates_db_transactions_in_flight"
+	fmt.Fprintf(bw, "# HELP %s Transactions started but not yet committed.\n# TYPE %s gauge\n", inFlightName, inFlightName)
+	backends := make([]string, 0, len(m.inFlight))
+	for backend := range m.inFlight {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+	for _, backend := range backends {
+		fmt.Fprintf(bw, "%s{backend=%s} %d\n", inFlightName, quoteLabel(backend), m.inFlight[backend])
+	}
+}
+
+func (l operationLabels) String() string {
+	return fmt.Sprintf("backend=%s,operation=%s,bar_length=%s", quoteLabel(l.backend), quoteLabel(l.operation), quoteLabel(string(l.barLength)))
+}
+
+func (l operationLabels) less(o operationLabels) bool {
+	if l.backend != o.backend {
+		return l.backend < o.backend
+	}
+	if l.operation != o.operation {
+		return l.operation < o.operation
+	}
+	return l.barLength < o.barLength
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
+
+// InstrumentedDB wraps a DB, recording the latency and errors of every operation in a Metrics.
+type InstrumentedDB[Tx any] struct {
+	db      DB[Tx]
+	backend string
+	metrics *Metrics
+}
+
+var _ DB[Tx] = &InstrumentedDB[Tx]{}
+
+// Instrument wraps db, labeling its metrics with the backend name.
+func Instrument[Tx any](db DB[Tx], backend string, metrics *Metrics) *InstrumentedDB[Tx] {
+	return &InstrumentedDB[Tx]{
+		db:      db,
+		backend: backend,
+		metrics: metrics,
+	}
+}
+
+func (i *InstrumentedDB[Tx]) Get(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) (globals.Aggregate, error) {
+	start := time.Now()
+	agg, err := i.db.Get(tx, ticker, timestamp, barLength)
+	i.metrics.observe(operationLabels{backend: i.backend, operation: "get", barLength: barLength}, time.Since(start), err)
+
+	return agg, err
+}
+
+func (i *InstrumentedDB[Tx]) Upsert(tx *Tx, aggregate globals.Aggregate) error {
+	// an invalid bar length is recorded with an empty label
+	barLength, _ := getBarLength(aggregate)
+
+	start := time.Now()
+	err := i.db.Upsert(tx, aggregate)
+	i.metrics.observe(operationLabels{backend: i.backend, operation: "upsert", barLength: barLength}, time.Since(start), err)
+
+	return err
+}
+
+func (i *InstrumentedDB[Tx]) GetState(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) ([]byte, error) {
+	start := time.Now()
+	state, err := i.db.GetState(tx, ticker, timestamp, barLength)
+	i.metrics.observe(operationLabels{backend: i.backend, operation: "get_state", barLength: barLength}, time.Since(start), err)
+
+	return state, err
+}
+
+func (i *InstrumentedDB[Tx]) UpsertState(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength, state []byte) error {
+	start := time.Now()
+	err := i.db.UpsertState(tx, ticker, timestamp, barLength, state)
+	i.metrics.observe(operationLabels{backend: i.backend, operation: "upsert_state", barLength: barLength}, time.Since(start), err)
+
+	return err
+}
+
+func (i *InstrumentedDB[Tx]) Delete(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) error {
+	start := time.Now()
+	err := i.db.Delete(tx, ticker, timestamp, barLength)
+	i.metrics.observe(operationLabels{backend: i.backend, operation: "delete", barLength: barLength}, time.Since(start), err)
+
+	return err
+}
+
+func (i *InstrumentedDB[Tx]) NewTx(ctx context.Context) (*Tx, error) {
+	start := time.Now()
+	tx, err := i.db.NewTx(ctx)
+	i.metrics.observe(operationLabels{backend: i.backend, operation: "new_tx"}, time.Since(start), err)
+
+	if err == nil {
+		i.metrics.addInFlight(i.backend, 1)
+	}
+
+	return tx, err
+}
+
+func (i *InstrumentedDB[Tx]) Commit(tx *Tx) error {
+	start := time.Now()
+	err := i.db.Commit(tx)
+	i.metrics.observe(operationLabels{backend: i.backend, operation: "commit"}, time.Since(start), err)
+
+	i.metrics.addInFlight(i.backend, -1)
+	i.metrics.countTransaction(i.backend, err)
+
+	return err
+}
@@ -0,0 +1,22 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package db
+
+import (
+	"io"
+	"os"
+)
+
+// mmap falls back to reading the whole file into memory on platforms without mmap support.
+func mmap(f *os.File, size int) (data []byte, mapped bool, err error) {
+	data = make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, false, err
+	}
+
+	return data, false, nil
+}
+
+func munmap(data []byte) error {
+	return nil
+}
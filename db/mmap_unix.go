@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package db
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmap maps the first size bytes of the file read-only. mapped reports whether munmap must be called on the result.
+func mmap(f *os.File, size int) (data []byte, mapped bool, err error) {
+	data, err = syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return data, true, nil
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
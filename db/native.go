@@ -2,12 +2,17 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/polygon-io/go-lib-models/v2/globals"
 	"github.com/polygon-io/ptime"
 	"github.com/sirupsen/logrus"
+	"github.com/suremarc/go-lib-aggregates/tracing"
 )
 
 type index struct {
@@ -16,23 +21,37 @@ type index struct {
 	barLength BarLength
 }
 
-type NativeDB struct {
+// NativeStore is an in-memory Store of any aggregate type described by a Schema.
+type NativeStore[A comparable] struct {
+	schema      Schema[A]
 	lockManager lockManager
 	data        sync.Map
+	states      sync.Map
 	lastUpdated sync.Map
 	ttl         map[BarLength]time.Duration
 	flushTicker *time.Ticker
 }
 
+// NativeDB is a NativeStore of globals.Aggregate.
+type NativeDB = NativeStore[globals.Aggregate]
+
 var _ DB[Tx] = &NativeDB{}
 
 func NewNativeDB(ttl bool) *NativeDB {
-	n := &NativeDB{}
+	return NewNativeStore(AggregateSchema, ttl)
+}
+
+// NewNativeStore creates a NativeStore of the aggregate type described by schema.
+// If ttl is set, aggregates expire on the same schedule as NativeDB's.
+func NewNativeStore[A comparable](schema Schema[A], ttl bool) *NativeStore[A] {
+	n := &NativeStore[A]{schema: schema}
 	if ttl {
 		n.ttl = map[BarLength]time.Duration{
 			BarLengthSecond: time.Minute * 15,
 			BarLengthMinute: time.Minute * 15,
+			BarLengthHour:   time.Hour,
 			BarLengthDay:    time.Hour * 24,
+			BarLengthWeek:   time.Hour * 24 * 7,
 		}
 		n.flushTicker = time.NewTicker(time.Minute * 15)
 		go func() {
@@ -46,40 +65,50 @@ func NewNativeDB(ttl bool) *NativeDB {
 	return n
 }
 
-func (n *NativeDB) Get(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) (globals.Aggregate, error) {
-	n.maybeAcquireLock(tx, ticker)
+// ErrLockTimeout is returned when a transaction's context is done before it could acquire the lock for a ticker.
+var ErrLockTimeout = errors.New("timed out acquiring lock")
+
+func (n *NativeStore[A]) Get(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) (A, error) {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		var zero A
+		return zero, err
+	}
+
+	if err := n.maybeAcquireLock(tx, ticker); err != nil {
+		var zero A
+		return zero, err
+	}
 
 	index := index{
 		ticker:    ticker,
-		timestamp: snapTimestamp(timestamp),
+		timestamp: snapTimestamp(ticker, timestamp, barLength),
 		barLength: barLength,
 	}
 
-	duration, err := getBarLengthDuration(barLength)
+	key, err := newBarKey(index.ticker, index.timestamp, barLength)
 	if err != nil {
 		panic(err.Error())
 	}
 
-	val, _ := n.data.LoadOrStore(index, globals.Aggregate{
-		Ticker:         index.ticker,
-		Timestamp:      index.timestamp,
-		StartTimestamp: index.timestamp,
-		EndTimestamp:   index.timestamp + ptime.IMillisecondsFromDuration(duration),
-	})
-	return val.(globals.Aggregate), nil
+	val, _ := n.data.LoadOrStore(index, n.schema.New(key))
+	return val.(A), nil
 }
 
-func (n *NativeDB) Upsert(tx *Tx, aggregate globals.Aggregate) error {
-	n.maybeAcquireLock(tx, aggregate.Ticker)
+func (n *NativeStore[A]) Upsert(tx *Tx, aggregate A) error {
+	key := n.schema.Key(aggregate)
+	if err := n.maybeAcquireLock(tx, key.Ticker); err != nil {
+		return err
+	}
 
-	barLength, err := getBarLength(aggregate)
+	barLength, err := key.BarLength()
 	if err != nil {
 		panic(err.Error())
 	}
 
 	index := index{
-		ticker:    aggregate.Ticker,
-		timestamp: aggregate.Timestamp,
+		ticker:    key.Ticker,
+		timestamp: key.Start,
 		barLength: barLength,
 	}
 
@@ -89,31 +118,88 @@ func (n *NativeDB) Upsert(tx *Tx, aggregate globals.Aggregate) error {
 	return nil
 }
 
-func (n *NativeDB) Delete(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) error {
-	n.maybeAcquireLock(tx, ticker)
+func (n *NativeStore[A]) GetState(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) ([]byte, error) {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := n.maybeAcquireLock(tx, ticker); err != nil {
+		return nil, err
+	}
+
+	index := index{
+		ticker:    ticker,
+		timestamp: snapTimestamp(ticker, timestamp, barLength),
+		barLength: barLength,
+	}
+
+	val, ok := n.states.Load(index)
+	if !ok {
+		return nil, nil
+	}
+
+	return val.([]byte), nil
+}
+
+func (n *NativeStore[A]) UpsertState(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength, state []byte) error {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		return err
+	}
+
+	if err := n.maybeAcquireLock(tx, ticker); err != nil {
+		return err
+	}
+
+	index := index{
+		ticker:    ticker,
+		timestamp: snapTimestamp(ticker, timestamp, barLength),
+		barLength: barLength,
+	}
+
+	// the caller may reuse its buffer
+	n.states.Store(index, append([]byte(nil), state...))
+
+	return nil
+}
+
+func (n *NativeStore[A]) Delete(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) error {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		return err
+	}
+
+	if err := n.maybeAcquireLock(tx, ticker); err != nil {
+		return err
+	}
 
 	index := index{
 		ticker:    ticker,
-		timestamp: snapTimestamp(timestamp),
+		timestamp: snapTimestamp(ticker, timestamp, barLength),
 		barLength: barLength,
 	}
 
 	n.data.Delete(index)
+	n.states.Delete(index)
 
 	return nil
 }
 
-func (n *NativeDB) Flush() {
+func (n *NativeStore[A]) Flush() {
 	n.data.Range((func(key, value any) bool {
 		index := key.(index)
 		var tx Tx
-		n.maybeAcquireLock(&tx, index.ticker)
+		if err := n.maybeAcquireLock(&tx, index.ticker); err != nil {
+			logrus.WithField("index", index).WithError(err).Error("couldn't acquire lock")
+			return true
+		}
 		defer n.Commit(&tx)
 
 		lastUpdatedNanosAny, _ := n.lastUpdated.LoadOrStore(index, ptime.INanosecondsFromTime(time.Now()))
 		lastUpdatedNanos := lastUpdatedNanosAny.(ptime.INanoseconds).ToDuration().Nanoseconds()
 
-		ttl, ok := n.ttl[index.barLength]
+		ttl, ok := lookupTTL(n.ttl, index.barLength)
 		if ok && time.Since(time.Unix(lastUpdatedNanos/1_000_000_000, lastUpdatedNanos%1_000_000_000)) > ttl {
 			if err := n.Delete(&tx, index.ticker, index.timestamp.ToINanoseconds(), index.barLength); err != nil {
 				logrus.WithField("index", index).WithError(err).Error("couldn't delete row")
@@ -124,49 +210,170 @@ func (n *NativeDB) Flush() {
 	}))
 }
 
-func (n *NativeDB) NewTx(context.Context) (*Tx, error) {
-	return &Tx{}, nil
+func (n *NativeStore[A]) NewTx(ctx context.Context) (*Tx, error) {
+	return &Tx{ctx: ctx}, nil
 }
 
-func (n *NativeDB) Commit(tx *Tx) error {
-	tx.lock.Unlock()
+func (n *NativeStore[A]) Commit(tx *Tx) error {
+	if !tx.Empty() {
+		tx.lock.release()
+	}
 	*tx = Tx{}
 
 	return nil
 }
 
-func (n *NativeDB) Range(fn func(globals.Aggregate) bool) {
+func (n *NativeStore[A]) Range(fn func(A) bool) {
 	n.data.Range(func(key, value any) bool {
-		return fn(value.(globals.Aggregate))
+		return fn(value.(A))
 	})
 }
 
-func (h *NativeDB) maybeAcquireLock(tx *Tx, ticker string) {
-	if tx.Empty() {
-		tx.ticker = ticker
-		tx.lock = h.lockManager.acquire(ticker)
-	} else if tx.ticker != ticker {
-		panic("cannot acquire lock on multiple tickers")
-	}
+// LockStats returns contention statistics for every ticker that has been locked so far,
+// sorted so that the tickers with the most time spent waiting come first.
+func (n *NativeStore[A]) LockStats() []LockStats {
+	return n.lockManager.stats()
+}
+
+func (h *NativeStore[A]) maybeAcquireLock(tx *Tx, ticker string) error {
+	return h.lockManager.maybeAcquire(tx, ticker)
 }
 
 type Tx struct {
+	ctx    context.Context
 	ticker string
-	lock   *sync.Mutex
+	lock   *tickerLock
 }
 
 func (t *Tx) Empty() bool {
 	return t.lock == nil
 }
 
+// LockStats summarizes how contended the lock for a single ticker has been.
+type LockStats struct {
+	Ticker string
+	// Acquisitions is the number of times the lock was successfully acquired.
+	Acquisitions int64
+	// Contended is the number of acquisitions that had to wait for another transaction.
+	Contended int64
+	// Timeouts is the number of acquisitions abandoned because the transaction's context was done.
+	Timeouts int64
+	// TotalWait is the cumulative time spent waiting for the lock, including abandoned attempts.
+	TotalWait time.Duration
+	// MaxWait is the longest single wait for the lock.
+	MaxWait time.Duration
+}
+
+// tickerLock is a mutex that can be acquired with a context, implemented as a semaphore of size one.
+type tickerLock struct {
+	sem chan struct{}
+
+	acquisitions int64
+	contended    int64
+	timeouts     int64
+	waitNanos    int64
+	maxWaitNanos int64
+}
+
+func newTickerLock() *tickerLock {
+	return &tickerLock{sem: make(chan struct{}, 1)}
+}
+
+func (t *tickerLock) release() {
+	<-t.sem
+}
+
+func (t *tickerLock) recordWait(wait time.Duration) {
+	atomic.AddInt64(&t.waitNanos, int64(wait))
+	for {
+		max := atomic.LoadInt64(&t.maxWaitNanos)
+		if int64(wait) <= max || atomic.CompareAndSwapInt64(&t.maxWaitNanos, max, int64(wait)) {
+			return
+		}
+	}
+}
+
 type lockManager struct {
 	locks sync.Map
 }
 
-func (l *lockManager) acquire(ticker string) *sync.Mutex {
-	v, _ := l.locks.LoadOrStore(ticker, &sync.Mutex{})
-	lock := v.(*sync.Mutex)
-	lock.Lock()
+// maybeAcquire acquires the lock for the ticker on behalf of the transaction, if it does not hold it already.
+func (l *lockManager) maybeAcquire(tx *Tx, ticker string) error {
+	if tx.Empty() {
+		ctx := tx.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		_, span := tracing.Start(ctx, "db.Lock", tracing.String("ticker", ticker))
+		lock, err := l.acquire(ctx, ticker)
+		span.End(err)
+		if err != nil {
+			return err
+		}
+
+		tx.ticker = ticker
+		tx.lock = lock
+	} else if tx.ticker != ticker {
+		panic("cannot acquire lock on multiple tickers")
+	}
+
+	return nil
+}
+
+func (l *lockManager) acquire(ctx context.Context, ticker string) (*tickerLock, error) {
+	v, ok := l.locks.Load(ticker)
+	if !ok {
+		v, _ = l.locks.LoadOrStore(ticker, newTickerLock())
+	}
+	lock := v.(*tickerLock)
+
+	if err := ctx.Err(); err != nil {
+		atomic.AddInt64(&lock.timeouts, 1)
+		return nil, fmt.Errorf("%w on %s: %s", ErrLockTimeout, ticker, err)
+	}
+
+	// fast path: the lock is free
+	select {
+	case lock.sem <- struct{}{}:
+		atomic.AddInt64(&lock.acquisitions, 1)
+		return lock, nil
+	default:
+	}
+
+	start := time.Now()
+	select {
+	case lock.sem <- struct{}{}:
+		lock.recordWait(time.Since(start))
+		atomic.AddInt64(&lock.contended, 1)
+		atomic.AddInt64(&lock.acquisitions, 1)
+		return lock, nil
+	case <-ctx.Done():
+		lock.recordWait(time.Since(start))
+		atomic.AddInt64(&lock.timeouts, 1)
+		return nil, fmt.Errorf("%w on %s: %s", ErrLockTimeout, ticker, ctx.Err())
+	}
+}
+
+func (l *lockManager) stats() []LockStats {
+	var stats []LockStats
+	l.locks.Range(func(key, value any) bool {
+		lock := value.(*tickerLock)
+		stats = append(stats, LockStats{
+			Ticker:       key.(string),
+			Acquisitions: atomic.LoadInt64(&lock.acquisitions),
+			Contended:    atomic.LoadInt64(&lock.contended),
+			Timeouts:     atomic.LoadInt64(&lock.timeouts),
+			TotalWait:    time.Duration(atomic.LoadInt64(&lock.waitNanos)),
+			MaxWait:      time.Duration(atomic.LoadInt64(&lock.maxWaitNanos)),
+		})
+
+		return true
+	})
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].TotalWait > stats[j].TotalWait
+	})
 
-	return lock
+	return stats
 }
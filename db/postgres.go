@@ -0,0 +1,266 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/polygon-io/ptime"
+)
+
+// WithDailyPartitions creates the aggregates table with native Postgres range partitions, one per UTC day of
+// timestamps, named after the table like aggregates_20220624. Partitions are created on demand, the first time a bar is written to
+// them, and MaintainPartitions drops the partitions that end more than retention ago. A retention of 0 keeps every
+// partition. It is only supported by Postgres, and can't be used on an existing unpartitioned table.
+func WithDailyPartitions(retention time.Duration) SQLOption {
+	return func(s *sqlOptions) {
+		s.partitioned = true
+		s.retention = retention
+	}
+}
+
+const (
+	pgCreatePartitionedTableStmt = `CREATE TABLE IF NOT EXISTS %[1]s (
+	ticker VARCHAR(24) NOT NULL,
+	%[5]s
+	timestamp BIGINT NOT NULL,
+	bar_length VARCHAR(16) NOT NULL,
+	PRIMARY KEY (ticker, timestamp, bar_length)
+) PARTITION BY RANGE (timestamp)`
+
+	// Partitions are created as standalone tables and then attached, since CREATE TABLE ... PARTITION OF needs an
+	// ACCESS EXCLUSIVE lock on the table, which would wait on the transaction writing the bar that needs the
+	// partition, whereas ATTACH PARTITION only needs a SHARE UPDATE EXCLUSIVE one.
+	pgCreatePartitionTableStmt = `CREATE TABLE IF NOT EXISTS %s (LIKE %s INCLUDING DEFAULTS INCLUDING CONSTRAINTS)`
+	pgAttachPartitionStmt      = `ALTER TABLE %s ATTACH PARTITION %s FOR VALUES FROM (%d) TO (%d)`
+	pgListPartitionsStmt       = `SELECT c.relname FROM pg_inherits i
+	JOIN pg_class c ON c.oid = i.inhrelid
+	JOIN pg_class p ON p.oid = i.inhparent
+	WHERE p.relname = $1`
+	pgIsPartitionStmt = `SELECT EXISTS (SELECT 1 FROM pg_inherits i
+	JOIN pg_class c ON c.oid = i.inhrelid
+	JOIN pg_class p ON p.oid = i.inhparent
+	WHERE p.relname = $1 AND c.relname = $2)`
+	pgDeleteExpiredStatesStmt = `DELETE FROM %[1]s_states WHERE timestamp<$1`
+
+	// The staging table holds a bulk load until it's merged into the table, since COPY can't upsert.
+	// DISTINCT ON keeps one row per bar, since a single INSERT can't update the same row twice.
+	pgCreateStagingTableStmt = `CREATE TEMP TABLE %[1]s_staging (LIKE %[1]s INCLUDING DEFAULTS) ON COMMIT DROP`
+	pgMergeStagingStmt       = `INSERT INTO %[1]s (ticker, timestamp, bar_length, %[2]s)
+	SELECT DISTINCT ON (ticker, timestamp, bar_length) ticker, timestamp, bar_length, %[2]s FROM %[1]s_staging
+	ON CONFLICT (ticker, timestamp, bar_length) DO UPDATE SET %[4]s`
+
+	// SQLite compares text bytewise by default, but Postgres uses the database's collation, which usually ignores
+	// punctuation, e.g. sorting BFAM before BF.B
+	pgSelectAllStmt = `SELECT ticker, bar_length, timestamp, %[2]s FROM %[1]s ORDER BY ticker COLLATE "C", bar_length COLLATE "C", timestamp`
+
+	// bar_length was CHAR(3) before bar specs, which don't fit
+	pgWidenBarLengthStmt       = `ALTER TABLE %[1]s ALTER COLUMN bar_length TYPE VARCHAR(16)`
+	pgWidenStatesBarLengthStmt = `ALTER TABLE %[1]s_states ALTER COLUMN bar_length TYPE VARCHAR(16)`
+
+	pgPartitionDateFormat = "20060102"
+	// how many days of partitions MaintainPartitions creates in advance
+	pgPartitionsAhead = 2
+)
+
+var msPerDay = ptime.IMillisecondsFromDuration(24 * time.Hour)
+
+// BulkLoad writes every aggregate produced by source with COPY, which is much faster than upserting them one by one.
+// source is called once with a function that accepts each aggregate, and should stop when it returns false;
+// NativeStore.Range, for example, can be passed directly. Existing bars are replaced.
+// It is only supported by Postgres, and returns the number of aggregates loaded.
+func (s *SQLStore[A]) BulkLoad(ctx context.Context, source func(fn func(A) bool)) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, s.stmt(pgCreateStagingTableStmt)); err != nil {
+		return 0, fmt.Errorf("create staging table: %w", err)
+	}
+
+	columns := []string{"ticker", "timestamp", "bar_length"}
+	for _, f := range s.schema.Fields {
+		columns = append(columns, f.Name)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(s.table+"_staging", columns...))
+	if err != nil {
+		return 0, fmt.Errorf("prepare copy: %w", err)
+	}
+	defer stmt.Close()
+
+	var n int64
+	var copyErr error
+	days := make(map[ptime.IMilliseconds]struct{})
+	source(func(agg A) bool {
+		key := s.schema.Key(agg)
+		barLength, err := key.BarLength()
+		if err != nil {
+			copyErr = fmt.Errorf("aggregate %s/%d: %w", key.Ticker, key.Start, err)
+			return false
+		}
+
+		args := append([]interface{}{key.Ticker, int64(key.Start), string(barLength)}, s.values(agg)...)
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			copyErr = fmt.Errorf("copy: %w", err)
+			return false
+		}
+
+		days[key.Start/msPerDay] = struct{}{}
+		n++
+
+		return true
+	})
+	if copyErr != nil {
+		return 0, copyErr
+	}
+
+	// flush the buffered rows
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return 0, fmt.Errorf("copy: %w", err)
+	}
+
+	if s.partitioned {
+		for day := range days {
+			if err := s.ensurePartition(ctx, day*msPerDay); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, s.stmt(pgMergeStagingStmt)); err != nil {
+		return 0, fmt.Errorf("merge staging table: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// MaintainPartitions creates the partitions for the next few days, so that writes at the start of a day don't wait on
+// DDL, and drops every partition that ended more than the retention before now.
+// It should be called periodically, e.g. daily.
+func (s *SQLStore[A]) MaintainPartitions(ctx context.Context, now time.Time) error {
+	if !s.partitioned {
+		return fmt.Errorf("partitions require WithDailyPartitions")
+	}
+
+	today := ptime.IMillisecondsFromTime(now) / msPerDay
+	for day := today; day <= today+pgPartitionsAhead; day++ {
+		if err := s.ensurePartition(ctx, day*msPerDay); err != nil {
+			return err
+		}
+	}
+
+	if s.retention <= 0 {
+		return nil
+	}
+
+	names, err := s.listPartitions(ctx)
+	if err != nil {
+		return err
+	}
+
+	cutoff := now.Add(-s.retention)
+	for _, name := range names {
+		day, err := time.Parse(pgPartitionDateFormat, strings.TrimPrefix(name, s.table+"_"))
+		if err != nil {
+			// not one of ours
+			continue
+		}
+
+		if end := day.Add(24 * time.Hour); end.After(cutoff) {
+			continue
+		}
+
+		if _, err := s.db.ExecContext(ctx, "DROP TABLE IF EXISTS "+pq.QuoteIdentifier(name)); err != nil {
+			return fmt.Errorf("drop partition %s: %w", name, err)
+		}
+
+		s.partitions.Delete(ptime.IMillisecondsFromTime(day) / msPerDay)
+	}
+
+	// states aren't partitioned, so the states of the dropped bars are deleted by timestamp
+	if _, err := s.db.ExecContext(ctx, s.stmt(pgDeleteExpiredStatesStmt), ptime.IMillisecondsFromTime(cutoff)/msPerDay*msPerDay); err != nil {
+		return fmt.Errorf("delete expired states: %w", err)
+	}
+
+	return nil
+}
+
+// UpgradeSchema brings tables created by earlier versions up to date, which CREATE TABLE IF NOT EXISTS doesn't:
+// it widens their bar_length columns to hold bar specs. Altering a partitioned table alters its partitions.
+// It does nothing to tables that are already up to date. It is only supported by Postgres.
+func (s *SQLStore[A]) UpgradeSchema(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, s.stmt(pgWidenBarLengthStmt)); err != nil {
+		return fmt.Errorf("widen bar_length: %w", err)
+	}
+
+	if _, err := s.db.ExecContext(ctx, s.stmt(pgWidenStatesBarLengthStmt)); err != nil {
+		return fmt.Errorf("widen states bar_length: %w", err)
+	}
+
+	return nil
+}
+
+// postgres reports whether the store is backed by Postgres.
+func (s *SQLStore[A]) postgres() bool {
+	_, ok := s.db.Driver().(*pq.Driver)
+	return ok
+}
+
+func (s *SQLStore[A]) listPartitions(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, pgListPartitionsStmt, s.table)
+	if err != nil {
+		return nil, fmt.Errorf("list partitions: %w", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("list partitions: %w", err)
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// ensurePartition creates the partition containing the timestamp, unless it's already known to exist.
+// The partition is created outside of any transaction, so that it's visible to concurrent writers right away, and
+// attached rather than created in place, so that it doesn't wait on the caller's transaction.
+func (s *SQLStore[A]) ensurePartition(ctx context.Context, ts ptime.IMilliseconds) error {
+	day := ts / msPerDay
+	if _, ok := s.partitions.Load(day); ok {
+		return nil
+	}
+
+	start := day * msPerDay
+	name := s.table + "_" + start.ToTime().UTC().Format(pgPartitionDateFormat)
+
+	// IF NOT EXISTS doesn't stop concurrent creations from conflicting, and only one of them can attach the table,
+	// so the attachment is checked if either fails
+	_, createErr := s.db.ExecContext(ctx, fmt.Sprintf(pgCreatePartitionTableStmt, pq.QuoteIdentifier(name), s.table))
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(pgAttachPartitionStmt, s.table, pq.QuoteIdentifier(name), int64(start), int64(start+msPerDay)))
+	if err != nil {
+		var attached bool
+		if checkErr := s.db.QueryRowContext(ctx, pgIsPartitionStmt, s.table, name).Scan(&attached); checkErr != nil || !attached {
+			if createErr != nil {
+				err = createErr
+			}
+			return fmt.Errorf("create partition %s: %w", name, err)
+		}
+	}
+
+	s.partitions.Store(day, struct{}{})
+
+	return nil
+}
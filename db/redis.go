@@ -2,114 +2,738 @@ package db
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/polygon-io/go-lib-models/v2/globals"
 	"github.com/polygon-io/ptime"
-	"github.com/sirupsen/logrus"
 )
 
-type Redis struct {
-	client *redis.Client
-	ttl    map[BarLength]time.Duration
+// RedisStore is a Store of any aggregate type described by a Schema, backed by Redis.
+type RedisStore[A comparable] struct {
+	redisOptions
+	client redis.UniversalClient
+	schema Schema[A]
+
+	// encode and decode aggregates, except with the hash layout
+	marshal   func(A) ([]byte, error)
+	unmarshal func([]byte, *A) error
+}
+
+// Redis is a RedisStore of globals.Aggregate.
+type Redis = RedisStore[globals.Aggregate]
+
+type redisOptions struct {
+	ttl        map[BarLength]time.Duration
+	codec      Codec
+	hashLayout bool
+	namespace  string
+}
+
+// RedisOption configures optional behavior of a RedisStore.
+type RedisOption func(*redisOptions)
+
+// WithCodec sets the codec used to write aggregates. Values written by any codec can always be read,
+// so the codec can be changed without flushing the keyspace. The default is JSONCodec.
+// Codecs only apply to Redis; a RedisStore of another aggregate type encodes its schema's fields as JSON,
+// behind the same header.
+func WithCodec(codec Codec) RedisOption {
+	return func(r *redisOptions) {
+		r.codec = codec
+	}
+}
+
+// WithHashLayout stores each bar as a hash with one field per value, instead of as a single encoded string,
+// and indexes every ticker's bars in a sorted set per bar length, scored by timestamp.
+// This allows range scans and partial updates with IncrBy, at the cost of some memory.
+// The codec is not used with this layout.
+func WithHashLayout() RedisOption {
+	return func(r *redisOptions) {
+		r.hashLayout = true
+	}
+}
+
+// WithNamespace prefixes every key with the namespace, so that several environments can share one Redis.
+func WithNamespace(namespace string) RedisOption {
+	return func(r *redisOptions) {
+		r.namespace = namespace
+	}
 }
 
+// RedisTx is a transaction of a RedisStore. Redis can't lock keys, so transactions are optimistic: writes are queued
+// until Commit, which only applies them if no other transaction changed the keys that were read in the meantime,
+// and returns ErrConflict otherwise.
 type RedisTx struct {
-	ctx      context.Context
-	pipeline redis.Pipeliner
+	ctx    context.Context
+	writes []func(redis.Pipeliner)
+	// reads holds what each key read by the transaction held when it was first read.
+	reads map[string]redisSnapshot
+}
+
+// redisSnapshot is the value of a string key, or the sorted fields of a hash, in a form that can be compared.
+type redisSnapshot struct {
+	value  string
+	exists bool
+}
+
+// redisReader is what snapshots are read with: a client, or the connection of a WATCH.
+type redisReader interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+	HGetAll(ctx context.Context, key string) *redis.StringStringMapCmd
+}
+
+func (tx *RedisTx) queue(write func(redis.Pipeliner)) {
+	tx.writes = append(tx.writes, write)
+}
+
+// discard rolls the transaction back.
+func (tx *RedisTx) discard() {
+	tx.writes, tx.reads = nil, make(map[string]redisSnapshot)
+}
+
+// read records what a key held when the transaction first read it.
+func (tx *RedisTx) read(key string, snapshot redisSnapshot) {
+	if _, ok := tx.reads[key]; !ok {
+		tx.reads[key] = snapshot
+	}
 }
 
 var _ DB[RedisTx] = &Redis{}
+var _ Scanner = &Redis{}
+
+// ErrScanUnsupported is returned when scanning a Redis DB that doesn't use the hash layout.
+var ErrScanUnsupported = errors.New("scan requires the hash layout")
+
+// fields of a globals.Aggregate in the hash layout
+const (
+	redisFieldOpen         = "o"
+	redisFieldHigh         = "h"
+	redisFieldLow          = "l"
+	redisFieldClose        = "c"
+	redisFieldVolume       = "v"
+	redisFieldVWAP         = "vw"
+	redisFieldTransactions = "n"
+	// the bar's state, if any
+	redisFieldState = "s"
+)
 
-func NewRedis(client *redis.Client) *Redis {
-	return &Redis{
-		client: client,
-		ttl: map[BarLength]time.Duration{
-			BarLengthSecond: time.Minute * 15,
-			BarLengthMinute: time.Minute * 15,
-			BarLengthDay:    time.Hour * 24,
+// NewRedis creates a Redis DB. The client can be a single node or a cluster: every key is tagged with its ticker,
+// as in {AAPL}/1656000000000/min, so that all the keys for a ticker, and therefore every transaction, live in one slot.
+func NewRedis(client redis.UniversalClient, opts ...RedisOption) *Redis {
+	r := NewRedisStore(client, AggregateSchema, opts...)
+	r.marshal = func(agg globals.Aggregate) ([]byte, error) {
+		return EncodeAggregate(r.codec, agg)
+	}
+	r.unmarshal = DecodeAggregate
+
+	return r
+}
+
+// NewRedisStore creates a RedisStore of the aggregate type described by schema. See NewRedis for the key layout.
+func NewRedisStore[A comparable](client redis.UniversalClient, schema Schema[A], opts ...RedisOption) *RedisStore[A] {
+	r := &RedisStore[A]{
+		redisOptions: redisOptions{
+			ttl: map[BarLength]time.Duration{
+				BarLengthSecond: time.Minute * 15,
+				BarLengthMinute: time.Minute * 15,
+				BarLengthHour:   time.Hour,
+				BarLengthDay:    time.Hour * 24,
+				BarLengthWeek:   time.Hour * 24 * 7,
+			},
+			codec: JSONCodec,
 		},
+		client:    client,
+		schema:    schema,
+		marshal:   schema.marshalFields,
+		unmarshal: schema.unmarshalFields,
 	}
+
+	for _, opt := range opts {
+		opt(&r.redisOptions)
+	}
+
+	return r
 }
 
-func (r *Redis) Get(tx *RedisTx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) (globals.Aggregate, error) {
-	key := fmt.Sprintf("%s/%d/%s", ticker, snapTimestamp(timestamp), barLength)
+func (r *RedisStore[A]) Get(tx *RedisTx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) (A, error) {
+	var zero A
+
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		tx.discard()
+		return zero, err
+	}
+
+	ts := snapTimestamp(ticker, timestamp, barLength)
+	barKey, err := newBarKey(ticker, ts, barLength)
+	if err != nil {
+		tx.discard()
+		return zero, err
+	}
+
+	key := r.barKey(ticker, ts, barLength)
+	agg := r.schema.New(barKey)
 
-	result := tx.pipeline.Get(tx.ctx, key)
-	if result.Val() == "" {
-		duration, err := getBarLengthDuration(barLength)
+	// Reads can't go through the pipeline, since its results aren't available until it's executed.
+	var found bool
+	if r.hashLayout {
+		fields, err := r.client.HGetAll(tx.ctx, key).Result()
 		if err != nil {
-			tx.pipeline.Discard()
-			return globals.Aggregate{}, err
+			tx.discard()
+			return zero, err
 		}
 
-		ts := snapTimestamp(timestamp)
-		defaultAgg := globals.Aggregate{
-			Ticker:         ticker,
-			Timestamp:      ts,
-			StartTimestamp: ts,
-			EndTimestamp:   ts + ptime.IMillisecondsFromDuration(duration),
+		tx.read(key, hashSnapshot(fields))
+		if found = len(fields) > 0; found {
+			if err := r.parseHash(fields, &agg); err != nil {
+				tx.discard()
+				return zero, fmt.Errorf("parse %s: %w", key, err)
+			}
+		}
+	} else {
+		value, err := r.client.Get(tx.ctx, key).Bytes()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			tx.discard()
+			return zero, err
 		}
 
-		if err := r.Upsert(tx, defaultAgg); err != nil {
-			return globals.Aggregate{}, err
+		tx.read(key, redisSnapshot{value: string(value), exists: err == nil})
+		if found = err == nil; found {
+			if agg, err = r.decode(value, barKey); err != nil {
+				tx.discard()
+				return zero, fmt.Errorf("decode: %w", err)
+			}
 		}
+	}
 
-		return defaultAgg, nil
+	if !found {
+		if err := r.Upsert(tx, agg); err != nil {
+			return zero, err
+		}
 	}
 
-	if result.Err() != nil {
-		tx.pipeline.Discard()
-		return globals.Aggregate{}, result.Err()
+	return agg, nil
+}
+
+func (r *RedisStore[A]) Upsert(tx *RedisTx, aggregate A) error {
+	barKey := r.schema.Key(aggregate)
+	barLength, err := barKey.BarLength()
+	if err != nil {
+		tx.discard()
+		return err
 	}
 
-	logrus.Info(result.Val())
-	var agg globals.Aggregate
-	if err := json.Unmarshal([]byte(result.Val()), &agg); err != nil {
-		tx.pipeline.Discard()
-		return agg, fmt.Errorf("unmarshal: %w", err)
+	key := r.barKey(barKey.Ticker, barKey.Start, barLength)
+
+	if r.hashLayout {
+		values := make([]interface{}, 0, 2*len(r.schema.Fields))
+		for _, f := range r.schema.Fields {
+			values = append(values, f.hashField(), f.sqlValue(aggregate))
+		}
+		tx.queue(func(p redis.Pipeliner) { p.HSet(tx.ctx, key, values...) })
+		r.touch(tx, key, barKey.Ticker, barKey.Start, barLength)
+
+		return nil
 	}
 
-	return agg, nil
+	value, err := r.marshal(aggregate)
+	if err != nil {
+		tx.discard()
+		return err
+	}
+
+	tx.queue(func(p redis.Pipeliner) { p.Set(tx.ctx, key, value, r.barTTL(barLength)) })
+
+	return nil
 }
 
-func (r *Redis) Upsert(tx *RedisTx, aggregate globals.Aggregate) error {
-	barLength, err := getBarLength(aggregate)
+// GetState implements DB. With the hash layout, the state is a field of the bar's hash;
+// otherwise it's stored under its own key, next to the bar's.
+func (r *RedisStore[A]) GetState(tx *RedisTx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) ([]byte, error) {
+	barLength, err := resolveBarLength(ticker, barLength)
 	if err != nil {
-		tx.pipeline.Discard()
+		tx.discard()
+		return nil, err
+	}
+
+	key := r.barKey(ticker, snapTimestamp(ticker, timestamp, barLength), barLength)
+
+	if r.hashLayout {
+		// the whole hash is read, so that the transaction's snapshot of the bar covers its state
+		fields, err := r.client.HGetAll(tx.ctx, key).Result()
+		if err != nil {
+			tx.discard()
+			return nil, err
+		}
+
+		tx.read(key, hashSnapshot(fields))
+		state, ok := fields[redisFieldState]
+		if !ok {
+			return nil, nil
+		}
+
+		return []byte(state), nil
+	}
+
+	key = r.stateKey(key)
+	state, err := r.client.Get(tx.ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		tx.read(key, redisSnapshot{})
+		return nil, nil
+	} else if err != nil {
+		tx.discard()
+		return nil, err
+	}
+
+	tx.read(key, redisSnapshot{value: string(state), exists: true})
+	return state, nil
+}
+
+func (r *RedisStore[A]) UpsertState(tx *RedisTx, ticker string, timestamp ptime.INanoseconds, barLength BarLength, state []byte) error {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		tx.discard()
 		return err
 	}
 
-	aggregateJSON, err := aggregate.MarshalJSON()
+	ts := snapTimestamp(ticker, timestamp, barLength)
+	key := r.barKey(ticker, ts, barLength)
+
+	if r.hashLayout {
+		tx.queue(func(p redis.Pipeliner) { p.HSet(tx.ctx, key, redisFieldState, state) })
+		r.touch(tx, key, ticker, ts, barLength)
+
+		return nil
+	}
+
+	tx.queue(func(p redis.Pipeliner) { p.Set(tx.ctx, r.stateKey(key), state, r.barTTL(barLength)) })
+
+	return nil
+}
+
+// IncrBy atomically adds to the volume and number of transactions of a bar, without reading it first.
+// It requires the hash layout, and a schema with v and n hash fields, as AggregateSchema has.
+func (r *RedisStore[A]) IncrBy(tx *RedisTx, ticker string, timestamp ptime.INanoseconds, barLength BarLength, volume float64, transactions int64) error {
+	if !r.hashLayout {
+		tx.discard()
+		return errors.New("IncrBy requires the hash layout")
+	}
+
+	for _, name := range []string{redisFieldVolume, redisFieldTransactions} {
+		if _, err := r.schema.fieldByHashField(name); err != nil {
+			tx.discard()
+			return fmt.Errorf("IncrBy: %w", err)
+		}
+	}
+
+	barLength, err := resolveBarLength(ticker, barLength)
 	if err != nil {
-		tx.pipeline.Discard()
+		tx.discard()
 		return err
 	}
 
-	key := fmt.Sprintf("%s/%d/%s", aggregate.Ticker, aggregate.Timestamp, barLength)
-	tx.pipeline.Set(tx.ctx, string(key), aggregateJSON, r.ttl[barLength])
+	ts := snapTimestamp(ticker, timestamp, barLength)
+	key := r.barKey(ticker, ts, barLength)
+
+	tx.queue(func(p redis.Pipeliner) { p.HIncrByFloat(tx.ctx, key, redisFieldVolume, volume) })
+	tx.queue(func(p redis.Pipeliner) { p.HIncrBy(tx.ctx, key, redisFieldTransactions, transactions) })
+	r.touch(tx, key, ticker, ts, barLength)
 
 	return nil
 }
 
-func (r *Redis) Delete(tx *RedisTx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) error {
-	key := fmt.Sprintf("%s/%d/%s", ticker, timestamp, barLength)
-	tx.pipeline.Del(tx.ctx, key)
+func (r *RedisStore[A]) Delete(tx *RedisTx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) error {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		tx.discard()
+		return err
+	}
+
+	ts := snapTimestamp(ticker, timestamp, barLength)
+	key := r.barKey(ticker, ts, barLength)
+	tx.queue(func(p redis.Pipeliner) { p.Del(tx.ctx, key) })
+
+	if r.hashLayout {
+		tx.queue(func(p redis.Pipeliner) {
+			p.ZRem(tx.ctx, r.indexKey(ticker, barLength), strconv.FormatInt(int64(ts), 10))
+		})
+	} else {
+		tx.queue(func(p redis.Pipeliner) { p.Del(tx.ctx, r.stateKey(key)) })
+	}
 
 	return nil
 }
 
-func (r *Redis) NewTx(ctx context.Context) (*RedisTx, error) {
+func (r *RedisStore[A]) NewTx(ctx context.Context) (*RedisTx, error) {
 	return &RedisTx{
-		ctx:      ctx,
-		pipeline: r.client.TxPipeline(),
+		ctx:   ctx,
+		reads: make(map[string]redisSnapshot),
 	}, nil
 }
 
-func (r *Redis) Commit(tx *RedisTx) error {
-	_, err := tx.pipeline.Exec(tx.ctx)
+// Commit implements Store. It returns ErrConflict if another transaction changed a key that tx read, in which case
+// none of its writes are applied, and it can be retried from the start.
+func (r *RedisStore[A]) Commit(tx *RedisTx) error {
+	if len(tx.writes) == 0 {
+		return nil
+	}
+
+	exec := func(pipeline redis.Pipeliner) error {
+		for _, write := range tx.writes {
+			write(pipeline)
+		}
+		return nil
+	}
+
+	if len(tx.reads) == 0 {
+		_, err := r.client.TxPipelined(tx.ctx, exec)
+		return err
+	}
+
+	keys := make([]string, 0, len(tx.reads))
+	for key := range tx.reads {
+		keys = append(keys, key)
+	}
+
+	// once the keys are watched, EXEC fails if any of them changes, so they only need to be checked once
+	err := r.client.Watch(tx.ctx, func(watched *redis.Tx) error {
+		for key, read := range tx.reads {
+			current, err := r.snapshot(tx.ctx, watched, key)
+			if err != nil {
+				return err
+			} else if current != read {
+				return ErrConflict
+			}
+		}
+
+		_, err := watched.TxPipelined(tx.ctx, exec)
+		return err
+	}, keys...)
+	if errors.Is(err, redis.TxFailedErr) {
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+
 	return err
 }
+
+// snapshot reads what a key holds: a bar's hash with the hash layout, and a string otherwise.
+func (r *RedisStore[A]) snapshot(ctx context.Context, client redisReader, key string) (redisSnapshot, error) {
+	if r.hashLayout {
+		fields, err := client.HGetAll(ctx, key).Result()
+		if err != nil {
+			return redisSnapshot{}, err
+		}
+
+		return hashSnapshot(fields), nil
+	}
+
+	value, err := client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return redisSnapshot{}, nil
+	} else if err != nil {
+		return redisSnapshot{}, err
+	}
+
+	return redisSnapshot{value: value, exists: true}, nil
+}
+
+func hashSnapshot(fields map[string]string) redisSnapshot {
+	if len(fields) == 0 {
+		return redisSnapshot{}
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		// lengths delimit the names and values, which may contain any byte
+		fmt.Fprintf(&b, "%d:%s%d:%s", len(name), name, len(fields[name]), fields[name])
+	}
+
+	return redisSnapshot{value: b.String(), exists: true}
+}
+
+// Scan implements Scanner. It requires the hash layout.
+func (r *RedisStore[A]) Scan(ctx context.Context, ticker string, barLength BarLength, from, to ptime.IMilliseconds, fn func(A) bool) error {
+	if !r.hashLayout {
+		return ErrScanUnsupported
+	}
+
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		return err
+	}
+
+	indexKey := r.indexKey(ticker, barLength)
+
+	const batchSize = 1000
+	for {
+		members, err := r.client.ZRangeByScore(ctx, indexKey, &redis.ZRangeBy{
+			Min:   strconv.FormatInt(int64(from), 10),
+			Max:   "(" + strconv.FormatInt(int64(to), 10),
+			Count: batchSize,
+		}).Result()
+		if err != nil {
+			return err
+		}
+
+		timestamps := make([]ptime.IMilliseconds, len(members))
+		pipeline := r.client.Pipeline()
+		results := make([]*redis.StringStringMapCmd, len(members))
+		for i, member := range members {
+			ts, err := strconv.ParseInt(member, 10, 64)
+			if err != nil {
+				return fmt.Errorf("index %s has invalid member %q: %w", indexKey, member, err)
+			}
+
+			timestamps[i] = ptime.IMilliseconds(ts)
+			results[i] = pipeline.HGetAll(ctx, r.barKey(ticker, timestamps[i], barLength))
+		}
+
+		if len(members) > 0 {
+			if _, err := pipeline.Exec(ctx); err != nil {
+				return err
+			}
+		}
+
+		for i, result := range results {
+			fields := result.Val()
+			if len(fields) == 0 {
+				// the bar expired, but the index hasn't yet
+				r.client.ZRem(ctx, indexKey, members[i])
+				continue
+			}
+
+			agg := r.schema.New(BarKey{
+				Ticker: ticker,
+				Start:  timestamps[i],
+				End:    barEnd(ticker, timestamps[i], barLength),
+			})
+			if err := r.parseHash(fields, &agg); err != nil {
+				return fmt.Errorf("parse %s: %w", r.barKey(ticker, timestamps[i], barLength), err)
+			}
+
+			if !fn(agg) {
+				return nil
+			}
+		}
+
+		if len(members) < batchSize {
+			return nil
+		}
+
+		from = timestamps[len(timestamps)-1] + 1
+	}
+}
+
+// Range calls fn with every aggregate in the namespace, in no particular order, until it returns false.
+// With a cluster client, every master is scanned.
+func (r *RedisStore[A]) Range(ctx context.Context, fn func(A) bool) error {
+	cluster, ok := r.client.(*redis.ClusterClient)
+	if !ok {
+		return r.rangeNode(ctx, r.client, fn)
+	}
+
+	// masters are scanned concurrently
+	var mu sync.Mutex
+	var stopped bool
+	return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+		return r.rangeNode(ctx, client, func(agg A) bool {
+			mu.Lock()
+			defer mu.Unlock()
+
+			stopped = stopped || !fn(agg)
+			return !stopped
+		})
+	})
+}
+
+func (r *RedisStore[A]) rangeNode(ctx context.Context, client redis.Cmdable, fn func(A) bool) error {
+	pattern := r.keyPrefix() + "{*}/*/*"
+
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, pattern, 1000).Result()
+		if err != nil {
+			return err
+		}
+
+		barKeys := make([]BarKey, 0, len(keys))
+		aggKeys := make([]string, 0, len(keys))
+		values := make([]*redis.StringCmd, 0, len(keys))
+		fields := make([]*redis.StringStringMapCmd, 0, len(keys))
+		pipeline := client.Pipeline()
+		for _, key := range keys {
+			ticker, ts, barLength, ok := r.parseBarKey(key)
+			if !ok {
+				continue
+			}
+
+			barKey, _ := newBarKey(ticker, ts, barLength)
+			barKeys = append(barKeys, barKey)
+			aggKeys = append(aggKeys, key)
+
+			if r.hashLayout {
+				fields = append(fields, pipeline.HGetAll(ctx, key))
+			} else {
+				values = append(values, pipeline.Get(ctx, key))
+			}
+		}
+
+		if len(barKeys) > 0 {
+			// keys may have expired since they were scanned
+			if _, err := pipeline.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+				return err
+			}
+		}
+
+		for i, barKey := range barKeys {
+			agg := r.schema.New(barKey)
+
+			if r.hashLayout {
+				if len(fields[i].Val()) == 0 {
+					continue
+				}
+
+				if err := r.parseHash(fields[i].Val(), &agg); err != nil {
+					return fmt.Errorf("parse %s: %w", aggKeys[i], err)
+				}
+			} else {
+				value, err := values[i].Bytes()
+				if errors.Is(err, redis.Nil) {
+					continue
+				} else if err != nil {
+					return err
+				}
+
+				if agg, err = r.decode(value, barKey); err != nil {
+					return fmt.Errorf("decode %s: %w", aggKeys[i], err)
+				}
+			}
+
+			if !fn(agg) {
+				return nil
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// parseBarKey is the inverse of barKey.
+func (r *RedisStore[A]) parseBarKey(key string) (ticker string, ts ptime.IMilliseconds, barLength BarLength, ok bool) {
+	key = strings.TrimPrefix(key, r.keyPrefix())
+	end := strings.LastIndex(key, "}/")
+	if !strings.HasPrefix(key, "{") || end < 0 {
+		return "", 0, "", false
+	}
+
+	parts := strings.Split(key[end+2:], "/")
+	if len(parts) != 2 {
+		return "", 0, "", false
+	}
+
+	v, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", 0, "", false
+	}
+
+	barLength = BarLength(parts[1])
+	if _, err := getBarLengthDuration(barLength); err != nil {
+		return "", 0, "", false
+	}
+
+	return key[1:end], ptime.IMilliseconds(v), barLength, true
+}
+
+// touch adds the bar to its ticker's index and refreshes the TTLs of both.
+func (r *RedisStore[A]) touch(tx *RedisTx, key, ticker string, ts ptime.IMilliseconds, barLength BarLength) {
+	indexKey := r.indexKey(ticker, barLength)
+	tx.queue(func(p redis.Pipeliner) {
+		p.ZAdd(tx.ctx, indexKey, &redis.Z{Score: float64(ts), Member: strconv.FormatInt(int64(ts), 10)})
+	})
+
+	if ttl := r.barTTL(barLength); ttl > 0 {
+		tx.queue(func(p redis.Pipeliner) { p.Expire(tx.ctx, key, ttl) })
+		tx.queue(func(p redis.Pipeliner) { p.Expire(tx.ctx, indexKey, ttl) })
+	}
+}
+
+func (r *RedisStore[A]) barKey(ticker string, ts ptime.IMilliseconds, barLength BarLength) string {
+	return fmt.Sprintf("%s{%s}/%d/%s", r.keyPrefix(), ticker, ts, barLength)
+}
+
+// stateKey is the key of a bar's state, when it isn't stored in the bar's hash.
+func (r *RedisStore[A]) stateKey(barKey string) string {
+	return barKey + "/state"
+}
+
+func (r *RedisStore[A]) indexKey(ticker string, barLength BarLength) string {
+	return fmt.Sprintf("%s{%s}/%s", r.keyPrefix(), ticker, barLength)
+}
+
+// barTTL returns the TTL of bars of a length, or 0 if they don't expire.
+func (r *RedisStore[A]) barTTL(barLength BarLength) time.Duration {
+	ttl, _ := lookupTTL(r.ttl, barLength)
+	return ttl
+}
+
+func (r *RedisStore[A]) keyPrefix() string {
+	if r.namespace == "" {
+		return ""
+	}
+
+	return r.namespace + ":"
+}
+
+// decode decodes a value written by Upsert without the hash layout, as the bar with the given key.
+func (r *RedisStore[A]) decode(value []byte, key BarKey) (A, error) {
+	decoded := r.schema.New(key)
+	if err := r.unmarshal(value, &decoded); err != nil {
+		return decoded, err
+	}
+
+	// the key is authoritative
+	return r.schema.rebuild(key, decoded), nil
+}
+
+func (r *RedisStore[A]) parseHash(fields map[string]string, agg *A) error {
+	for _, f := range r.schema.Fields {
+		name := f.hashField()
+		value, ok := fields[name]
+		if !ok {
+			// fields that were never set, e.g. after IncrBy on a new bar
+			continue
+		}
+
+		var v float64
+		var err error
+		if f.Integer {
+			var i int64
+			i, err = strconv.ParseInt(value, 10, 64)
+			v = float64(i)
+		} else {
+			v, err = strconv.ParseFloat(value, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("field %s: %w", name, err)
+		}
+
+		f.Set(agg, v)
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/polygon-io/ptime"
+)
+
+// RedisScript updates a single bar inside Redis with a Lua script, in one atomic round trip.
+// It requires the hash layout.
+//
+// The body of the script is given a table named agg, holding the bar's current values under the same
+// field names as the hash layout (o, h, l, c, v, vw, n for Redis; see Field.HashField for other schemas),
+// all of which default to 0. It should update agg in place.
+// Any arguments passed to Run are available to the body in a table named args.
+// The body may keep values of its own in other fields of the bar's hash, whose key is named key.
+// Reading and writing the bar, maintaining the index and refreshing TTLs are taken care of around the body.
+// Scripts can't see the bar's state (see DB.GetState), so it's discarded whenever a script changes the bar.
+type RedisScript struct {
+	script *redis.Script
+}
+
+const redisScriptPrelude = `
+local key, index = KEYS[1], KEYS[2]
+local ts, ttl = ARGV[1], tonumber(ARGV[2])
+local fields = {}
+for f in string.gmatch(ARGV[3], '%S+') do
+	table.insert(fields, f)
+end
+local args = {}
+for i = 4, #ARGV do
+	args[i - 3] = ARGV[i]
+end
+
+local raw = redis.call('HMGET', key, unpack(fields))
+local agg, old = {}, {}
+for i, f in ipairs(fields) do
+	agg[f] = tonumber(raw[i]) or 0
+	old[f] = agg[f]
+end
+
+do
+`
+
+// Numbers are formatted with 17 significant digits, so that they round-trip exactly,
+// and returned as strings, since Redis truncates numbers returned from scripts to integers.
+const redisScriptEpilogue = `
+end
+
+local updated = 0
+local hset, out = {}, {}
+for _, f in ipairs(fields) do
+	if agg[f] ~= old[f] then
+		updated = 1
+	end
+
+	local s = string.format('%.17g', agg[f])
+	table.insert(hset, f)
+	table.insert(hset, s)
+	table.insert(out, s)
+end
+
+redis.call('HSET', key, unpack(hset))
+if updated == 1 then
+	redis.call('HDEL', key, 's')
+end
+redis.call('ZADD', index, ts, ts)
+if ttl > 0 then
+	redis.call('PEXPIRE', key, ttl)
+	redis.call('PEXPIRE', index, ttl)
+end
+
+table.insert(out, 1, tostring(updated))
+return out
+`
+
+func NewRedisScript(body string) *RedisScript {
+	return &RedisScript{
+		script: redis.NewScript(redisScriptPrelude + body + redisScriptEpilogue),
+	}
+}
+
+// RunScript runs the script on the bar with the given ticker and bar length that contains the requested timestamp,
+// and returns the updated bar. updated reports whether the script changed it.
+func (r *RedisStore[A]) RunScript(ctx context.Context, script *RedisScript, ticker string, timestamp ptime.INanoseconds, barLength BarLength, args ...interface{}) (A, bool, error) {
+	var zero A
+
+	if !r.hashLayout {
+		return zero, false, errors.New("scripts require the hash layout")
+	}
+
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		return zero, false, err
+	}
+
+	ts := snapTimestamp(ticker, timestamp, barLength)
+	barKey, err := newBarKey(ticker, ts, barLength)
+	if err != nil {
+		return zero, false, err
+	}
+
+	fields := make([]string, len(r.schema.Fields))
+	for i, f := range r.schema.Fields {
+		fields[i] = f.hashField()
+	}
+
+	keys := []string{r.barKey(ticker, ts, barLength), r.indexKey(ticker, barLength)}
+	argv := append([]interface{}{int64(ts), r.barTTL(barLength).Milliseconds(), strings.Join(fields, " ")}, args...)
+
+	result, err := script.script.Run(ctx, r.client, keys, argv...).StringSlice()
+	if err != nil {
+		return zero, false, fmt.Errorf("run script: %w", err)
+	}
+
+	if len(result) != 1+len(fields) {
+		return zero, false, fmt.Errorf("script returned %d values", len(result))
+	}
+
+	agg := r.schema.New(barKey)
+	for i, f := range r.schema.Fields {
+		// integers are formatted as floats by the script
+		v, err := strconv.ParseFloat(result[1+i], 64)
+		if err != nil {
+			return zero, false, fmt.Errorf("field %s: %w", fields[i], err)
+		}
+
+		if f.Integer {
+			v = float64(int64(v))
+		}
+		f.Set(&agg, v)
+	}
+
+	return agg, result[0] == "1", nil
+}
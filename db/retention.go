@@ -0,0 +1,244 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/ptime"
+)
+
+// RetentionPolicy deletes the bars of one bar length once they are older than Keep.
+// If DownsampleTo is set, the expiring bars are first rolled up into bars of that (longer) length. Every expiring bar
+// is merged, so the longer bars should follow the same condition rules and sessions as the expiring ones.
+// Rolled-up bars never replace existing ones, since a bar computed from trades is more accurate than one
+// computed from finer bars; so a series that is already aggregated at both lengths is simply deleted.
+type RetentionPolicy struct {
+	BarLength    BarLength
+	Keep         time.Duration
+	DownsampleTo BarLength
+}
+
+// DefaultRetentionPolicies keeps second bars for 2 days, rolling them up into minute bars before deleting them,
+// and minute bars for a year, rolling them up into hour bars, which follow the same intraday rules. Minute bars
+// aren't rolled up into day bars, which don't: daily bars follow their own condition rules, and may only include
+// regular-hours trades. Hour and day bars are kept forever.
+var DefaultRetentionPolicies = []RetentionPolicy{
+	{BarLength: BarLengthSecond, Keep: 2 * 24 * time.Hour, DownsampleTo: BarLengthMinute},
+	{BarLength: BarLengthMinute, Keep: 365 * 24 * time.Hour, DownsampleTo: BarLengthHour},
+}
+
+// RetentionStats reports what applying a RetentionPolicy did.
+type RetentionStats struct {
+	BarLength BarLength
+	// Bars older than Cutoff were deleted. When downsampling, a ticker's bars are only deleted up to the start
+	// of the coarse bar containing Cutoff, aligned in the ticker's market timezone.
+	Cutoff      time.Time
+	Downsampled int64
+	Deleted     int64
+}
+
+const (
+	sqlSelectExpiringStmt  = `SELECT ticker, timestamp, %[2]s FROM %[1]s WHERE bar_length=$1 AND timestamp<$2 ORDER BY ticker, timestamp`
+	sqlInsertIfMissingStmt = `INSERT INTO %[1]s (ticker, timestamp, bar_length, %[2]s) VALUES ($1,$2,$3,%[3]s) ON CONFLICT (ticker, timestamp, bar_length) DO NOTHING`
+	sqlDeleteExpiringStmt  = `DELETE FROM %[1]s WHERE bar_length=$1 AND timestamp<$2`
+	// the states of expired bars are deleted with them, while downsampled bars start without one
+	sqlDeleteExpiringStatesStmt = `DELETE FROM %[1]s_states WHERE bar_length=$1 AND timestamp<$2`
+
+	// when downsampling, each ticker has its own cutoff, since coarse bars are aligned in its market timezone
+	sqlDeleteExpiringTickerStmt       = `DELETE FROM %[1]s WHERE ticker=$1 AND bar_length=$2 AND timestamp<$3`
+	sqlDeleteExpiringTickerStatesStmt = `DELETE FROM %[1]s_states WHERE ticker=$1 AND bar_length=$2 AND timestamp<$3`
+)
+
+// ApplyRetention applies the policies in order, each in its own transaction, relative to now.
+// Policies that downsample into a bar length should come before the policy for that bar length, as in DefaultRetentionPolicies.
+// Downsampling requires the schema to have a Merge function.
+// It should be called periodically, e.g. hourly.
+func (s *SQLStore[A]) ApplyRetention(ctx context.Context, now time.Time, policies []RetentionPolicy) ([]RetentionStats, error) {
+	stats := make([]RetentionStats, 0, len(policies))
+	for _, policy := range policies {
+		stat, err := s.applyRetentionPolicy(ctx, now, policy)
+		if err != nil {
+			return stats, fmt.Errorf("%s bars: %w", policy.BarLength, err)
+		}
+
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
+func (s *SQLStore[A]) applyRetentionPolicy(ctx context.Context, now time.Time, policy RetentionPolicy) (RetentionStats, error) {
+	duration, err := getBarLengthDuration(policy.BarLength)
+	if err != nil {
+		return RetentionStats{}, err
+	}
+
+	cutoff := ptime.IMillisecondsFromTime(now.Add(-policy.Keep))
+	if policy.DownsampleTo != "" {
+		coarse, err := getBarLengthDuration(policy.DownsampleTo)
+		if err != nil {
+			return RetentionStats{}, err
+		}
+
+		if coarse <= duration {
+			return RetentionStats{}, fmt.Errorf("can't downsample into %s bars", policy.DownsampleTo)
+		}
+
+		if s.schema.Merge == nil {
+			return RetentionStats{}, errors.New("can't downsample without a Merge function in the schema")
+		}
+	}
+
+	stats := RetentionStats{
+		BarLength: policy.BarLength,
+		Cutoff:    cutoff.ToTime(),
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return stats, err
+	}
+	defer tx.Rollback()
+
+	if policy.DownsampleTo == "" {
+		res, err := tx.ExecContext(ctx, s.stmt(sqlDeleteExpiringStmt), policy.BarLength, cutoff)
+		if err != nil {
+			return stats, fmt.Errorf("delete: %w", err)
+		}
+
+		if stats.Deleted, err = res.RowsAffected(); err != nil {
+			return stats, err
+		}
+
+		if _, err := tx.ExecContext(ctx, s.stmt(sqlDeleteExpiringStatesStmt), policy.BarLength, cutoff); err != nil {
+			return stats, fmt.Errorf("delete states: %w", err)
+		}
+
+		return stats, tx.Commit()
+	}
+
+	bars, cutoffs, err := s.downsampleExpiring(ctx, tx, policy, cutoff)
+	if err != nil {
+		return stats, fmt.Errorf("downsample: %w", err)
+	}
+
+	insertStmt := s.stmt(sqlInsertIfMissingStmt)
+	for _, bar := range bars {
+		key := s.schema.Key(bar)
+		if s.partitioned {
+			if err := s.ensurePartition(ctx, key.Start); err != nil {
+				return stats, err
+			}
+		}
+
+		args := append([]interface{}{key.Ticker, key.Start, policy.DownsampleTo}, s.values(bar)...)
+		res, err := tx.ExecContext(ctx, insertStmt, args...)
+		if err != nil {
+			return stats, fmt.Errorf("insert %s bar: %w", policy.DownsampleTo, err)
+		}
+
+		if n, err := res.RowsAffected(); err == nil {
+			stats.Downsampled += n
+		}
+	}
+
+	deleteStmt, deleteStatesStmt := s.stmt(sqlDeleteExpiringTickerStmt), s.stmt(sqlDeleteExpiringTickerStatesStmt)
+	for ticker, cutoff := range cutoffs {
+		res, err := tx.ExecContext(ctx, deleteStmt, ticker, policy.BarLength, cutoff)
+		if err != nil {
+			return stats, fmt.Errorf("delete %s: %w", ticker, err)
+		}
+
+		if n, err := res.RowsAffected(); err == nil {
+			stats.Deleted += n
+		}
+
+		if _, err := tx.ExecContext(ctx, deleteStatesStmt, ticker, policy.BarLength, cutoff); err != nil {
+			return stats, fmt.Errorf("delete %s states: %w", ticker, err)
+		}
+	}
+
+	return stats, tx.Commit()
+}
+
+// downsampleExpiring rolls up the bars older than cutoff into bars of the policy's DownsampleTo length,
+// and returns them along with the cutoff of each ticker that has expiring bars. Only whole coarse bars are
+// rolled up, so that none is written before all of its bars have expired; since coarse bars are aligned in
+// each ticker's market timezone, so is its cutoff.
+// The rolled-up bars are collected before any is written, since a connection can't run statements
+// while it's reading rows.
+func (s *SQLStore[A]) downsampleExpiring(ctx context.Context, tx *sql.Tx, policy RetentionPolicy, cutoff ptime.IMilliseconds) ([]A, map[string]ptime.IMilliseconds, error) {
+	rows, err := tx.QueryContext(ctx, s.stmt(sqlSelectExpiringStmt), policy.BarLength, cutoff)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var bars []A
+	var last BarKey
+	cutoffs := make(map[string]ptime.IMilliseconds)
+	for rows.Next() {
+		var ticker string
+		var ts ptime.IMilliseconds
+		values, err := s.scan(rows.Scan, &ticker, &ts)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tickerCutoff, ok := cutoffs[ticker]
+		if !ok {
+			tickerCutoff = snapTimestamp(ticker, cutoff.ToINanoseconds(), policy.DownsampleTo)
+			cutoffs[ticker] = tickerCutoff
+		}
+
+		if ts >= tickerCutoff {
+			continue
+		}
+
+		bar := s.newBar(BarKey{Ticker: ticker, Start: ts, End: barEnd(ticker, ts, policy.BarLength)}, values)
+
+		if len(bars) == 0 || last.Ticker != ticker || ts >= last.End {
+			start, end, err := BarBounds(ticker, ts.ToINanoseconds(), policy.DownsampleTo)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			last = BarKey{Ticker: ticker, Start: start, End: end}
+			bars = append(bars, s.schema.New(last))
+		}
+
+		s.schema.Merge(&bars[len(bars)-1], bar)
+	}
+
+	return bars, cutoffs, rows.Err()
+}
+
+// mergeBar folds a shorter bar into the longer bar containing it. Bars must be merged in time order.
+func mergeBar(dst *globals.Aggregate, src globals.Aggregate) {
+	if dst.Open == 0 {
+		dst.Open = src.Open
+	}
+
+	if src.Close != 0 {
+		dst.Close = src.Close
+	}
+
+	if src.High > dst.High {
+		dst.High = src.High
+	}
+
+	if src.Low != 0 && (dst.Low == 0 || src.Low < dst.Low) {
+		dst.Low = src.Low
+	}
+
+	if volume := dst.Volume + src.Volume; volume > 0 {
+		dst.VWAP = (dst.VWAP*dst.Volume + src.VWAP*src.Volume) / volume
+	}
+	dst.Volume += src.Volume
+
+	setInteger(&dst.Transactions, int64(dst.Transactions)+int64(src.Transactions))
+}
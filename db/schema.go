@@ -0,0 +1,235 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/ptime"
+	"github.com/suremarc/go-lib-aggregates/calendar"
+)
+
+// BarKey identifies a bar by its ticker and bounds. The bar length is implied by the bounds.
+type BarKey struct {
+	Ticker string
+	Start  ptime.IMilliseconds
+	End    ptime.IMilliseconds
+}
+
+// BarLength infers the bar length from the bounds.
+func (k BarKey) BarLength() (BarLength, error) {
+	return barLengthFromBounds(k.Ticker, k.Start, k.End)
+}
+
+// Session returns the session of the bar in the calendar of the ticker's market (see MarketCalendars):
+// the pre-market, regular or after-hours session it falls in, calendar.SessionClosed for bars on holidays or
+// overnight, and calendar.SessionMixed for bars that span more than one, such as daily bars. Bars of tickers
+// that trade around the clock are always in the regular session.
+func (k BarKey) Session() calendar.Session {
+	c := MarketCalendar(k.Ticker)
+	if c == nil {
+		return calendar.SessionRegular
+	}
+
+	return c.BarSession(k.Start.ToTime(), k.End.ToTime())
+}
+
+// newBarKey returns the key of the bar with the given ticker and bar length that starts at ts.
+func newBarKey(ticker string, ts ptime.IMilliseconds, barLength BarLength) (BarKey, error) {
+	_, end, err := BarBounds(ticker, ts.ToINanoseconds(), barLength)
+	if err != nil {
+		return BarKey{}, err
+	}
+
+	return BarKey{
+		Ticker: ticker,
+		Start:  ts,
+		End:    end,
+	}, nil
+}
+
+// Bar is the constraint satisfied by custom aggregate types, from which SchemaOf builds a Schema.
+type Bar[A any] interface {
+	comparable
+	// BarKey returns the bar's ticker and bounds.
+	BarKey() BarKey
+	// NewBar returns an empty bar with the given key. It is called on the zero value.
+	NewBar(BarKey) A
+}
+
+// Field is a numeric value of an aggregate type. SQLStore stores each field as a column,
+// and RedisStore as a hash field when using the hash layout.
+type Field[A any] struct {
+	// Name is the name of the field's column, and its key when encoded as JSON.
+	Name string
+	// HashField is the name of the field in Redis hashes, if it differs from Name. It must not be "s",
+	// which holds the bar's state.
+	HashField string
+	// Integer fields are stored as integers rather than floating-point numbers.
+	Integer bool
+
+	Get func(A) float64
+	Set func(*A, float64)
+}
+
+func (f Field[A]) hashField() string {
+	if f.HashField != "" {
+		return f.HashField
+	}
+
+	return f.Name
+}
+
+// Schema describes an aggregate type to the stores that can hold any type: NativeStore, RedisStore and SQLStore.
+// AggregateSchema describes globals.Aggregate, the default; other types can implement Bar and use SchemaOf.
+type Schema[A any] struct {
+	// Key returns the bar's ticker and bounds.
+	Key func(A) BarKey
+	// New returns an empty bar with the given key.
+	New func(BarKey) A
+	// Fields are the aggregate's values, other than its key.
+	Fields []Field[A]
+	// Merge folds a shorter bar into the longer bar containing it, in time order, for downsampling.
+	// If it's nil, bars of this type can't be downsampled.
+	Merge func(dst *A, src A)
+}
+
+// SchemaOf builds the Schema of a type that implements Bar, with the given fields.
+func SchemaOf[A Bar[A]](fields ...Field[A]) Schema[A] {
+	return Schema[A]{
+		Key: func(a A) BarKey {
+			return a.BarKey()
+		},
+		New: func(key BarKey) A {
+			var zero A
+			return zero.NewBar(key)
+		},
+		Fields: fields,
+	}
+}
+
+// rebuild returns a new bar with the given key and the values of src. Stores use it to make the key
+// they looked a bar up by authoritative over whatever key was decoded along with the bar.
+func (s Schema[A]) rebuild(key BarKey, src A) A {
+	bar := s.New(key)
+	for _, f := range s.Fields {
+		f.Set(&bar, f.Get(src))
+	}
+
+	return bar
+}
+
+// marshalFields encodes the bar's fields as a JSON object, keyed by name, behind the same header as the values of
+// codecs, with fieldsCodecID. Its key is not encoded.
+func (s Schema[A]) marshalFields(bar A) ([]byte, error) {
+	values := make(map[string]float64, len(s.Fields))
+	for _, f := range s.Fields {
+		values[f.Name] = f.Get(bar)
+	}
+
+	body, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{codecMagic, fieldsCodecID}, body...), nil
+}
+
+// unmarshalFields is the inverse of marshalFields. Fields missing from the object are left alone.
+// Values written without a header are bare JSON objects.
+func (s Schema[A]) unmarshalFields(buf []byte, bar *A) error {
+	if len(buf) >= codecHeaderSize && buf[0] == codecMagic {
+		if buf[1] != fieldsCodecID {
+			return fmt.Errorf("%w: %d", ErrUnknownCodec, buf[1])
+		}
+
+		buf = buf[codecHeaderSize:]
+	}
+
+	var values map[string]float64
+	if err := json.Unmarshal(buf, &values); err != nil {
+		return err
+	}
+
+	for _, f := range s.Fields {
+		if v, ok := values[f.Name]; ok {
+			f.Set(bar, v)
+		}
+	}
+
+	return nil
+}
+
+// sqlValue returns the value of the field to pass to a SQL statement.
+func (f Field[A]) sqlValue(bar A) interface{} {
+	if f.Integer {
+		return int64(f.Get(bar))
+	}
+
+	return f.Get(bar)
+}
+
+// AggregateSchema describes globals.Aggregate. Its field names match the columns and hash fields
+// that SQL and Redis have always used.
+var AggregateSchema = Schema[globals.Aggregate]{
+	Key: func(agg globals.Aggregate) BarKey {
+		return BarKey{Ticker: agg.Ticker, Start: agg.StartTimestamp, End: agg.EndTimestamp}
+	},
+	New: func(key BarKey) globals.Aggregate {
+		return globals.Aggregate{
+			Ticker:         key.Ticker,
+			Timestamp:      key.Start,
+			StartTimestamp: key.Start,
+			EndTimestamp:   key.End,
+		}
+	},
+	Fields: []Field[globals.Aggregate]{
+		{
+			Name: "volume", HashField: redisFieldVolume,
+			Get: func(agg globals.Aggregate) float64 { return agg.Volume },
+			Set: func(agg *globals.Aggregate, v float64) { agg.Volume = v },
+		},
+		{
+			Name: "vwap", HashField: redisFieldVWAP,
+			Get: func(agg globals.Aggregate) float64 { return agg.VWAP },
+			Set: func(agg *globals.Aggregate, v float64) { agg.VWAP = v },
+		},
+		{
+			Name: "open", HashField: redisFieldOpen,
+			Get: func(agg globals.Aggregate) float64 { return agg.Open },
+			Set: func(agg *globals.Aggregate, v float64) { agg.Open = v },
+		},
+		{
+			Name: "close", HashField: redisFieldClose,
+			Get: func(agg globals.Aggregate) float64 { return agg.Close },
+			Set: func(agg *globals.Aggregate, v float64) { agg.Close = v },
+		},
+		{
+			Name: "high", HashField: redisFieldHigh,
+			Get: func(agg globals.Aggregate) float64 { return agg.High },
+			Set: func(agg *globals.Aggregate, v float64) { agg.High = v },
+		},
+		{
+			Name: "low", HashField: redisFieldLow,
+			Get: func(agg globals.Aggregate) float64 { return agg.Low },
+			Set: func(agg *globals.Aggregate, v float64) { agg.Low = v },
+		},
+		{
+			Name: "transactions", HashField: redisFieldTransactions, Integer: true,
+			Get: func(agg globals.Aggregate) float64 { return float64(agg.Transactions) },
+			Set: func(agg *globals.Aggregate, v float64) { setInteger(&agg.Transactions, int64(v)) },
+		},
+	},
+	Merge: mergeBar,
+}
+
+// fieldByHashField finds a field by its name in Redis hashes.
+func (s Schema[A]) fieldByHashField(name string) (Field[A], error) {
+	for _, f := range s.Fields {
+		if f.hashField() == name {
+			return f, nil
+		}
+	}
+
+	return Field[A]{}, fmt.Errorf("schema has no %s field", name)
+}
@@ -6,134 +6,388 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/polygon-io/go-lib-models/v2/globals"
 	"github.com/polygon-io/ptime"
 )
 
-type SQL struct {
-	db         *sql.DB
+// SQLStore is a Store of any aggregate type described by a Schema, backed by a SQL database.
+// Every field of the schema is a column of the table, named after the field.
+type SQLStore[A comparable] struct {
+	sqlOptions
+	db     *sql.DB
+	schema Schema[A]
+
 	selectStmt *sql.Stmt
 	insertStmt *sql.Stmt
 	deleteStmt *sql.Stmt
+
+	selectStateStmt *sql.Stmt
+	upsertStateStmt *sql.Stmt
+	deleteStateStmt *sql.Stmt
+
+	partitions sync.Map // day number -> struct{}
+	// contexts holds the context of every transaction begun by NewTx, for the statements that run outside of it
+	contexts sync.Map // *sql.Tx -> context.Context
+}
+
+// SQL is a SQLStore of globals.Aggregate.
+type SQL = SQLStore[globals.Aggregate]
+
+type sqlOptions struct {
+	table string
+
+	// only set with WithDailyPartitions
+	partitioned bool
+	retention   time.Duration
+}
+
+// SQLOption configures optional behavior of a SQLStore.
+type SQLOption func(*sqlOptions)
+
+// WithTable sets the name of the table holding the aggregates, which must be a plain identifier.
+// States are kept in a table of the same name suffixed with _states. The default is aggregates.
+func WithTable(name string) SQLOption {
+	return func(s *sqlOptions) {
+		s.table = name
+	}
 }
 
 var _ DB[sql.Tx] = &SQL{}
 
-func NewSQL(db *sql.DB) (*SQL, error) {
-	_, err := db.Exec(sqlCreateTableStmt)
-	if err != nil {
-		// try replacing the double type
-		_, err = db.Exec(strings.ReplaceAll(sqlCreateTableStmt, "DOUBLE", "DOUBLE PRECISION"))
+func NewSQL(db *sql.DB, opts ...SQLOption) (*SQL, error) {
+	return NewSQLStore(db, AggregateSchema, opts...)
+}
+
+// NewSQLStore creates a SQLStore of the aggregate type described by schema, creating its tables if they don't exist.
+func NewSQLStore[A comparable](db *sql.DB, schema Schema[A], opts ...SQLOption) (*SQLStore[A], error) {
+	s := &SQLStore[A]{
+		sqlOptions: sqlOptions{
+			table: "aggregates",
+		},
+		db:     db,
+		schema: schema,
+	}
+
+	for _, opt := range opts {
+		opt(&s.sqlOptions)
+	}
+
+	var err error
+	if s.partitioned {
+		_, err = db.Exec(s.stmt(pgCreatePartitionedTableStmt))
+	} else {
+		_, err = db.Exec(s.stmt(sqlCreateTableStmt))
+		if err != nil {
+			// try replacing the double type
+			_, err = db.Exec(strings.ReplaceAll(s.stmt(sqlCreateTableStmt), "DOUBLE", "DOUBLE PRECISION"))
+		}
 	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	s := &SQL{
-		db: db,
+	if _, err := db.Exec(s.stmt(sqlCreateStatesTableStmt)); err != nil {
+		// try replacing the blob type
+		if _, err := db.Exec(strings.ReplaceAll(s.stmt(sqlCreateStatesTableStmt), "BLOB", "BYTEA")); err != nil {
+			return nil, fmt.Errorf("create states table: %w", err)
+		}
 	}
 
-	if s.selectStmt, err = db.Prepare(sqlSelectStmt); err != nil {
+	if s.selectStmt, err = db.Prepare(s.stmt(sqlSelectStmt)); err != nil {
 		return nil, fmt.Errorf("prepare select: %w", err)
 	}
 
-	if s.insertStmt, err = db.Prepare(sqlInsertStmt); err != nil {
+	if s.insertStmt, err = db.Prepare(s.stmt(sqlInsertStmt)); err != nil {
 		return nil, fmt.Errorf("prepare insert: %w", err)
 	}
 
-	if s.deleteStmt, err = db.Prepare(sqlDeleteStmt); err != nil {
+	if s.deleteStmt, err = db.Prepare(s.stmt(sqlDeleteStmt)); err != nil {
 		return nil, fmt.Errorf("prepare delete: %w", err)
 	}
 
+	if s.selectStateStmt, err = db.Prepare(s.stmt(sqlSelectStateStmt)); err != nil {
+		return nil, fmt.Errorf("prepare select state: %w", err)
+	}
+
+	if s.upsertStateStmt, err = db.Prepare(s.stmt(sqlUpsertStateStmt)); err != nil {
+		return nil, fmt.Errorf("prepare upsert state: %w", err)
+	}
+
+	if s.deleteStateStmt, err = db.Prepare(s.stmt(sqlDeleteStateStmt)); err != nil {
+		return nil, fmt.Errorf("prepare delete state: %w", err)
+	}
+
 	return s, nil
 }
 
+// Statements are templates, formatted by SQLStore.stmt.
 const (
-	sqlCreateTableStmt = `CREATE TABLE IF NOT EXISTS aggregates (
+	sqlCreateTableStmt = `CREATE TABLE IF NOT EXISTS %[1]s (
+	ticker VARCHAR(24) NOT NULL,
+	%[5]s
+	timestamp BIGINT NOT NULL,
+	bar_length VARCHAR(16) NOT NULL,
+	PRIMARY KEY (ticker, timestamp, bar_length)
+)`
+
+	sqlSelectStmt = `SELECT %[2]s FROM %[1]s WHERE ticker=$1 AND timestamp=$2 AND bar_length=$3`
+	sqlInsertStmt = `INSERT INTO %[1]s (ticker, timestamp, bar_length, %[2]s) VALUES ($1,$2,$3,%[3]s) ON CONFLICT (ticker, timestamp, bar_length) DO UPDATE SET %[4]s`
+	sqlDeleteStmt = `DELETE FROM %[1]s WHERE ticker=$1 AND timestamp=$2 AND bar_length=$3`
+
+	// States are kept in their own table, so that reading and writing aggregates doesn't pay for them.
+	sqlCreateStatesTableStmt = `CREATE TABLE IF NOT EXISTS %[1]s_states (
 	ticker VARCHAR(24) NOT NULL,
-	volume DOUBLE NOT NULL,
-	vwap DOUBLE NOT NULL,
-	open DOUBLE NOT NULL,
-	close DOUBLE NOT NULL,
-	high DOUBLE NOT NULL,
-	low DOUBLE NOT NULL,
 	timestamp BIGINT NOT NULL,
-	transactions INT NOT NULL,
-	bar_length CHAR(3) NOT NULL,
+	bar_length VARCHAR(16) NOT NULL,
+	state BLOB NOT NULL,
 	PRIMARY KEY (ticker, timestamp, bar_length)
 )`
 
-	sqlSelectStmt = `SELECT volume, vwap, open, close, high, low, transactions FROM aggregates WHERE ticker=$1 AND timestamp=$2 AND bar_length=$3`
-	sqlInsertStmt = `INSERT INTO aggregates (ticker, volume, vwap, open, close, high, low, timestamp, transactions, bar_length) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10) ON CONFLICT (ticker, timestamp, bar_length) DO UPDATE SET volume=$2, vwap=$3, open=$4, close=$5, high=$6, low=$7, transactions=$8`
-	sqlDeleteStmt = `DELETE FROM aggregates WHERE ticker=$1 AND timestamp=$2 AND bar_length=$3`
+	sqlSelectStateStmt = `SELECT state FROM %[1]s_states WHERE ticker=$1 AND timestamp=$2 AND bar_length=$3`
+	sqlUpsertStateStmt = `INSERT INTO %[1]s_states (ticker, timestamp, bar_length, state) VALUES ($1,$2,$3,$4) ON CONFLICT (ticker, timestamp, bar_length) DO UPDATE SET state=$4`
+	sqlDeleteStateStmt = `DELETE FROM %[1]s_states WHERE ticker=$1 AND timestamp=$2 AND bar_length=$3`
 )
 
-func (s *SQL) Get(tx *sql.Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) (agg globals.Aggregate, err error) {
-	ts := snapTimestamp(timestamp)
+// stmt formats a statement template with the table (%[1]s), the columns of the schema's fields (%[2]s),
+// their placeholders, starting from $4 (%[3]s), assignments of every column from EXCLUDED (%[4]s),
+// and the definitions of the columns (%[5]s).
+func (s *SQLStore[A]) stmt(format string) string {
+	columns := make([]string, len(s.schema.Fields))
+	placeholders := make([]string, len(s.schema.Fields))
+	assignments := make([]string, len(s.schema.Fields))
+	var definitions strings.Builder
+	for i, f := range s.schema.Fields {
+		columns[i] = f.Name
+		placeholders[i] = fmt.Sprintf("$%d", i+4)
+		assignments[i] = fmt.Sprintf("%s=EXCLUDED.%s", f.Name, f.Name)
+
+		typ := "DOUBLE"
+		if f.Integer {
+			typ = "BIGINT"
+		}
+		fmt.Fprintf(&definitions, "%s %s NOT NULL,\n\t", f.Name, typ)
+	}
+
+	return fmt.Sprintf(format,
+		s.table,
+		strings.Join(columns, ", "),
+		strings.Join(placeholders, ","),
+		strings.Join(assignments, ", "),
+		strings.TrimSuffix(definitions.String(), "\n\t"))
+}
+
+// values returns the arguments that write the bar's fields, in column order.
+func (s *SQLStore[A]) values(bar A) []interface{} {
+	values := make([]interface{}, len(s.schema.Fields))
+	for i, f := range s.schema.Fields {
+		values[i] = f.sqlValue(bar)
+	}
+
+	return values
+}
+
+// scan reads a row holding the columns of dst followed by the schema's fields, and returns the fields.
+func (s *SQLStore[A]) scan(scan func(dst ...interface{}) error, dst ...interface{}) ([]float64, error) {
+	values := make([]float64, len(s.schema.Fields))
+	for i := range values {
+		dst = append(dst, &values[i])
+	}
+
+	return values, scan(dst...)
+}
+
+// newBar returns the bar with the given key and field values, in column order.
+func (s *SQLStore[A]) newBar(key BarKey, values []float64) A {
+	bar := s.schema.New(key)
+	for i, f := range s.schema.Fields {
+		f.Set(&bar, values[i])
+	}
+
+	return bar
+}
+
+func (s *SQLStore[A]) Get(tx *sql.Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) (A, error) {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		s.rollback(tx)
+		var zero A
+		return zero, err
+	}
+
+	ts := snapTimestamp(ticker, timestamp, barLength)
+	key, err := newBarKey(ticker, ts, barLength)
+	if err != nil {
+		s.rollback(tx)
+		var zero A
+		return zero, err
+	}
 
 	row := tx.Stmt(s.selectStmt).QueryRow(ticker, ts, barLength)
 
-	if err := row.Scan(&agg.Volume, &agg.VWAP, &agg.Open, &agg.Close, &agg.High, &agg.Low, &agg.Transactions); err != nil {
+	values, err := s.scan(row.Scan)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			duration, err := getBarLengthDuration(barLength)
-			if err != nil {
-				tx.Rollback()
-				return agg, err
-			}
-
-			return globals.Aggregate{
-				Ticker:         ticker,
-				Timestamp:      ts,
-				StartTimestamp: ts,
-				EndTimestamp:   ts + ptime.IMillisecondsFromDuration(duration),
-			}, nil
+			return s.schema.New(key), nil
 		}
 
-		return agg, err
+		s.rollback(tx)
+		var zero A
+		return zero, err
 	}
 
-	return agg, nil
+	return s.newBar(key, values), nil
 }
 
-func (s *SQL) Upsert(tx *sql.Tx, aggregate globals.Aggregate) error {
-	barLength, err := getBarLength(aggregate)
+func (s *SQLStore[A]) Upsert(tx *sql.Tx, aggregate A) error {
+	key := s.schema.Key(aggregate)
+	barLength, err := key.BarLength()
 	if err != nil {
-		tx.Rollback()
+		s.rollback(tx)
 		return err
 	}
 
-	_, err = tx.Stmt(s.insertStmt).Exec(
-		aggregate.Ticker,
-		aggregate.Volume,
-		aggregate.VWAP,
-		aggregate.Open,
-		aggregate.Close,
-		aggregate.High,
-		aggregate.Low,
-		aggregate.Timestamp,
-		aggregate.Transactions,
-		barLength)
+	if s.partitioned {
+		if err := s.ensurePartition(s.txContext(tx), key.Start); err != nil {
+			s.rollback(tx)
+			return err
+		}
+	}
+
+	args := append([]interface{}{key.Ticker, key.Start, barLength}, s.values(aggregate)...)
+	if _, err := tx.Stmt(s.insertStmt).Exec(args...); err != nil {
+		s.rollback(tx)
+		return err
+	}
+
+	return nil
+}
+
+func (s *SQLStore[A]) GetState(tx *sql.Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) ([]byte, error) {
+	barLength, err := resolveBarLength(ticker, barLength)
 	if err != nil {
+		s.rollback(tx)
+		return nil, err
+	}
+
+	var state []byte
+	if err := tx.Stmt(s.selectStateStmt).QueryRow(ticker, snapTimestamp(ticker, timestamp, barLength), barLength).Scan(&state); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		s.rollback(tx)
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func (s *SQLStore[A]) UpsertState(tx *sql.Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength, state []byte) error {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		s.rollback(tx)
+		return err
+	}
+
+	if _, err := tx.Stmt(s.upsertStateStmt).Exec(ticker, snapTimestamp(ticker, timestamp, barLength), barLength, state); err != nil {
+		s.rollback(tx)
 		return err
 	}
 
 	return nil
 }
 
-func (s *SQL) Delete(tx *sql.Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) error {
-	if _, err := tx.Stmt(s.deleteStmt).Exec(ticker, timestamp, barLength); err != nil {
+func (s *SQLStore[A]) Delete(tx *sql.Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) error {
+	barLength, err := resolveBarLength(ticker, barLength)
+	if err != nil {
+		s.rollback(tx)
+		return err
+	}
+
+	ts := snapTimestamp(ticker, timestamp, barLength)
+	if _, err := tx.Stmt(s.deleteStmt).Exec(ticker, ts, barLength); err != nil {
+		s.rollback(tx)
+		return err
+	}
+
+	if _, err := tx.Stmt(s.deleteStateStmt).Exec(ticker, ts, barLength); err != nil {
+		s.rollback(tx)
 		return err
 	}
 
 	return nil
 }
 
-func (s *SQL) NewTx(ctx context.Context) (*sql.Tx, error) {
-	return s.db.BeginTx(ctx, nil)
+func (s *SQLStore[A]) NewTx(ctx context.Context) (*sql.Tx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.contexts.Store(tx, ctx)
+
+	return tx, nil
 }
 
-func (s *SQL) Commit(tx *sql.Tx) error {
+func (s *SQLStore[A]) Commit(tx *sql.Tx) error {
+	s.contexts.Delete(tx)
+
 	return tx.Commit()
 }
+
+func (s *SQLStore[A]) rollback(tx *sql.Tx) {
+	s.contexts.Delete(tx)
+	tx.Rollback()
+}
+
+// txContext returns the context that a transaction was begun with, or the background context for transactions
+// that weren't begun by NewTx.
+func (s *SQLStore[A]) txContext(tx *sql.Tx) context.Context {
+	if ctx, ok := s.contexts.Load(tx); ok {
+		return ctx.(context.Context)
+	}
+
+	return context.Background()
+}
+
+const sqlSelectAllStmt = `SELECT ticker, bar_length, timestamp, %[2]s FROM %[1]s ORDER BY ticker, bar_length, timestamp`
+
+// Range calls fn with every aggregate, ordered by ticker, bar length and timestamp, until it returns false.
+// Tickers and bar lengths are ordered bytewise, as Copy expects, whatever the collation of the database.
+func (s *SQLStore[A]) Range(ctx context.Context, fn func(A) bool) error {
+	stmt := sqlSelectAllStmt
+	if s.postgres() {
+		stmt = pgSelectAllStmt
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.stmt(stmt))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ticker, barLength string
+		var ts ptime.IMilliseconds
+		values, err := s.scan(rows.Scan, &ticker, &barLength, &ts)
+		if err != nil {
+			return err
+		}
+
+		// CHAR columns may be padded
+		key, err := newBarKey(ticker, ts, BarLength(strings.TrimSpace(barLength)))
+		if err != nil {
+			return fmt.Errorf("%s/%d: %w", ticker, ts, err)
+		}
+
+		if !fn(s.newBar(key, values)) {
+			return nil
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+	"sync"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/ptime"
+	"github.com/suremarc/go-lib-aggregates/tracing"
+)
+
+// TracedDB wraps a DB, recording a span for every transaction, from NewTx to Commit,
+// with a child span for every operation in it. Spans are only recorded if the context passed to NewTx
+// carries a tracer (see tracing.ContextWithTracer), and are children of the span in that context, if any.
+type TracedDB[Tx any] struct {
+	db      DB[Tx]
+	backend string
+
+	// the context of each transaction's span
+	txs sync.Map // *Tx -> tracedTx
+}
+
+type tracedTx struct {
+	ctx  context.Context
+	span *tracing.Span
+}
+
+var _ DB[Tx] = &TracedDB[Tx]{}
+
+// Trace wraps db, setting the backend attribute of its spans.
+func Trace[Tx any](db DB[Tx], backend string) *TracedDB[Tx] {
+	return &TracedDB[Tx]{
+		db:      db,
+		backend: backend,
+	}
+}
+
+func (t *TracedDB[Tx]) Get(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) (globals.Aggregate, error) {
+	span := t.startSpan(tx, "db.Get", ticker, barLength)
+	agg, err := t.db.Get(tx, ticker, timestamp, barLength)
+	span.End(err)
+
+	return agg, err
+}
+
+func (t *TracedDB[Tx]) Upsert(tx *Tx, aggregate globals.Aggregate) error {
+	barLength, _ := getBarLength(aggregate)
+
+	span := t.startSpan(tx, "db.Upsert", aggregate.Ticker, barLength)
+	err := t.db.Upsert(tx, aggregate)
+	span.End(err)
+
+	return err
+}
+
+func (t *TracedDB[Tx]) GetState(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) ([]byte, error) {
+	span := t.startSpan(tx, "db.GetState", ticker, barLength)
+	state, err := t.db.GetState(tx, ticker, timestamp, barLength)
+	span.End(err)
+
+	return state, err
+}
+
+func (t *TracedDB[Tx]) UpsertState(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength, state []byte) error {
+	span := t.startSpan(tx, "db.UpsertState", ticker, barLength)
+	err := t.db.UpsertState(tx, ticker, timestamp, barLength, state)
+	span.End(err)
+
+	return err
+}
+
+func (t *TracedDB[Tx]) Delete(tx *Tx, ticker string, timestamp ptime.INanoseconds, barLength BarLength) error {
+	span := t.startSpan(tx, "db.Delete", ticker, barLength)
+	err := t.db.Delete(tx, ticker, timestamp, barLength)
+	span.End(err)
+
+	return err
+}
+
+func (t *TracedDB[Tx]) NewTx(ctx context.Context) (*Tx, error) {
+	txCtx, txSpan := tracing.Start(ctx, "db.Tx", tracing.String("backend", t.backend))
+
+	// the store sees the transaction's context, so that it can record spans of its own, e.g. for locks
+	_, span := tracing.Start(txCtx, "db.NewTx", tracing.String("backend", t.backend))
+	tx, err := t.db.NewTx(txCtx)
+	span.End(err)
+
+	if err != nil {
+		txSpan.End(err)
+		return nil, err
+	}
+
+	if txSpan != nil {
+		t.txs.Store(tx, tracedTx{ctx: txCtx, span: txSpan})
+	}
+
+	return tx, nil
+}
+
+func (t *TracedDB[Tx]) Commit(tx *Tx) error {
+	v, traced := t.txs.LoadAndDelete(tx)
+
+	var span *tracing.Span
+	if traced {
+		_, span = tracing.Start(v.(tracedTx).ctx, "db.Commit", tracing.String("backend", t.backend))
+	}
+
+	err := t.db.Commit(tx)
+	span.End(err)
+
+	if traced {
+		v.(tracedTx).span.End(err)
+	}
+
+	return err
+}
+
+func (t *TracedDB[Tx]) startSpan(tx *Tx, name, ticker string, barLength BarLength) *tracing.Span {
+	v, ok := t.txs.Load(tx)
+	if !ok {
+		return nil
+	}
+
+	_, span := tracing.Start(v.(tracedTx).ctx, name,
+		tracing.String("backend", t.backend),
+		tracing.String("ticker", ticker),
+		tracing.String("bar_length", string(barLength)),
+	)
+
+	return span
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/polygon-io/ptime"
+)
+
+// TradeID identifies a trade of a ticker. Trade IDs are only unique per exchange, and off-exchange trades share the
+// exchange of the trade reporting facility that reported them, so they're qualified with both.
+type TradeID struct {
+	Exchange int32
+	// TRF is the ID of the trade reporting facility of an off-exchange trade, or 0.
+	TRF int32
+	ID  string
+}
+
+// ErrEmptyTradeID is returned when a trade without an ID is stored, since it couldn't be told apart from others.
+var ErrEmptyTradeID = errors.New("empty trade ID")
+
+// less orders trade IDs, to break ties between trades with the same timestamp.
+func (id TradeID) less(other TradeID) bool {
+	switch {
+	case id.ID != other.ID:
+		return id.ID < other.ID
+	case id.Exchange != other.Exchange:
+		return id.Exchange < other.Exchange
+	default:
+		return id.TRF < other.TRF
+	}
+}
+
+// TradeStore keeps the trades that bars are built from, by ticker and trade ID, alongside the store of the bars,
+// so that bars can be recomputed when a trade is canceled or corrected. Trades are opaque to it, but for their timestamp.
+// Since bars are recomputed from their trades alone, it must hold every trade of any bar that may need to be.
+type TradeStore[Trade any] interface {
+	// Put stores a trade, replacing any trade of the ticker with the same ID.
+	// It returns ErrEmptyTradeID if the trade has no ID.
+	Put(ticker string, id TradeID, timestamp ptime.INanoseconds, trade Trade) error
+
+	// Get retrieves the trade of a ticker with the given ID, and its timestamp, or false if there is none.
+	Get(ticker string, id TradeID) (trade Trade, timestamp ptime.INanoseconds, ok bool, err error)
+
+	// Delete deletes the trade of a ticker with the given ID, if there is one.
+	Delete(ticker string, id TradeID) error
+
+	// Range calls fn on every trade of a ticker whose timestamp is in [from, to), in timestamp order,
+	// until fn returns false.
+	Range(ticker string, from, to ptime.INanoseconds, fn func(Trade) bool) error
+
+	// Expire deletes every trade before the given time, and returns how many there were.
+	Expire(before ptime.INanoseconds) (int, error)
+}
+
+// NativeTradeStore is an in-memory TradeStore. Each ticker's trades are kept sorted by timestamp, then by ID.
+type NativeTradeStore[Trade any] struct {
+	mu      sync.RWMutex
+	tickers map[string]*tickerTrades[Trade]
+}
+
+var _ TradeStore[any] = &NativeTradeStore[any]{}
+
+type tickerTrades[Trade any] struct {
+	timestamps map[TradeID]ptime.INanoseconds
+	trades     []storedTrade[Trade]
+}
+
+type storedTrade[Trade any] struct {
+	id        TradeID
+	timestamp ptime.INanoseconds
+	trade     Trade
+}
+
+func NewNativeTradeStore[Trade any]() *NativeTradeStore[Trade] {
+	return &NativeTradeStore[Trade]{tickers: make(map[string]*tickerTrades[Trade])}
+}
+
+func (n *NativeTradeStore[Trade]) Put(ticker string, id TradeID, timestamp ptime.INanoseconds, trade Trade) error {
+	if id.ID == "" {
+		return ErrEmptyTradeID
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	t, ok := n.tickers[ticker]
+	if !ok {
+		t = &tickerTrades[Trade]{timestamps: make(map[TradeID]ptime.INanoseconds)}
+		n.tickers[ticker] = t
+	}
+
+	t.delete(id)
+
+	i := t.search(timestamp, id)
+	t.trades = append(t.trades, storedTrade[Trade]{})
+	copy(t.trades[i+1:], t.trades[i:])
+	t.trades[i] = storedTrade[Trade]{id: id, timestamp: timestamp, trade: trade}
+	t.timestamps[id] = timestamp
+
+	return nil
+}
+
+func (n *NativeTradeStore[Trade]) Get(ticker string, id TradeID) (trade Trade, timestamp ptime.INanoseconds, ok bool, err error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	t, ok := n.tickers[ticker]
+	if !ok {
+		return trade, 0, false, nil
+	}
+
+	timestamp, ok = t.timestamps[id]
+	if !ok {
+		return trade, 0, false, nil
+	}
+
+	return t.trades[t.search(timestamp, id)].trade, timestamp, true, nil
+}
+
+func (n *NativeTradeStore[Trade]) Delete(ticker string, id TradeID) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if t, ok := n.tickers[ticker]; ok {
+		t.delete(id)
+		if len(t.trades) == 0 {
+			delete(n.tickers, ticker)
+		}
+	}
+
+	return nil
+}
+
+func (n *NativeTradeStore[Trade]) Range(ticker string, from, to ptime.INanoseconds, fn func(Trade) bool) error {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	t, ok := n.tickers[ticker]
+	if !ok {
+		return nil
+	}
+
+	for i := t.search(from, TradeID{}); i < len(t.trades) && t.trades[i].timestamp < to; i++ {
+		if !fn(t.trades[i].trade) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (n *NativeTradeStore[Trade]) Expire(before ptime.INanoseconds) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var expired int
+	for ticker, t := range n.tickers {
+		i := t.search(before, TradeID{})
+		if i == 0 {
+			continue
+		}
+
+		for _, trade := range t.trades[:i] {
+			delete(t.timestamps, trade.id)
+		}
+
+		// copy the remaining trades, so that the expired ones can be garbage collected
+		t.trades = append([]storedTrade[Trade](nil), t.trades[i:]...)
+		expired += i
+
+		if len(t.trades) == 0 {
+			delete(n.tickers, ticker)
+		}
+	}
+
+	return expired, nil
+}
+
+// search returns the index of the first trade that doesn't come before the given timestamp and ID.
+func (t *tickerTrades[Trade]) search(timestamp ptime.INanoseconds, id TradeID) int {
+	return sort.Search(len(t.trades), func(i int) bool {
+		s := t.trades[i]
+		return s.timestamp > timestamp || s.timestamp == timestamp && !s.id.less(id)
+	})
+}
+
+func (t *tickerTrades[Trade]) delete(id TradeID) {
+	timestamp, ok := t.timestamps[id]
+	if !ok {
+		return
+	}
+
+	i := t.search(timestamp, id)
+	t.trades = append(t.trades[:i], t.trades[i+1:]...)
+	delete(t.timestamps, id)
+}
@@ -11,31 +11,121 @@ import (
 var ErrInvalidBarLength = errors.New("unrecognized bar length")
 
 func getBarLength(agg globals.Aggregate) (BarLength, error) {
-	switch agg.EndTimestamp - agg.StartTimestamp {
-	case ptime.IMillisecondsFromDuration(time.Second):
+	return barLengthFromBounds(agg.Ticker, agg.StartTimestamp, agg.EndTimestamp)
+}
+
+// barLengthFromBounds infers the bar length of a ticker's bar from its bounds. Day and week bars may be an hour
+// shorter or longer than usual, across DST transitions (see BarBounds). Bars that divide an hour are those of the
+// BarSpec aligned to their start, resolved for the ticker (see resolveBarLength), which makes hour bars that don't
+// start on the hour those of a spec.
+func barLengthFromBounds(ticker string, start, end ptime.IMilliseconds) (BarLength, error) {
+	switch d := (end - start).ToDuration(); {
+	case d == time.Second:
 		return BarLengthSecond, nil
-	case ptime.IMillisecondsFromDuration(time.Minute):
+	case d == time.Minute:
 		return BarLengthMinute, nil
-	case ptime.IMillisecondsFromDuration(time.Hour * 24):
+	case d >= 23*time.Hour && d <= 25*time.Hour:
 		return BarLengthDay, nil
+	case d >= 7*24*time.Hour-time.Hour && d <= 7*24*time.Hour+time.Hour:
+		return BarLengthWeek, nil
+	case d > time.Minute && d%time.Minute == 0 && time.Hour%d == 0:
+		offset := timeOfDay(start.ToTime().In(marketTimezone(ticker))) % d
+		return alignedBarLength(d, offset)
 	default:
 		return "", ErrInvalidBarLength
 	}
 }
 
+// getBarLengthDuration returns the usual duration of bars of a length. The bounds of a particular bar are given
+// by BarBounds, since day and week bars are aligned in local time.
 func getBarLengthDuration(b BarLength) (time.Duration, error) {
 	switch b {
 	case BarLengthSecond:
 		return time.Second, nil
 	case BarLengthMinute:
 		return time.Minute, nil
+	case BarLengthHour:
+		return time.Hour, nil
 	case BarLengthDay:
 		return time.Hour * 24, nil
+	case BarLengthWeek:
+		return time.Hour * 24 * 7, nil
+	default:
+		spec, err := ParseBarSpec(b)
+		return spec.Length, err
+	}
+}
+
+// barLengthSpecID is the ID of the bar lengths of BarSpecs, which must be encoded alongside it.
+const barLengthSpecID = 0xff
+
+// barLengthID encodes a bar length as a small integer, for compact keys and on-disk formats.
+// Bar lengths of BarSpecs all share barLengthSpecID.
+func barLengthID(b BarLength) uint8 {
+	switch b {
+	case BarLengthSecond:
+		return 1
+	case BarLengthMinute:
+		return 2
+	case BarLengthDay:
+		return 3
+	case BarLengthHour:
+		return 4
+	case BarLengthWeek:
+		return 5
 	default:
-		return 0, ErrInvalidBarLength
+		return barLengthSpecID
 	}
 }
 
-func snapTimestamp(ts ptime.INanoseconds) ptime.IMilliseconds {
-	return ptime.IMillisecondsFromDuration(ts.ToDuration().Truncate(time.Minute))
+func barLengthFromID(id uint8) (BarLength, error) {
+	switch id {
+	case 1:
+		return BarLengthSecond, nil
+	case 2:
+		return BarLengthMinute, nil
+	case 3:
+		return BarLengthDay, nil
+	case 4:
+		return BarLengthHour, nil
+	case 5:
+		return BarLengthWeek, nil
+	default:
+		return "", ErrInvalidBarLength
+	}
+}
+
+// snapTimestamp returns the start of the bar of a ticker with the given length that contains ts, under which
+// the bar is stored. Callers validate the bar length; ts is only truncated to milliseconds if it's invalid.
+func snapTimestamp(ticker string, ts ptime.INanoseconds, barLength BarLength) ptime.IMilliseconds {
+	start, _, err := BarBounds(ticker, ts, barLength)
+	if err != nil {
+		return ptime.IMillisecondsFromDuration(ts.ToDuration())
+	}
+
+	return start
+}
+
+type integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+// setInteger assigns v to dst, whatever the width of dst's integer type.
+func setInteger[T integer](dst *T, v int64) {
+	*dst = T(v)
+}
+
+// lookupTTL returns the TTL of bars of a length, if they expire. Bars of a BarSpec that has no TTL of its own
+// expire like hour bars, the longest they can be.
+func lookupTTL(ttl map[BarLength]time.Duration, barLength BarLength) (time.Duration, bool) {
+	if d, ok := ttl[barLength]; ok {
+		return d, true
+	}
+
+	if _, err := ParseBarSpec(barLength); err == nil {
+		d, ok := ttl[BarLengthHour]
+		return d, ok
+	}
+
+	return 0, false
 }
@@ -2,18 +2,34 @@ package aggregates
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/polygon-io/go-lib-models/v2/globals"
 	"github.com/polygon-io/go-lib-models/v2/stocks"
+	"github.com/polygon-io/ptime"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/suremarc/go-lib-aggregates/calendar"
 	"github.com/suremarc/go-lib-aggregates/db"
 	"github.com/suremarc/go-lib-aggregates/logic"
+	"github.com/suremarc/go-lib-aggregates/publish"
+	"github.com/suremarc/go-lib-aggregates/tracing"
 )
 
-func testLogic(agg globals.Aggregate, trade *stocks.Trade) globals.Aggregate {
+func testLogic(agg globals.Aggregate, state *logic.BarState, trade *stocks.Trade) globals.Aggregate {
 	if agg.Open == 0 {
 		agg.Open = trade.Price
 	}
@@ -28,32 +44,35 @@ func testLogic(agg globals.Aggregate, trade *stocks.Trade) globals.Aggregate {
 
 	agg.Volume += float64(trade.Size_)
 
+	state.PriceVolume += trade.Price * float64(trade.Size_)
+	agg.VWAP = state.PriceVolume / agg.Volume
+
 	return agg
 }
 
-func testDB[Tx any](t *testing.T, store db.DB[Tx]) {
-	ctx := context.Background()
-
-	trades := []stocks.Trade{
-		{
-			Base: stocks.Base{
-				Ticker:    "PGON",
-				Timestamp: 1,
-			},
-			Price: 1.0,
-			Size_: 2,
+var testTrades = []stocks.Trade{
+	{
+		Base: stocks.Base{
+			Ticker:    "PGON",
+			Timestamp: 1,
 		},
-		{
-			Base: stocks.Base{
-				Ticker:    "PGON",
-				Timestamp: 1,
-			},
-			Price: 2.0,
-			Size_: 1,
+		Price: 1.0,
+		Size_: 2,
+	},
+	{
+		Base: stocks.Base{
+			Ticker:    "PGON",
+			Timestamp: 1,
 		},
-	}
+		Price: 2.0,
+		Size_: 1,
+	},
+}
 
-	for _, trade := range trades {
+func testDB[Tx any](t *testing.T, store db.DB[Tx]) {
+	ctx := context.Background()
+
+	for _, trade := range testTrades {
 		_, _, err := logic.ProcessTrade(ctx, store, testLogic, &trade, db.BarLengthMinute)
 		require.NoError(t, err)
 	}
@@ -67,9 +86,1775 @@ func testDB[Tx any](t *testing.T, store db.DB[Tx]) {
 	assert.Equal(t, 1.0, agg.Low)
 	assert.Equal(t, 2.0, agg.Close)
 	assert.Equal(t, 3.0, agg.Volume)
+	assert.InDelta(t, 4.0/3, agg.VWAP, 1e-12)
+
+	raw, err := store.GetState(tx, "PGON", 0, db.BarLengthMinute)
+	require.NoError(t, err)
+	var state logic.BarState
+	require.NoError(t, state.UnmarshalBinary(raw))
+	assert.Equal(t, 4.0, state.PriceVolume)
 }
 
 func TestNativeDB(t *testing.T) {
 	store := db.NewNativeDB(false)
 	testDB[db.Tx](t, store)
 }
+
+func TestNativeDBLockTimeout(t *testing.T) {
+	store := db.NewNativeDB(false)
+
+	// hold the lock on PGON without committing
+	stuck, err := store.NewTx(context.Background())
+	require.NoError(t, err)
+	_, err = store.Get(stuck, "PGON", 0, db.BarLengthMinute)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	_, err = store.Get(tx, "PGON", 0, db.BarLengthMinute)
+	require.ErrorIs(t, err, db.ErrLockTimeout)
+	require.NoError(t, store.Commit(tx))
+
+	require.NoError(t, store.Commit(stuck))
+
+	stats := store.LockStats()
+	require.Len(t, stats, 1)
+	assert.Equal(t, "PGON", stats[0].Ticker)
+	assert.Equal(t, int64(1), stats[0].Acquisitions)
+	assert.Equal(t, int64(1), stats[0].Timeouts)
+	assert.GreaterOrEqual(t, stats[0].TotalWait, 10*time.Millisecond)
+}
+
+func TestActorDB(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewActorDB(4, 16, false)
+	defer store.Close()
+
+	for i := range testTrades {
+		require.NoError(t, logic.SendTrade(ctx, store, testLogic, &testTrades[i], db.BarLengthMinute, nil))
+	}
+
+	// updates are applied in order, so this observes both trades above
+	agg, updated, err := store.Update(ctx, "PGON", 0, db.BarLengthMinute, func(agg globals.Aggregate, raw []byte) (globals.Aggregate, []byte) {
+		var state logic.BarState
+		require.NoError(t, state.UnmarshalBinary(raw))
+		assert.Equal(t, 4.0, state.PriceVolume)
+
+		return agg, raw
+	})
+	require.NoError(t, err)
+	assert.False(t, updated)
+	assert.Equal(t, 1.0, agg.Open)
+	assert.Equal(t, 2.0, agg.High)
+	assert.Equal(t, 1.0, agg.Low)
+	assert.Equal(t, 2.0, agg.Close)
+	assert.Equal(t, 3.0, agg.Volume)
+}
+
+func TestColumnarDB(t *testing.T) {
+	store := db.NewColumnarDB(0)
+	testDB[db.Tx](t, store)
+
+	// bars are keyed by their start, not by their timestamp
+	ctx := context.Background()
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	require.NoError(t, store.Upsert(tx, globals.Aggregate{
+		Ticker:         "KEYED",
+		StartTimestamp: 60_000,
+		EndTimestamp:   120_000,
+		Volume:         1,
+	}))
+	agg, err := store.Get(tx, "KEYED", ptime.IMilliseconds(60_000).ToINanoseconds(), db.BarLengthMinute)
+	require.NoError(t, err)
+	require.NoError(t, store.Commit(tx))
+	assert.Equal(t, 1.0, agg.Volume)
+}
+
+func TestColumnarDBEviction(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewColumnarDB(2048)
+
+	for i := 0; i < 100; i++ {
+		trade := stocks.Trade{
+			Base: stocks.Base{
+				Ticker:    fmt.Sprintf("T%d", i),
+				Timestamp: int64(i) * 60_000,
+			},
+			Price: 1,
+			Size_: 1,
+		}
+		_, _, err := logic.ProcessTrade[db.Tx](ctx, store, testLogic, &trade, db.BarLengthMinute)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, store.MemoryUsage(), int64(2048))
+	}
+
+	var count int
+	store.Range(func(globals.Aggregate) bool {
+		count++
+		return true
+	})
+	assert.Greater(t, count, 0)
+	assert.Less(t, count, 100)
+
+	// the most recently updated ticker survives eviction
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	agg, err := store.Get(tx, "T99", ptime.IMilliseconds(99*60_000).ToINanoseconds(), db.BarLengthMinute)
+	require.NoError(t, err)
+	require.NoError(t, store.Commit(tx))
+	assert.Equal(t, 1.0, agg.Volume)
+}
+
+func TestDiskDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aggregates.log")
+	store, err := db.OpenDiskDB(path, false)
+	require.NoError(t, err)
+	testDB[db.DiskTx](t, store)
+
+	// bars are keyed by their start, not by their timestamp
+	tx, err := store.NewTx(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, store.Upsert(tx, globals.Aggregate{
+		Ticker:         "KEYED",
+		StartTimestamp: 60_000,
+		EndTimestamp:   120_000,
+		Volume:         1,
+	}))
+	require.NoError(t, store.Commit(tx))
+	tx, err = store.NewTx(context.Background())
+	require.NoError(t, err)
+	agg, err := store.Get(tx, "KEYED", ptime.IMilliseconds(60_000).ToINanoseconds(), db.BarLengthMinute)
+	require.NoError(t, err)
+	require.NoError(t, store.Commit(tx))
+	assert.Equal(t, 1.0, agg.Volume)
+	require.NoError(t, store.Close())
+
+	// simulate a crash in the middle of writing a transaction
+	fi, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = fi.Write([]byte{0xff, 0x00, 0x00, 0x00, 0x01})
+	require.NoError(t, err)
+	require.NoError(t, fi.Close())
+
+	store, err = db.OpenDiskDB(path, false)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	// a torn header can claim any length, which mustn't be allocated
+	fi, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = fi.Write([]byte{0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00, 0x01})
+	require.NoError(t, err)
+	require.NoError(t, fi.Close())
+
+	store, err = db.OpenDiskDB(path, false)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	// corruption before the last entry isn't a torn write, so the entries after it aren't truncated
+	valid, err := os.ReadFile(path)
+	require.NoError(t, err)
+	corrupt := append([]byte(nil), valid...)
+	corrupt[10] ^= 0xff
+	require.NoError(t, os.WriteFile(path, corrupt, 0o644))
+	_, err = db.OpenDiskDB(path, false)
+	require.ErrorIs(t, err, db.ErrCorruptLog)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(valid)), info.Size())
+	require.NoError(t, os.WriteFile(path, valid, 0o644))
+
+	store, err = db.OpenDiskDB(path, false)
+	require.NoError(t, err)
+	defer store.Close()
+
+	require.NoError(t, store.Compact())
+	assert.Zero(t, store.Garbage())
+
+	var aggs []globals.Aggregate
+	require.NoError(t, store.Scan(context.Background(), "PGON", db.BarLengthMinute, 0, 60_000, func(agg globals.Aggregate) bool {
+		aggs = append(aggs, agg)
+		return true
+	}))
+	require.Len(t, aggs, 1)
+	assert.Equal(t, 1.0, aggs[0].Open)
+	assert.Equal(t, 2.0, aggs[0].Close)
+	assert.Equal(t, 3.0, aggs[0].Volume)
+
+	// the state survives compaction, and is deleted with its bar
+	tx, err = store.NewTx(context.Background())
+	require.NoError(t, err)
+	raw, err := store.GetState(tx, "PGON", 0, db.BarLengthMinute)
+	require.NoError(t, err)
+	assert.NotNil(t, raw)
+	require.NoError(t, store.Delete(tx, "PGON", 0, db.BarLengthMinute))
+	require.NoError(t, store.Commit(tx))
+
+	tx, err = store.NewTx(context.Background())
+	require.NoError(t, err)
+	raw, err = store.GetState(tx, "PGON", 0, db.BarLengthMinute)
+	require.NoError(t, err)
+	assert.Nil(t, raw)
+	require.NoError(t, store.Commit(tx))
+}
+
+func TestArchive(t *testing.T) {
+	dir := t.TempDir()
+	minute := ptime.IMillisecondsFromDuration(time.Minute)
+
+	w := db.NewArchiveWriter(dir)
+	for _, i := range []ptime.IMilliseconds{3, 1, 2} {
+		require.NoError(t, w.Add(globals.Aggregate{
+			Ticker:         "X:BTCUSD",
+			Timestamp:      i * minute,
+			StartTimestamp: i * minute,
+			EndTimestamp:   (i + 1) * minute,
+			Open:           float64(i),
+		}))
+	}
+	require.NoError(t, w.Flush())
+
+	// merge a correction and a new bar into the existing file
+	for _, i := range []ptime.IMilliseconds{2, 4} {
+		require.NoError(t, w.Add(globals.Aggregate{
+			Ticker:         "X:BTCUSD",
+			Timestamp:      i * minute,
+			StartTimestamp: i * minute,
+			EndTimestamp:   (i + 1) * minute,
+			Open:           float64(i) * 10,
+		}))
+	}
+	require.NoError(t, w.Flush())
+
+	// bars are keyed by their start, not by their timestamp
+	require.NoError(t, w.Add(globals.Aggregate{
+		Ticker:         "X:BTCUSD",
+		StartTimestamp: 5 * minute,
+		EndTimestamp:   6 * minute,
+		Open:           50,
+	}))
+	require.NoError(t, w.Flush())
+
+	archive := db.OpenArchive(dir)
+	defer archive.Close()
+
+	var opens []float64
+	require.NoError(t, archive.Scan(context.Background(), "X:BTCUSD", db.BarLengthMinute, 2*minute, 5*minute, func(agg globals.Aggregate) bool {
+		opens = append(opens, agg.Open)
+		return true
+	}))
+	assert.Equal(t, []float64{20, 3, 40}, opens)
+
+	var keyed []globals.Aggregate
+	require.NoError(t, archive.Scan(context.Background(), "X:BTCUSD", db.BarLengthMinute, 5*minute, 6*minute, func(agg globals.Aggregate) bool {
+		keyed = append(keyed, agg)
+		return true
+	}))
+	require.Len(t, keyed, 1)
+	assert.Equal(t, 50.0, keyed[0].Open)
+	assert.Equal(t, 5*minute, keyed[0].StartTimestamp)
+	assert.Equal(t, 6*minute, keyed[0].EndTimestamp)
+
+	require.NoError(t, archive.Scan(context.Background(), "PGON", db.BarLengthMinute, 0, 5*minute, func(agg globals.Aggregate) bool {
+		t.Fatal("unexpected bar")
+		return false
+	}))
+}
+
+func TestCodecs(t *testing.T) {
+	agg := globals.Aggregate{
+		Ticker:         "PGON",
+		Timestamp:      60_000,
+		StartTimestamp: 60_000,
+		EndTimestamp:   120_000,
+		Open:           1,
+		High:           2,
+		Low:            0.5,
+		Close:          1.5,
+		Volume:         300,
+		VWAP:           1.25,
+		Transactions:   7,
+	}
+
+	for _, codec := range []db.Codec{db.JSONCodec, db.BinaryCodec, db.ProtobufCodec} {
+		buf, err := db.EncodeAggregate(codec, agg)
+		require.NoError(t, err)
+
+		var decoded globals.Aggregate
+		require.NoError(t, db.DecodeAggregate(buf, &decoded))
+		assert.Equal(t, agg, decoded)
+	}
+
+	// values written before codecs existed are bare JSON
+	legacy, err := agg.MarshalJSON()
+	require.NoError(t, err)
+
+	var decoded globals.Aggregate
+	require.NoError(t, db.DecodeAggregate(legacy, &decoded))
+	assert.Equal(t, agg, decoded)
+}
+
+func newTestRedisClient(t *testing.T) *redis.Client {
+	client := redis.NewClient(&redis.Options{
+		Addr: getEnv("REDIS_URL", "localhost:6379"),
+	})
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Skipf("redis unavailable: %v", err)
+	}
+
+	require.NoError(t, client.FlushAll(context.Background()).Err())
+
+	return client
+}
+
+func TestRedis(t *testing.T) {
+	store := db.NewRedis(newTestRedisClient(t), db.WithCodec(db.BinaryCodec), db.WithNamespace("test"))
+	testDB[db.RedisTx](t, store)
+
+	var aggs []globals.Aggregate
+	require.NoError(t, store.Range(context.Background(), func(agg globals.Aggregate) bool {
+		aggs = append(aggs, agg)
+		return true
+	}))
+	require.Len(t, aggs, 1)
+	assert.Equal(t, "PGON", aggs[0].Ticker)
+	assert.Equal(t, 3.0, aggs[0].Volume)
+}
+
+func TestRedisHashLayout(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewRedis(newTestRedisClient(t), db.WithHashLayout())
+	testDB[db.RedisTx](t, store)
+
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	require.NoError(t, store.IncrBy(tx, "PGON", 0, db.BarLengthMinute, 2, 1))
+	require.NoError(t, store.Commit(tx))
+
+	var aggs []globals.Aggregate
+	require.NoError(t, store.Scan(ctx, "PGON", db.BarLengthMinute, 0, 60_000, func(agg globals.Aggregate) bool {
+		aggs = append(aggs, agg)
+		return true
+	}))
+	require.Len(t, aggs, 1)
+	assert.Equal(t, 1.0, aggs[0].Open)
+	assert.Equal(t, 5.0, aggs[0].Volume)
+}
+
+func TestRedisConflicts(t *testing.T) {
+	ctx := context.Background()
+	client := newTestRedisClient(t)
+
+	for _, store := range []*db.Redis{db.NewRedis(client), db.NewRedis(client, db.WithHashLayout(), db.WithNamespace("hash"))} {
+		// a transaction that read a bar that another one changed since can't commit
+		tx, err := store.NewTx(ctx)
+		require.NoError(t, err)
+		agg, err := store.Get(tx, "PGON", 0, db.BarLengthMinute)
+		require.NoError(t, err)
+		_, err = store.GetState(tx, "PGON", 0, db.BarLengthMinute)
+		require.NoError(t, err)
+
+		other, err := store.NewTx(ctx)
+		require.NoError(t, err)
+		otherAgg, err := store.Get(other, "PGON", 0, db.BarLengthMinute)
+		require.NoError(t, err)
+		otherAgg.Volume = 5
+		require.NoError(t, store.Upsert(other, otherAgg))
+		require.NoError(t, store.UpsertState(other, "PGON", 0, db.BarLengthMinute, []byte("state")))
+		require.NoError(t, store.Commit(other))
+
+		agg.Volume = 1
+		require.NoError(t, store.Upsert(tx, agg))
+		require.ErrorIs(t, store.Commit(tx), db.ErrConflict)
+
+		// a transaction rolled back by a failed operation can still be used
+		tx, err = store.NewTx(ctx)
+		require.NoError(t, err)
+		_, err = store.Get(tx, "PGON", 0, db.BarLength("bogus"))
+		require.Error(t, err)
+		_, err = store.Get(tx, "PGON", 0, db.BarLengthMinute)
+		require.NoError(t, err)
+		require.NoError(t, store.Commit(tx))
+
+		tx, err = store.NewTx(ctx)
+		require.NoError(t, err)
+		agg, err = store.Get(tx, "PGON", 0, db.BarLengthMinute)
+		require.NoError(t, err)
+		require.NoError(t, store.Commit(tx))
+		assert.Equal(t, 5.0, agg.Volume)
+
+		// concurrent trades are retried rather than overwriting one another
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					trade := &stocks.Trade{Base: stocks.Base{Ticker: "PGON", Timestamp: 60_000}, Price: 10, Size_: 1}
+					_, _, err := logic.ProcessTrade[db.RedisTx](ctx, store, logic.StocksLogic, trade, db.BarLengthMinute)
+					assert.NoError(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		tx, err = store.NewTx(ctx)
+		require.NoError(t, err)
+		agg, err = store.Get(tx, "PGON", ptime.IMilliseconds(60_000).ToINanoseconds(), db.BarLengthMinute)
+		require.NoError(t, err)
+		require.NoError(t, store.Commit(tx))
+		assert.Equal(t, 80.0, agg.Volume)
+		assert.Equal(t, int32(80), agg.Transactions)
+	}
+}
+
+func TestRedisScriptLogic(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewRedis(newTestRedisClient(t), db.WithHashLayout())
+
+	stocksTrades := []*stocks.Trade{
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 1}, Price: 10.1, Size_: 100},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 2}, Price: 10.3, Size_: 7, Conditions: []int32{12}},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 3}, Price: 9.7, Size_: 50, Conditions: []int32{15}},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 4}, Price: 9.9, Size_: 3, Conditions: []int32{2, 37}},
+		// out of order, and tied with the first trade but earlier in sequence
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 1, SequenceNumber: -1}, Price: 10.2, Size_: 5},
+		// negative sequence numbers compare numerically, down to the smallest
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 1, SequenceNumber: -2}, Price: 10.4, Size_: 5},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 1, SequenceNumber: -10}, Price: 10.6, Size_: 5},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 1, SequenceNumber: math.MinInt64}, Price: 10.5, Size_: 5},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 4, SequenceNumber: math.MaxInt64}, Price: 9.8, Size_: 5},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 60_001}, Price: 10, Size_: 1},
+	}
+	require.NoError(t, logic.CheckScriptLogic(ctx, store, logic.StocksScriptLogic, stocksTrades, db.BarLengthMinute))
+}
+
+func TestStocksLogicOutOfOrder(t *testing.T) {
+	ctx := context.Background()
+
+	trades := []stocks.Trade{
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 3_000, SequenceNumber: 7}, Price: 10.4, Size_: 10},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 1_000, SequenceNumber: 2}, Price: 10.1, Size_: 10},
+		// tied with the first trade by timestamp, but later in sequence
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 3_000, SequenceNumber: 8}, Price: 10.5, Size_: 10},
+		// Form T trades count toward high and low, but not open and close
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 500, SequenceNumber: 1}, Price: 9.5, Size_: 10, Conditions: []int32{12}},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 2_000, SequenceNumber: 5}, Price: 10.2, Size_: 10},
+	}
+
+	// every rotation of the trades must produce the same bar
+	for i := range trades {
+		store := db.NewNativeDB(false)
+		for j := range trades {
+			trade := trades[(i+j)%len(trades)]
+			_, _, err := logic.ProcessTrade[db.Tx](ctx, store, logic.StocksLogic, &trade, db.BarLengthMinute)
+			require.NoError(t, err)
+		}
+
+		tx, err := store.NewTx(ctx)
+		require.NoError(t, err)
+		agg, err := store.Get(tx, "PGON", 0, db.BarLengthMinute)
+		require.NoError(t, err)
+		require.NoError(t, store.Commit(tx))
+
+		assert.Equal(t, 10.1, agg.Open, "rotation %d", i)
+		assert.Equal(t, 10.5, agg.Close, "rotation %d", i)
+		assert.Equal(t, 10.5, agg.High, "rotation %d", i)
+		assert.Equal(t, 9.5, agg.Low, "rotation %d", i)
+	}
+}
+
+func TestStocksDailyLogic(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewNativeDB(false)
+
+	primaryExchanges := func(ticker string) (int32, bool) {
+		return 12, ticker == "PGON"
+	}
+	stocksLogic := logic.ByBarLength(logic.StocksIntradayLogic, logic.NewStocksDailyLogic(logic.DefaultConditionRules, primaryExchanges))
+
+	trades := []stocks.Trade{
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 1_000}, Exchange: 4, Price: 10, Size_: 100},
+		// an official close from another exchange
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 50_000}, Exchange: 4, Price: 11, Size_: 100, Conditions: []int32{15}},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 2_000}, Exchange: 12, Price: 10.2, Size_: 100, Conditions: []int32{16}},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 40_000}, Exchange: 11, Price: 10.6, Size_: 100},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 45_000}, Exchange: 12, Price: 10.5, Size_: 100, Conditions: []int32{15}},
+		// later than the official close
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 59_000}, Exchange: 4, Price: 10.9, Size_: 10},
+	}
+
+	for _, barLength := range []db.BarLength{db.BarLengthMinute, db.BarLengthDay} {
+		for _, trade := range trades {
+			_, _, err := logic.ProcessTrade[db.Tx](ctx, store, stocksLogic, &trade, barLength)
+			require.NoError(t, err)
+		}
+	}
+
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	defer store.Commit(tx)
+
+	minute, err := store.Get(tx, "PGON", 0, db.BarLengthMinute)
+	require.NoError(t, err)
+	assert.Equal(t, 10.0, minute.Open)
+	assert.Equal(t, 10.9, minute.Close)
+
+	day, err := store.Get(tx, "PGON", 0, db.BarLengthDay)
+	require.NoError(t, err)
+	assert.Equal(t, 10.2, day.Open)
+	assert.Equal(t, 10.5, day.Close)
+	assert.Equal(t, 10.9, day.High)
+	assert.Equal(t, 10.0, day.Low)
+	assert.Equal(t, 210.0, day.Volume)
+}
+
+// A week bar opens with the opening print of its first day and closes with the closing print of its last,
+// whichever order they arrive in.
+func TestStocksLogicDailyRules(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewNativeDB(false)
+
+	// a corrected consolidated close sets the close of the day, but not of the minute
+	trades := []stocks.Trade{
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 1_000}, Exchange: 4, Price: 10, Size_: 100},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: 30_000}, Exchange: 4, Price: 10.4, Size_: 100, Conditions: []int32{38}},
+	}
+
+	for _, barLength := range []db.BarLength{db.BarLengthMinute, db.BarLengthDay} {
+		for _, trade := range trades {
+			_, _, err := logic.ProcessTrade[db.Tx](ctx, store, logic.StocksLogic, &trade, barLength)
+			require.NoError(t, err)
+		}
+	}
+
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	minute, err := store.Get(tx, "PGON", 0, db.BarLengthMinute)
+	require.NoError(t, err)
+	day, err := store.Get(tx, "PGON", 0, db.BarLengthDay)
+	require.NoError(t, err)
+	require.NoError(t, store.Commit(tx))
+
+	assert.Equal(t, 10.0, minute.Close)
+	assert.Equal(t, 10.4, day.Close)
+	assert.Equal(t, minute.High, day.High)
+	assert.Equal(t, minute.Volume, day.Volume)
+
+	// primary exchanges are loaded from a file
+	path := filepath.Join(t.TempDir(), "exchanges.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("version: 1\nexchanges:\n  PGON: 12\n"), 0o644))
+	exchanges, err := logic.LoadPrimaryExchanges(path)
+	require.NoError(t, err)
+	exchange, ok := exchanges.Lookup("PGON")
+	assert.True(t, ok)
+	assert.Equal(t, int32(12), exchange)
+	_, ok = exchanges.Lookup("AAPL")
+	assert.False(t, ok)
+
+	daily := logic.NewStocksDailyLogic(logic.DefaultConditionRules, exchanges.Lookup)
+	agg := daily(day, &logic.BarState{}, &stocks.Trade{Base: stocks.Base{Ticker: "PGON", Timestamp: 2_000}, Exchange: 12, Price: 10.2, Conditions: []int32{16}})
+	assert.Equal(t, 10.2, agg.Open)
+
+	require.NoError(t, os.WriteFile(path, []byte("version: 2\n"), 0o644))
+	_, err = logic.LoadPrimaryExchanges(path)
+	require.ErrorIs(t, err, logic.ErrInvalidPrimaryExchanges)
+}
+
+func TestStocksWeeklyOfficialPrints(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewNativeDB(false)
+
+	primaryExchanges := func(ticker string) (int32, bool) {
+		return 12, ticker == "PGON"
+	}
+	stocksLogic := logic.ByBarLength(logic.StocksIntradayLogic, logic.NewStocksDailyLogic(logic.DefaultConditionRules, primaryExchanges))
+
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	at := func(day, hour, min int) int64 {
+		return time.Date(2022, 3, day, hour, min, 0, 0, newYork).UnixNano()
+	}
+	week := []stocks.Trade{
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: at(14, 9, 30)}, Exchange: 12, Price: 20, Size_: 100, Conditions: []int32{16}},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: at(15, 16, 0)}, Exchange: 12, Price: 23, Size_: 100, Conditions: []int32{15}},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: at(15, 9, 30)}, Exchange: 12, Price: 22, Size_: 100, Conditions: []int32{16}},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: at(14, 16, 0)}, Exchange: 12, Price: 21, Size_: 100, Conditions: []int32{15}},
+	}
+	for _, trade := range week {
+		_, _, err := logic.ProcessTrade[db.Tx](ctx, store, stocksLogic, &trade, db.BarLengthWeek)
+		require.NoError(t, err)
+	}
+
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	defer store.Commit(tx)
+
+	weekBar, err := store.Get(tx, "PGON", ptime.INanoseconds(at(14, 12, 0)), db.BarLengthWeek)
+	require.NoError(t, err)
+	assert.Equal(t, 20.0, weekBar.Open)
+	assert.Equal(t, 23.0, weekBar.Close)
+}
+
+func TestMarketTimezones(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewNativeDB(false)
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	cases := []struct {
+		name      string
+		ticker    string
+		at        time.Time
+		barLength db.BarLength
+		start     time.Time
+		length    time.Duration
+	}{
+		{"hour", "PGON", time.Date(2022, 3, 14, 9, 45, 0, 0, newYork), db.BarLengthHour, time.Date(2022, 3, 14, 9, 0, 0, 0, newYork), time.Hour},
+		{"day", "PGON", time.Date(2022, 3, 14, 23, 30, 0, 0, newYork), db.BarLengthDay, time.Date(2022, 3, 14, 0, 0, 0, 0, newYork), 24 * time.Hour},
+		{"spring forward", "PGON", time.Date(2022, 3, 13, 12, 0, 0, 0, newYork), db.BarLengthDay, time.Date(2022, 3, 13, 0, 0, 0, 0, newYork), 23 * time.Hour},
+		{"fall back", "O:PGON220318C00010000", time.Date(2022, 11, 6, 12, 0, 0, 0, newYork), db.BarLengthDay, time.Date(2022, 11, 6, 0, 0, 0, 0, newYork), 25 * time.Hour},
+		{"week", "PGON", time.Date(2022, 3, 16, 12, 0, 0, 0, newYork), db.BarLengthWeek, time.Date(2022, 3, 14, 0, 0, 0, 0, newYork), 7 * 24 * time.Hour},
+		{"week across DST", "PGON", time.Date(2022, 3, 13, 12, 0, 0, 0, newYork), db.BarLengthWeek, time.Date(2022, 3, 7, 0, 0, 0, 0, newYork), 7*24*time.Hour - time.Hour},
+		{"crypto", "X:BTCUSD", time.Date(2022, 3, 13, 23, 30, 0, 0, newYork), db.BarLengthDay, time.Date(2022, 3, 14, 0, 0, 0, 0, time.UTC), 24 * time.Hour},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tx, err := store.NewTx(ctx)
+			require.NoError(t, err)
+
+			agg, err := store.Get(tx, c.ticker, ptime.INanosecondsFromTime(c.at), c.barLength)
+			require.NoError(t, err)
+			assert.Equal(t, ptime.IMillisecondsFromTime(c.start), agg.StartTimestamp)
+			assert.Equal(t, ptime.IMillisecondsFromDuration(c.length), agg.EndTimestamp-agg.StartTimestamp)
+
+			// the bar length is inferred from the bounds
+			agg.Volume = 1
+			require.NoError(t, store.Upsert(tx, agg))
+			agg, err = store.Get(tx, c.ticker, ptime.INanosecondsFromTime(c.at), c.barLength)
+			require.NoError(t, err)
+			assert.Equal(t, 1.0, agg.Volume)
+			require.NoError(t, store.Commit(tx))
+		})
+	}
+}
+
+func TestBarSpecs(t *testing.T) {
+	for _, c := range []struct {
+		spec      db.BarSpec
+		barLength db.BarLength
+	}{
+		{db.BarSpec{Length: 30 * time.Minute}, "30m"},
+		{db.BarSpec{Length: time.Hour, SessionOpen: true}, "60m@open"},
+		{db.BarSpec{Length: time.Hour, Offset: 9*time.Hour + 30*time.Minute}, "60m@0930"},
+	} {
+		barLength, err := c.spec.BarLength()
+		require.NoError(t, err)
+		assert.Equal(t, c.barLength, barLength)
+
+		spec, err := db.ParseBarSpec(barLength)
+		require.NoError(t, err)
+		assert.Equal(t, c.spec, spec)
+	}
+
+	for _, barLength := range []db.BarLength{"45m", "60m@2500", "60m@0975", "m@open", "60"} {
+		_, err := db.ParseBarSpec(barLength)
+		assert.ErrorIs(t, err, db.ErrInvalidBarLength, barLength)
+	}
+
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	at := time.Date(2022, 3, 14, 9, 45, 0, 0, newYork)
+
+	t.Run("native", func(t *testing.T) {
+		testBarSpecs[db.Tx](t, db.NewNativeDB(false), at)
+	})
+
+	t.Run("columnar", func(t *testing.T) {
+		testBarSpecs[db.Tx](t, db.NewColumnarDB(0), at)
+	})
+
+	t.Run("disk", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "aggregates.log")
+		store, err := db.OpenDiskDB(path, false)
+		require.NoError(t, err)
+		testBarSpecs[db.DiskTx](t, store, at)
+		require.NoError(t, store.Close())
+
+		// the bar length of the spec survives a restart
+		store, err = db.OpenDiskDB(path, false)
+		require.NoError(t, err)
+		defer store.Close()
+
+		var aggs []globals.Aggregate
+		require.NoError(t, store.Scan(context.Background(), "PGON", "60m@open", 0, ptime.IMillisecondsFromTime(at.Add(time.Hour)), func(agg globals.Aggregate) bool {
+			aggs = append(aggs, agg)
+			return true
+		}))
+		require.Len(t, aggs, 1)
+		assert.Equal(t, ptime.IMillisecondsFromTime(at.Add(-15*time.Minute)), aggs[0].StartTimestamp)
+		assert.Equal(t, 2.0, aggs[0].Volume)
+	})
+
+	t.Run("sql", func(t *testing.T) {
+		sqlDB, err := sql.Open("sqlite", "file:bar_specs?mode=memory&cache=shared")
+		require.NoError(t, err)
+		defer sqlDB.Close()
+
+		store, err := db.NewSQL(sqlDB)
+		require.NoError(t, err)
+		testBarSpecs[sql.Tx](t, store, at)
+	})
+}
+
+// testBarSpecs aggregates two trades of a stock at and half an hour after at, a quarter past the regular open,
+// into hourly bars aligned to the open.
+func testBarSpecs[Tx any](t *testing.T, store db.DB[Tx], at time.Time) {
+	ctx := context.Background()
+
+	for _, ts := range []time.Time{at, at.Add(30 * time.Minute)} {
+		trade := stocks.Trade{
+			Base:  stocks.Base{Ticker: "PGON", Timestamp: ts.UnixMilli()},
+			Price: 1,
+			Size_: 1,
+		}
+		_, _, err := logic.ProcessTrade(ctx, store, testLogic, &trade, "60m@open")
+		require.NoError(t, err)
+	}
+
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+
+	// bars aligned to the open and to 9:30 are the same bars
+	agg, err := store.Get(tx, "PGON", ptime.INanosecondsFromTime(at), "60m@0930")
+	require.NoError(t, err)
+	assert.Equal(t, ptime.IMillisecondsFromTime(at.Add(-15*time.Minute)), agg.StartTimestamp)
+	assert.Equal(t, ptime.IMillisecondsFromTime(at.Add(45*time.Minute)), agg.EndTimestamp)
+	assert.Equal(t, 2.0, agg.Volume)
+
+	// which is the bar length inferred from their bounds
+	barLength, err := db.AggregateSchema.Key(agg).BarLength()
+	require.NoError(t, err)
+	assert.Equal(t, db.BarLength("60m@0030"), barLength)
+
+	// half-hour bars aligned to the open are aligned to midnight
+	agg, err = store.Get(tx, "PGON", ptime.INanosecondsFromTime(at), "30m@open")
+	require.NoError(t, err)
+	assert.Equal(t, ptime.IMillisecondsFromTime(at.Add(-15*time.Minute)), agg.StartTimestamp)
+	require.NoError(t, store.Commit(tx))
+
+	// and crypto has no open
+	tx, err = store.NewTx(ctx)
+	require.NoError(t, err)
+	agg, err = store.Get(tx, "X:BTCUSD", ptime.INanosecondsFromTime(at), "60m@open")
+	require.NoError(t, err)
+	assert.Equal(t, ptime.IMillisecondsFromTime(at.Truncate(time.Hour)), agg.StartTimestamp)
+	require.NoError(t, store.Commit(tx))
+}
+
+func TestMarketCalendar(t *testing.T) {
+	nyse := calendar.NYSE
+	at := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, nyse.Location())
+	}
+
+	assert.Equal(t, calendar.SessionClosed, nyse.Session(at(2022, 3, 14, 3, 59)))
+	assert.Equal(t, calendar.SessionPreMarket, nyse.Session(at(2022, 3, 14, 4, 0)))
+	assert.Equal(t, calendar.SessionRegular, nyse.Session(at(2022, 3, 14, 9, 30)))
+	assert.Equal(t, calendar.SessionAfterHours, nyse.Session(at(2022, 3, 14, 16, 0)))
+	assert.Equal(t, calendar.SessionClosed, nyse.Session(at(2022, 3, 14, 20, 0)))
+	assert.Equal(t, calendar.SessionClosed, nyse.Session(at(2022, 3, 12, 12, 0)))
+
+	holiday, ok := nyse.Holiday(at(2022, 11, 24, 12, 0))
+	assert.True(t, ok)
+	assert.Equal(t, "Thanksgiving Day", holiday)
+	assert.Equal(t, calendar.SessionClosed, nyse.Session(at(2022, 11, 24, 12, 0)))
+
+	day, ok := nyse.TradingDay(at(2022, 11, 25, 0, 0))
+	require.True(t, ok)
+	assert.True(t, day.EarlyClose)
+	assert.Equal(t, at(2022, 11, 25, 13, 0), day.RegularClose)
+	assert.Equal(t, calendar.SessionAfterHours, nyse.Session(at(2022, 11, 25, 13, 30)))
+	assert.Equal(t, calendar.SessionClosed, nyse.Session(at(2022, 11, 25, 17, 0)))
+
+	session := func(ticker string, at time.Time, barLength db.BarLength) calendar.Session {
+		store := db.NewNativeDB(false)
+		tx, err := store.NewTx(context.Background())
+		require.NoError(t, err)
+		defer store.Commit(tx)
+
+		agg, err := store.Get(tx, ticker, ptime.INanosecondsFromTime(at), barLength)
+		require.NoError(t, err)
+		return db.AggregateSchema.Key(agg).Session()
+	}
+
+	assert.Equal(t, calendar.SessionRegular, session("PGON", at(2022, 3, 14, 9, 30), db.BarLengthMinute))
+	assert.Equal(t, calendar.SessionPreMarket, session("PGON", at(2022, 3, 14, 8, 0), db.BarLengthHour))
+	assert.Equal(t, calendar.SessionMixed, session("PGON", at(2022, 3, 14, 9, 0), db.BarLengthHour))
+	assert.Equal(t, calendar.SessionMixed, session("PGON", at(2022, 3, 14, 12, 0), db.BarLengthDay))
+	assert.Equal(t, calendar.SessionClosed, session("PGON", at(2022, 11, 24, 12, 0), db.BarLengthDay))
+	assert.Equal(t, calendar.SessionRegular, session("X:BTCUSD", at(2022, 3, 12, 12, 0), db.BarLengthDay))
+
+	path := filepath.Join(t.TempDir(), "calendar.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"version": 1,
+		"name": "test",
+		"timezone": "Europe/London",
+		"hours": {"preMarketOpen": "07:00", "regularOpen": "08:00", "regularClose": "16:30", "afterHoursClose": "16:30"},
+		"earlyCloseHours": {"preMarketOpen": "07:00", "regularOpen": "08:00", "regularClose": "12:30", "afterHoursClose": "12:30"},
+		"holidays": {"2022-12-26": "Boxing Day"}
+	}`), 0o644))
+
+	loaded, err := calendar.Load(path)
+	require.NoError(t, err)
+	assert.False(t, loaded.IsTradingDay(time.Date(2022, 12, 26, 12, 0, 0, 0, time.UTC)))
+	assert.Equal(t, calendar.SessionRegular, loaded.Session(time.Date(2022, 7, 1, 7, 0, 0, 0, time.UTC)))
+
+	_, err = calendar.Parse([]byte("version: 1\ntimezone: UTC\nhours: {regularOpen: '17:00', regularClose: '09:00'}"))
+	require.ErrorIs(t, err, calendar.ErrInvalidCalendar)
+}
+
+func TestStocksRegularHoursLogic(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewNativeDB(false)
+
+	primaryExchanges := func(string) (int32, bool) {
+		return 12, true
+	}
+	stocksLogic := logic.ByBarLength(logic.StocksIntradayLogic, logic.NewStocksRegularHoursDailyLogic(logic.DefaultConditionRules, primaryExchanges))
+
+	at := func(hour, minute, second int) int64 {
+		return time.Date(2022, 3, 14, hour, minute, second, 0, calendar.NYSE.Location()).UnixNano()
+	}
+
+	trades := []stocks.Trade{
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: at(8, 0, 0)}, Exchange: 4, Price: 9, Size_: 100},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: at(10, 0, 0)}, Exchange: 4, Price: 10, Size_: 100},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: at(15, 59, 0)}, Exchange: 4, Price: 10.5, Size_: 100},
+		// the closing print is reported after the close
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: at(16, 0, 5)}, Exchange: 12, Price: 10.4, Size_: 100, Conditions: []int32{15}},
+		{Base: stocks.Base{Ticker: "PGON", Timestamp: at(17, 0, 0)}, Exchange: 4, Price: 11, Size_: 100},
+	}
+
+	for _, barLength := range []db.BarLength{db.BarLengthHour, db.BarLengthDay} {
+		for _, trade := range trades {
+			_, _, err := logic.ProcessTrade[db.Tx](ctx, store, stocksLogic, &trade, barLength)
+			require.NoError(t, err)
+		}
+	}
+
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	defer store.Commit(tx)
+
+	// intraday bars include every trade
+	hour, err := store.Get(tx, "PGON", ptime.INanoseconds(at(8, 0, 0)), db.BarLengthHour)
+	require.NoError(t, err)
+	assert.Equal(t, 9.0, hour.Open)
+
+	day, err := store.Get(tx, "PGON", ptime.INanoseconds(at(8, 0, 0)), db.BarLengthDay)
+	require.NoError(t, err)
+	assert.Equal(t, 10.0, day.Open)
+	assert.Equal(t, 10.4, day.Close)
+	assert.Equal(t, 10.5, day.High)
+	assert.Equal(t, 10.0, day.Low)
+	assert.Equal(t, 200.0, day.Volume)
+}
+
+func TestConditionRules(t *testing.T) {
+	rules := logic.DefaultConditionRules
+
+	// a regular trade updates everything, while an odd lot only counts toward volume
+	assert.Equal(t, logic.Permissions{HighLow: true, OpenClose: true, Volume: true}, rules.Consolidated.Intraday.Permissions(nil))
+	assert.Equal(t, logic.Permissions{Volume: true}, rules.Consolidated.Intraday.Permissions([]int32{14, 37}))
+	assert.Equal(t, logic.Permissions{HighLow: true, Volume: true}, rules.Consolidated.Daily.Permissions([]int32{12}))
+
+	// market center daily rules follow the consolidated rules, but let official prints set the open and close
+	assert.Equal(t, logic.Permissions{OpenClose: true}, rules.MarketCenter.Daily.Permissions([]int32{15}))
+	assert.Equal(t, logic.Permissions{Volume: true}, rules.MarketCenter.Daily.Permissions([]int32{2}))
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"version": 1,
+		"revision": "test",
+		"consolidated": {"intraday": {"14": {"highLow": true, "volume": true}}}
+	}`), 0o644))
+
+	loaded, err := logic.LoadConditionRules(path)
+	require.NoError(t, err)
+	assert.Equal(t, "test", loaded.Revision)
+
+	stocksLogic := logic.NewStocksLogic(loaded.Consolidated.Intraday)
+	agg := stocksLogic(globals.Aggregate{}, &logic.BarState{}, &stocks.Trade{Price: 10, Size_: 1, Conditions: []int32{14}})
+	assert.Equal(t, 0.0, agg.Open)
+	assert.Equal(t, 10.0, agg.High)
+	assert.Equal(t, 1.0, agg.Volume)
+
+	_, err = logic.ParseConditionRules([]byte("version: 2"))
+	require.ErrorIs(t, err, logic.ErrInvalidConditionRules)
+}
+
+func TestBarStateV1(t *testing.T) {
+	// a state written before trade positions were tracked
+	var state logic.BarState
+	require.NoError(t, state.UnmarshalBinary([]byte{1, 0, 0, 0, 0, 0, 0, 0x10, 0x40}))
+	assert.Equal(t, logic.BarState{PriceVolume: 4}, state)
+
+	raw, err := state.MarshalBinary()
+	require.NoError(t, err)
+	assert.Equal(t, byte(2), raw[0])
+}
+
+func TestPostgresPartitions(t *testing.T) {
+	ctx := context.Background()
+
+	sqlDB, err := sql.Open("postgres", getEnv("POSTGRES_URL", "postgresql://localhost?sslmode=disable&user=postgres&password=postgres"))
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	if err := sqlDB.PingContext(ctx); err != nil {
+		t.Skipf("postgres unavailable: %v", err)
+	}
+
+	_, err = sqlDB.Exec("DROP TABLE IF EXISTS aggregates CASCADE")
+	require.NoError(t, err)
+
+	store, err := db.NewSQL(sqlDB, db.WithDailyPartitions(48*time.Hour))
+	require.NoError(t, err)
+	testDB[sql.Tx](t, store)
+
+	// bulk load a bar on the next day, replacing nothing
+	source := db.NewNativeDB(false)
+	_, _, err = logic.ProcessTrade[db.Tx](ctx, source, testLogic, &stocks.Trade{
+		Base:  stocks.Base{Ticker: "PGON", Timestamp: int64(24 * time.Hour)},
+		Price: 3,
+		Size_: 4,
+	}, db.BarLengthMinute)
+	require.NoError(t, err)
+
+	n, err := store.BulkLoad(ctx, source.Range)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	agg, err := store.Get(tx, "PGON", ptime.INanoseconds(24*time.Hour), db.BarLengthMinute)
+	require.NoError(t, err)
+	assert.Equal(t, 4.0, agg.Volume)
+	require.NoError(t, store.Commit(tx))
+
+	// only the first day is past the retention
+	require.NoError(t, store.MaintainPartitions(ctx, time.Unix(0, 0).Add(72*time.Hour)))
+
+	tx, err = store.NewTx(ctx)
+	require.NoError(t, err)
+	agg, err = store.Get(tx, "PGON", 0, db.BarLengthMinute)
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, agg.Volume)
+	agg, err = store.Get(tx, "PGON", ptime.INanoseconds(24*time.Hour), db.BarLengthMinute)
+	require.NoError(t, err)
+	assert.Equal(t, 4.0, agg.Volume)
+	require.NoError(t, store.Commit(tx))
+}
+
+// The first write into a day without a partition creates it, while the writing transaction holds the table.
+func TestPostgresPartitionOnWrite(t *testing.T) {
+	url, ok := os.LookupEnv("POSTGRES_URL")
+	if !ok {
+		t.Skip("POSTGRES_URL not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sqlDB, err := sql.Open("postgres", url)
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	_, err = sqlDB.Exec("DROP TABLE IF EXISTS aggregates CASCADE")
+	require.NoError(t, err)
+
+	store, err := db.NewSQL(sqlDB, db.WithDailyPartitions(0))
+	require.NoError(t, err)
+
+	ts := int64(10 * 24 * time.Hour)
+	_, _, err = logic.ProcessTrade[sql.Tx](ctx, store, testLogic, &stocks.Trade{
+		Base:  stocks.Base{Ticker: "PGON", Timestamp: ts},
+		Price: 3,
+		Size_: 4,
+	}, db.BarLengthMinute)
+	require.NoError(t, err)
+
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	agg, err := store.Get(tx, "PGON", ptime.INanoseconds(ts), db.BarLengthMinute)
+	require.NoError(t, err)
+	require.NoError(t, store.Commit(tx))
+	assert.Equal(t, 4.0, agg.Volume)
+}
+
+// Range orders tickers bytewise, as Copy expects, rather than by the database's collation.
+func TestPostgresRangeOrder(t *testing.T) {
+	url, ok := os.LookupEnv("POSTGRES_URL")
+	if !ok {
+		t.Skip("POSTGRES_URL not set")
+	}
+
+	ctx := context.Background()
+	sqlDB, err := sql.Open("postgres", url)
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	_, err = sqlDB.Exec("DROP TABLE IF EXISTS aggregates CASCADE")
+	require.NoError(t, err)
+
+	store, err := db.NewSQL(sqlDB)
+	require.NoError(t, err)
+
+	for _, ticker := range []string{"BFAM", "BF.B", "BF"} {
+		_, _, err := logic.ProcessTrade[sql.Tx](ctx, store, testLogic, &stocks.Trade{
+			Base:  stocks.Base{Ticker: ticker},
+			Price: 1,
+			Size_: 1,
+		}, db.BarLengthMinute)
+		require.NoError(t, err)
+	}
+
+	var tickers []string
+	require.NoError(t, store.Range(ctx, func(agg globals.Aggregate) bool {
+		tickers = append(tickers, agg.Ticker)
+		return true
+	}))
+	assert.Equal(t, []string{"BF", "BF.B", "BFAM"}, tickers)
+}
+
+func TestPublishQueue(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewNativeDB(false)
+
+	start := time.Date(2022, 3, 14, 10, 0, 0, 0, time.UTC)
+	now := start.Add(90 * time.Second)
+	queue := publish.NewQueue(publish.WithAllowedLateness(time.Minute), publish.WithClock(func() time.Time { return now }))
+
+	trade := func(at time.Duration) bool {
+		trade := stocks.Trade{
+			Base:  stocks.Base{Ticker: "X:BTCUSD", Timestamp: start.Add(at).UnixMilli()},
+			Price: 1,
+			Size_: 1,
+		}
+
+		ok, err := queue.Observe(trade.Ticker, logic.TradeTimestamp(&trade), db.BarLengthMinute)
+		require.NoError(t, err)
+
+		agg, updated, err := logic.ProcessTrade[db.Tx](ctx, store, testLogic, &trade, db.BarLengthMinute)
+		require.NoError(t, err)
+		if updated && ok {
+			queue.Enqueue(agg, db.BarLengthMinute)
+		}
+
+		return ok
+	}
+
+	sweep := func() []publish.Bar {
+		var bars []publish.Bar
+		queue.Sweep(func(bar publish.Bar) {
+			bars = append(bars, bar)
+		})
+		sort.Slice(bars, func(i, j int) bool { return bars[i].Timestamp < bars[j].Timestamp })
+
+		return bars
+	}
+
+	// the watermark lags the wall clock by at most a minute, so the bar isn't complete yet
+	require.True(t, trade(10*time.Second))
+	assert.Equal(t, ptime.IMillisecondsFromTime(start.Add(30*time.Second)), queue.Watermark())
+	assert.Empty(t, sweep())
+
+	// a trade from the next bar completes it
+	require.True(t, trade(65*time.Second))
+	bars := sweep()
+	require.Len(t, bars, 1)
+	assert.Equal(t, 0, bars[0].Revision)
+	assert.False(t, bars[0].Final)
+	assert.Equal(t, 1.0, bars[0].Volume)
+
+	// a late trade republishes it
+	require.True(t, trade(20*time.Second))
+	bars = sweep()
+	require.Len(t, bars, 1)
+	assert.Equal(t, 1, bars[0].Revision)
+	assert.False(t, bars[0].Final)
+	assert.Equal(t, 2.0, bars[0].Volume)
+	assert.Empty(t, sweep())
+
+	// until the allowed lateness has passed, which makes it final
+	now = start.Add(3 * time.Minute)
+	require.True(t, trade(125*time.Second))
+	bars = sweep()
+	require.Len(t, bars, 2)
+	assert.Equal(t, ptime.IMillisecondsFromTime(start), bars[0].StartTimestamp)
+	assert.Equal(t, 1, bars[0].Revision)
+	assert.True(t, bars[0].Final)
+	assert.Equal(t, 2.0, bars[0].Volume)
+	assert.Equal(t, 0, bars[1].Revision)
+	assert.False(t, bars[1].Final)
+
+	// after which trades are still applied, but don't republish it
+	assert.False(t, trade(30*time.Second))
+	assert.Equal(t, int64(1), queue.Late())
+	assert.Empty(t, sweep())
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	agg, err := store.Get(tx, "X:BTCUSD", ptime.INanosecondsFromTime(start), db.BarLengthMinute)
+	require.NoError(t, err)
+	require.NoError(t, store.Commit(tx))
+	assert.Equal(t, 3.0, agg.Volume)
+
+	// and a trade from the future doesn't move the watermark past the wall clock, then or later,
+	// so that it doesn't make other bars final early
+	require.True(t, trade(time.Hour))
+	assert.Equal(t, ptime.IMillisecondsFromTime(now), queue.Watermark())
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, ptime.IMillisecondsFromTime(start.Add(3*time.Minute)), queue.Watermark())
+
+	// a final bar that's recomputed, e.g. after a trade is canceled, is republished as a correction
+	queue.Enqueue(agg, db.BarLengthMinute)
+	bars = sweep()
+	require.Len(t, bars, 3)
+	assert.Equal(t, ptime.IMillisecondsFromTime(start), bars[0].StartTimestamp)
+	assert.True(t, bars[0].Correction)
+	assert.True(t, bars[0].Final)
+	assert.False(t, bars[1].Correction)
+}
+
+func TestTradeCorrections(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewNativeDB(false)
+	var tradeStore db.TradeStore[*stocks.Trade] = db.NewNativeTradeStore[*stocks.Trade]()
+
+	trade := func(id string, ts time.Duration, price float64) *stocks.Trade {
+		return &stocks.Trade{
+			Base:     stocks.Base{Ticker: "PGON", Timestamp: ts.Milliseconds()},
+			ID:       id,
+			Exchange: 4,
+			Price:    price,
+			Size_:    100,
+		}
+	}
+	tradeID := func(id string) db.TradeID {
+		return db.TradeID{Exchange: 4, ID: id}
+	}
+
+	for _, trade := range []*stocks.Trade{trade("1", 0, 10), trade("2", 10*time.Second, 12), trade("3", 20*time.Second, 11)} {
+		_, _, err := logic.ProcessStoredTrade[db.Tx](ctx, store, tradeStore, logic.StocksLogic, trade, tradeID(trade.ID), db.BarLengthMinute)
+		require.NoError(t, err)
+	}
+
+	// canceling the high recomputes it from the remaining trades
+	aggs, err := logic.CancelTrade[db.Tx](ctx, store, tradeStore, logic.StocksLogic, "PGON", tradeID("2"), db.BarLengthMinute)
+	require.NoError(t, err)
+	require.Len(t, aggs, 1)
+	assert.Equal(t, 11.0, aggs[0].High)
+	assert.Equal(t, 10.0, aggs[0].Low)
+	assert.Equal(t, 200.0, aggs[0].Volume)
+	assert.Equal(t, 10.5, aggs[0].VWAP)
+	assert.Equal(t, int32(2), aggs[0].Transactions)
+
+	// a correction that moves a trade to the next bar recomputes both
+	aggs, err = logic.CorrectTrade[db.Tx](ctx, store, tradeStore, logic.StocksLogic, tradeID("3"), trade("3", 70*time.Second, 9), db.BarLengthMinute)
+	require.NoError(t, err)
+	require.Len(t, aggs, 2)
+	assert.Equal(t, 10.0, aggs[0].Close)
+	assert.Equal(t, 100.0, aggs[0].Volume)
+	assert.Equal(t, ptime.IMilliseconds(60_000), aggs[1].StartTimestamp)
+	assert.Equal(t, 9.0, aggs[1].Open)
+
+	// the bar is stored as recomputed, with its state
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	agg, err := store.Get(tx, "PGON", 0, db.BarLengthMinute)
+	require.NoError(t, err)
+	assert.Equal(t, aggs[0], agg)
+	raw, err := store.GetState(tx, "PGON", 0, db.BarLengthMinute)
+	require.NoError(t, err)
+	var state logic.BarState
+	require.NoError(t, state.UnmarshalBinary(raw))
+	assert.Equal(t, 1000.0, state.PriceVolume)
+	require.NoError(t, store.Commit(tx))
+
+	// canceling the last trade of a bar deletes it
+	aggs, err = logic.CancelTrade[db.Tx](ctx, store, tradeStore, logic.StocksLogic, "PGON", tradeID("1"), db.BarLengthMinute)
+	require.NoError(t, err)
+	require.Len(t, aggs, 1)
+	assert.Zero(t, aggs[0].Volume)
+	tx, err = store.NewTx(ctx)
+	require.NoError(t, err)
+	raw, err = store.GetState(tx, "PGON", 0, db.BarLengthMinute)
+	require.NoError(t, err)
+	assert.Nil(t, raw)
+	require.NoError(t, store.Commit(tx))
+
+	_, err = logic.CancelTrade[db.Tx](ctx, store, tradeStore, logic.StocksLogic, "PGON", tradeID("1"), db.BarLengthMinute)
+	assert.ErrorIs(t, err, logic.ErrTradeNotFound)
+
+	expired, err := tradeStore.Expire(ptime.IMilliseconds(80_000).ToINanoseconds())
+	require.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	_, _, ok, err := tradeStore.Get("PGON", tradeID("3"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// trade IDs are only unique per exchange and trade reporting facility
+	for _, id := range []db.TradeID{{Exchange: 4, ID: "1"}, {Exchange: 4, TRF: 202, ID: "1"}, {Exchange: 12, ID: "1"}} {
+		require.NoError(t, tradeStore.Put("PGON", id, 0, trade(id.ID, 0, 10)))
+	}
+	var count int
+	require.NoError(t, tradeStore.Range("PGON", 0, 1, func(*stocks.Trade) bool {
+		count++
+		return true
+	}))
+	assert.Equal(t, 3, count)
+	assert.ErrorIs(t, tradeStore.Put("PGON", db.TradeID{Exchange: 4}, 0, trade("", 0, 10)), db.ErrEmptyTradeID)
+}
+
+func TestTradeCorrectionConflicts(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewRedis(newTestRedisClient(t))
+	var tradeStore db.TradeStore[*stocks.Trade] = db.NewNativeTradeStore[*stocks.Trade]()
+
+	trade := func(id string, ts time.Duration, price float64) *stocks.Trade {
+		return &stocks.Trade{
+			Base:     stocks.Base{Ticker: "PGON", Timestamp: ts.Milliseconds()},
+			ID:       id,
+			Exchange: 4,
+			Price:    price,
+			Size_:    100,
+		}
+	}
+	tradeID := func(id string) db.TradeID {
+		return db.TradeID{Exchange: 4, ID: id}
+	}
+
+	for _, trade := range []*stocks.Trade{trade("1", 0, 10), trade("2", 10*time.Second, 12)} {
+		_, _, err := logic.ProcessStoredTrade[db.RedisTx](ctx, store, tradeStore, logic.StocksLogic, trade, tradeID(trade.ID), db.BarLengthMinute)
+		require.NoError(t, err)
+	}
+
+	// after the cancel reads the bar, another trade commits to it, so the cancel's commit conflicts
+	interrupting := &interruptedDB{DB: store, interrupt: func() {
+		_, _, err := logic.ProcessStoredTrade[db.RedisTx](ctx, store, tradeStore, logic.StocksLogic, trade("3", 20*time.Second, 11), tradeID("3"), db.BarLengthMinute)
+		require.NoError(t, err)
+	}}
+
+	aggs, err := logic.CancelTrade[db.RedisTx](ctx, interrupting, tradeStore, logic.StocksLogic, "PGON", tradeID("2"), db.BarLengthMinute)
+	require.NoError(t, err)
+	require.Nil(t, interrupting.interrupt)
+	require.Len(t, aggs, 1)
+	assert.Equal(t, 11.0, aggs[0].High)
+	assert.Equal(t, 200.0, aggs[0].Volume)
+
+	_, _, ok, err := tradeStore.Get("PGON", tradeID("2"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	agg, err := store.Get(tx, "PGON", 0, db.BarLengthMinute)
+	require.NoError(t, err)
+	require.NoError(t, store.Commit(tx))
+	assert.Equal(t, aggs[0], agg)
+}
+
+// interruptedDB calls interrupt once, after the first read of a bar.
+type interruptedDB struct {
+	db.DB[db.RedisTx]
+	interrupt func()
+}
+
+func (i *interruptedDB) Get(tx *db.RedisTx, ticker string, timestamp ptime.INanoseconds, barLength db.BarLength) (globals.Aggregate, error) {
+	agg, err := i.DB.Get(tx, ticker, timestamp, barLength)
+	if i.interrupt != nil {
+		interrupt := i.interrupt
+		i.interrupt = nil
+		interrupt()
+	}
+
+	return agg, err
+}
+
+func TestSQLRetention(t *testing.T) {
+	ctx := context.Background()
+
+	sqlDB, err := sql.Open("sqlite", "file:retention?mode=memory&cache=shared")
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	store, err := db.NewSQL(sqlDB)
+	require.NoError(t, err)
+
+	second := func(ts int64, price, volume float64) globals.Aggregate {
+		return globals.Aggregate{
+			Ticker:         "PGON",
+			Timestamp:      ptime.IMilliseconds(ts),
+			StartTimestamp: ptime.IMilliseconds(ts),
+			EndTimestamp:   ptime.IMilliseconds(ts + 1000),
+			Open:           price,
+			High:           price,
+			Low:            price,
+			Close:          price,
+			Volume:         volume,
+			VWAP:           price,
+			Transactions:   1,
+		}
+	}
+
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	for _, agg := range []globals.Aggregate{
+		second(0, 1, 1),
+		second(1000, 3, 3),
+		second(61_000, 5, 1),
+		// not expired yet
+		second(120_000, 7, 1),
+		// already aggregated from trades
+		{Ticker: "PGON", Timestamp: 60_000, StartTimestamp: 60_000, EndTimestamp: 120_000, Open: 4, High: 4, Low: 4, Close: 4, Volume: 1, VWAP: 4, Transactions: 1},
+	} {
+		require.NoError(t, store.Upsert(tx, agg))
+	}
+	require.NoError(t, store.Commit(tx))
+
+	policies := []db.RetentionPolicy{{BarLength: db.BarLengthSecond, Keep: time.Second, DownsampleTo: db.BarLengthMinute}}
+	stats, err := store.ApplyRetention(ctx, time.UnixMilli(150_000), policies)
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	assert.Equal(t, int64(1), stats[0].Downsampled)
+	assert.Equal(t, int64(3), stats[0].Deleted)
+
+	tx, err = store.NewTx(ctx)
+	require.NoError(t, err)
+	defer store.Commit(tx)
+
+	agg, err := store.Get(tx, "PGON", 0, db.BarLengthMinute)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, agg.Open)
+	assert.Equal(t, 3.0, agg.High)
+	assert.Equal(t, 1.0, agg.Low)
+	assert.Equal(t, 3.0, agg.Close)
+	assert.Equal(t, 4.0, agg.Volume)
+	assert.Equal(t, 2.5, agg.VWAP)
+
+	agg, err = store.Get(tx, "PGON", ptime.INanoseconds(time.Minute), db.BarLengthMinute)
+	require.NoError(t, err)
+	assert.Equal(t, 4.0, agg.Open)
+
+	var remaining []string
+	require.NoError(t, store.Range(ctx, func(agg globals.Aggregate) bool {
+		remaining = append(remaining, fmt.Sprintf("%d-%d", agg.Timestamp, agg.EndTimestamp))
+		return true
+	}))
+	assert.Equal(t, []string{"0-60000", "60000-120000", "120000-121000"}, remaining)
+}
+
+func TestDefaultRetentionPolicies(t *testing.T) {
+	ctx := context.Background()
+
+	sqlDB, err := sql.Open("sqlite", "file:default-retention?mode=memory&cache=shared")
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	store, err := db.NewSQL(sqlDB)
+	require.NoError(t, err)
+
+	// expired minute bars are rolled up into hour bars, but not into day bars
+	for _, ts := range []int64{0, 60_000} {
+		_, _, err := logic.ProcessTrade[sql.Tx](ctx, store, testLogic, &stocks.Trade{
+			Base:  stocks.Base{Ticker: "X:BTCUSD", Timestamp: ts},
+			Price: 1,
+			Size_: 1,
+		}, db.BarLengthMinute)
+		require.NoError(t, err)
+	}
+
+	_, err = store.ApplyRetention(ctx, time.UnixMilli(0).Add(400*24*time.Hour), db.DefaultRetentionPolicies)
+	require.NoError(t, err)
+
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	defer store.Commit(tx)
+
+	minute, err := store.Get(tx, "X:BTCUSD", 0, db.BarLengthMinute)
+	require.NoError(t, err)
+	assert.Zero(t, minute.Volume)
+
+	hour, err := store.Get(tx, "X:BTCUSD", 0, db.BarLengthHour)
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, hour.Volume)
+
+	day, err := store.Get(tx, "X:BTCUSD", 0, db.BarLengthDay)
+	require.NoError(t, err)
+	assert.Zero(t, day.Volume)
+}
+
+func TestSQLRetentionMarketTimezones(t *testing.T) {
+	ctx := context.Background()
+
+	sqlDB, err := sql.Open("sqlite", "file:retention_timezones?mode=memory&cache=shared")
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	store, err := db.NewSQL(sqlDB)
+	require.NoError(t, err)
+
+	minute := func(ticker string, at time.Time, price float64) globals.Aggregate {
+		ts := ptime.IMillisecondsFromTime(at)
+		return globals.Aggregate{
+			Ticker:         ticker,
+			Timestamp:      ts,
+			StartTimestamp: ts,
+			EndTimestamp:   ts + ptime.IMillisecondsFromDuration(time.Minute),
+			Open:           price,
+			High:           price,
+			Low:            price,
+			Close:          price,
+			Volume:         1,
+			VWAP:           price,
+			Transactions:   1,
+		}
+	}
+
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	for _, agg := range []globals.Aggregate{
+		// the evening of March 13th in New York
+		minute("PGON", time.Date(2022, 3, 14, 2, 0, 0, 0, time.UTC), 1),
+		// March 14th in New York, which hasn't ended at the cutoff
+		minute("PGON", time.Date(2022, 3, 14, 15, 0, 0, 0, time.UTC), 2),
+		minute("X:BTCUSD", time.Date(2022, 3, 14, 2, 0, 0, 0, time.UTC), 3),
+		minute("X:BTCUSD", time.Date(2022, 3, 14, 15, 0, 0, 0, time.UTC), 4),
+	} {
+		require.NoError(t, store.Upsert(tx, agg))
+	}
+	require.NoError(t, store.Commit(tx))
+
+	policies := []db.RetentionPolicy{{BarLength: db.BarLengthMinute, Keep: time.Second, DownsampleTo: db.BarLengthDay}}
+	stats, err := store.ApplyRetention(ctx, time.Date(2022, 3, 15, 2, 0, 0, 0, time.UTC), policies)
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	assert.Equal(t, int64(2), stats[0].Downsampled)
+	assert.Equal(t, int64(3), stats[0].Deleted)
+
+	var remaining []string
+	require.NoError(t, store.Range(ctx, func(agg globals.Aggregate) bool {
+		remaining = append(remaining, fmt.Sprintf("%s %s %s %v", agg.Ticker, agg.StartTimestamp.ToTime().UTC().Format(time.RFC3339),
+			time.Duration(agg.EndTimestamp-agg.StartTimestamp)*time.Millisecond, agg.Open))
+		return true
+	}))
+	assert.Equal(t, []string{
+		"PGON 2022-03-13T05:00:00Z 23h0m0s 1",
+		"PGON 2022-03-14T15:00:00Z 1m0s 2",
+		"X:BTCUSD 2022-03-14T00:00:00Z 24h0m0s 3",
+	}, remaining)
+}
+
+// flowBar is a custom aggregate type, splitting volume by whether trades ticked up or down.
+type flowBar struct {
+	Ticker     string
+	Start, End ptime.IMilliseconds
+	UpVolume   float64
+	DownVolume float64
+	Last       float64
+	Trades     int64
+}
+
+func (b flowBar) BarKey() db.BarKey {
+	return db.BarKey{Ticker: b.Ticker, Start: b.Start, End: b.End}
+}
+
+func (flowBar) NewBar(key db.BarKey) flowBar {
+	return flowBar{Ticker: key.Ticker, Start: key.Start, End: key.End}
+}
+
+var flowSchema = db.SchemaOf(
+	db.Field[flowBar]{
+		Name: "up_volume", HashField: "u",
+		Get: func(b flowBar) float64 { return b.UpVolume },
+		Set: func(b *flowBar, v float64) { b.UpVolume = v },
+	},
+	db.Field[flowBar]{
+		Name: "down_volume", HashField: "d",
+		Get: func(b flowBar) float64 { return b.DownVolume },
+		Set: func(b *flowBar, v float64) { b.DownVolume = v },
+	},
+	db.Field[flowBar]{
+		Name: "last",
+		Get:  func(b flowBar) float64 { return b.Last },
+		Set:  func(b *flowBar, v float64) { b.Last = v },
+	},
+	db.Field[flowBar]{
+		Name: "trades", Integer: true,
+		Get: func(b flowBar) float64 { return float64(b.Trades) },
+		Set: func(b *flowBar, v float64) { b.Trades = int64(v) },
+	},
+)
+
+func flowLogic(bar flowBar, _ *logic.BarState, trade *stocks.Trade) flowBar {
+	if trade.Price >= bar.Last {
+		bar.UpVolume += float64(trade.Size_)
+	} else {
+		bar.DownVolume += float64(trade.Size_)
+	}
+
+	bar.Last = trade.Price
+	bar.Trades++
+
+	return bar
+}
+
+func testFlowStore[Tx any](t *testing.T, store db.Store[Tx, flowBar]) {
+	ctx := context.Background()
+
+	for _, trade := range testTrades {
+		_, _, err := logic.ProcessTradeOf(ctx, store, flowLogic, &trade, db.BarLengthMinute)
+		require.NoError(t, err)
+	}
+
+	_, updated, err := logic.ProcessTradeOf(ctx, store, flowLogic, &stocks.Trade{
+		Base:  stocks.Base{Ticker: "PGON", Timestamp: 2},
+		Price: 1.5,
+		Size_: 4,
+	}, db.BarLengthMinute)
+	require.NoError(t, err)
+	assert.True(t, updated)
+
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	bar, err := store.Get(tx, "PGON", 0, db.BarLengthMinute)
+	require.NoError(t, err)
+	require.NoError(t, store.Commit(tx))
+
+	assert.Equal(t, flowBar{Ticker: "PGON", Start: 0, End: 60_000, UpVolume: 3, DownVolume: 4, Last: 1.5, Trades: 3}, bar)
+}
+
+func TestNativeStore(t *testing.T) {
+	testFlowStore[db.Tx](t, db.NewNativeStore(flowSchema, false))
+}
+
+func TestSQLStore(t *testing.T) {
+	ctx := context.Background()
+
+	sqlDB, err := sql.Open("sqlite", "file:flow?mode=memory&cache=shared")
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	store, err := db.NewSQLStore(sqlDB, flowSchema, db.WithTable("flow"))
+	require.NoError(t, err)
+	testFlowStore[sql.Tx](t, store)
+
+	var bars []flowBar
+	require.NoError(t, store.Range(ctx, func(bar flowBar) bool {
+		bars = append(bars, bar)
+		return true
+	}))
+	require.Len(t, bars, 1)
+	assert.Equal(t, int64(3), bars[0].Trades)
+
+	// flowSchema can't merge bars
+	policies := []db.RetentionPolicy{{BarLength: db.BarLengthMinute, Keep: time.Second, DownsampleTo: db.BarLengthDay}}
+	_, err = store.ApplyRetention(ctx, time.UnixMilli(150_000), policies)
+	require.Error(t, err)
+}
+
+func TestRedisStore(t *testing.T) {
+	client := newTestRedisClient(t)
+
+	testFlowStore[db.RedisTx](t, db.NewRedisStore(client, flowSchema, db.WithNamespace("flow")))
+	testFlowStore[db.RedisTx](t, db.NewRedisStore(client, flowSchema, db.WithNamespace("flowhash"), db.WithHashLayout()))
+
+	// values of custom schemas carry a codec header too, which no aggregate codec claims
+	raw, err := client.Get(context.Background(), "flow:{PGON}/0/min").Bytes()
+	require.NoError(t, err)
+	var agg globals.Aggregate
+	require.ErrorIs(t, db.DecodeAggregate(raw, &agg), db.ErrUnknownCodec)
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+
+	source := db.NewNativeDB(false)
+	for i, ticker := range []string{"AAPL", "MSFT", "PGON"} {
+		for minute := 0; minute < 3; minute++ {
+			_, _, err := logic.ProcessTrade[db.Tx](ctx, source, testLogic, &stocks.Trade{
+				Base:  stocks.Base{Ticker: ticker, Timestamp: int64(minute * 60_000)},
+				Price: float64(i + 1),
+				Size_: uint32(minute + 1),
+			}, db.BarLengthMinute)
+			require.NoError(t, err)
+		}
+	}
+
+	src := db.SortedSource(func(ctx context.Context, fn func(globals.Aggregate) bool) error {
+		source.Range(fn)
+		return nil
+	})
+
+	dst := db.NewNativeDB(false)
+	opts := db.CopyOptions{
+		Filter:     db.Filter{Tickers: []string{"AAPL", "PGON"}, To: 120_000},
+		BatchSize:  1,
+		Checkpoint: filepath.Join(t.TempDir(), "checkpoint"),
+		Verify:     true,
+	}
+
+	// fail partway through, after AAPL has been copied
+	errInterrupted := errors.New("interrupted")
+	var n int
+	_, err := db.Copy[db.Tx](ctx, func(ctx context.Context, fn func(globals.Aggregate) bool) error {
+		src(ctx, func(agg globals.Aggregate) bool {
+			if n++; n > 4 {
+				return false
+			}
+			return fn(agg)
+		})
+		return errInterrupted
+	}, dst, opts)
+	require.ErrorIs(t, err, errInterrupted)
+	require.FileExists(t, opts.Checkpoint)
+
+	stats, err := db.Copy[db.Tx](ctx, src, dst, opts)
+	require.NoError(t, err)
+	assert.Equal(t, db.CopyStats{Read: 9, Skipped: 5, Copied: 4}, stats)
+	assert.NoFileExists(t, opts.Checkpoint)
+
+	var copied []string
+	dst.Range(func(agg globals.Aggregate) bool {
+		copied = append(copied, fmt.Sprintf("%s/%d", agg.Ticker, agg.Timestamp))
+		return true
+	})
+	assert.ElementsMatch(t, []string{"AAPL/0", "AAPL/60000", "PGON/0", "PGON/60000"}, copied)
+
+	_, err = db.Copy[db.Tx](ctx, func(ctx context.Context, fn func(globals.Aggregate) bool) error {
+		source.Range(fn)
+		source.Range(fn)
+		return nil
+	}, dst, opts)
+	require.ErrorIs(t, err, db.ErrUnorderedSource)
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+
+	bar := func(ticker string, ts int64, volume float64) globals.Aggregate {
+		return globals.Aggregate{
+			Ticker:         ticker,
+			Timestamp:      ptime.IMilliseconds(ts),
+			StartTimestamp: ptime.IMilliseconds(ts),
+			EndTimestamp:   ptime.IMilliseconds(ts + 60_000),
+			Open:           1,
+			Volume:         volume,
+		}
+	}
+
+	source := func(aggs ...globals.Aggregate) db.Source {
+		return func(ctx context.Context, fn func(globals.Aggregate) bool) error {
+			for _, agg := range aggs {
+				if !fn(agg) {
+					return nil
+				}
+			}
+			return nil
+		}
+	}
+
+	expected := source(bar("AAPL", 0, 1), bar("AAPL", 60_000, 2), bar("PGON", 0, 3), bar("MSFT", 0, 4))
+	actual := source(bar("PGON", 0, 3+1e-12), bar("AAPL", 60_000, 2.5), bar("AAPL", 120_000, 1), bar("MSFT", 0, 5))
+
+	report, err := db.Check(ctx, expected, actual, db.CheckOptions{Filter: db.Filter{Tickers: []string{"AAPL", "PGON"}}})
+	require.NoError(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, int64(2), report.Compared)
+	assert.Equal(t, int64(1), report.Matched)
+
+	require.Len(t, report.Missing, 1)
+	assert.Equal(t, ptime.IMilliseconds(0), report.Missing[0].Timestamp)
+	require.Len(t, report.Extra, 1)
+	assert.Equal(t, ptime.IMilliseconds(120_000), report.Extra[0].Timestamp)
+	require.Len(t, report.Divergent, 1)
+	assert.Equal(t, []string{"volume"}, report.Divergent[0].Fields)
+}
+
+func TestInstrumentedDB(t *testing.T) {
+	metrics := db.NewMetrics()
+	store := db.Instrument[db.Tx](db.NewNativeDB(false), "native", metrics)
+	testDB[db.Tx](t, store)
+
+	// testDB leaves a transaction holding the lock on PGON
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	tx, err := store.NewTx(ctx)
+	require.NoError(t, err)
+	_, err = store.Get(tx, "PGON", 0, db.BarLengthMinute)
+	require.ErrorIs(t, err, db.ErrLockTimeout)
+	require.NoError(t, store.Commit(tx))
+
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	for _, line := range []string{
+		`aggregates_db_operation_duration_seconds_count{backend="native",operation="get",bar_length="min"} 4`,
+		`aggregates_db_operation_duration_seconds_bucket{backend="native",operation="upsert",bar_length="min",le="+Inf"} 2`,
+		`aggregates_db_errors_total{backend="native",operation="get",bar_length="min",type="lock_timeout"} 1`,
+		`aggregates_db_transactions_total{backend="native",outcome="committed"} 3`,
+		`aggregates_db_transactions_in_flight{backend="native"} 1`,
+	} {
+		assert.Contains(t, string(body), line+"\n")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracing.NewMemoryExporter()
+	ctx := tracing.ContextWithTracer(context.Background(), tracing.NewTracer(exporter))
+
+	store := db.Trace[db.Tx](db.NewNativeDB(false), "native")
+	_, _, err := logic.ProcessTrade[db.Tx](ctx, store, testLogic, &testTrades[0], db.BarLengthMinute)
+	require.NoError(t, err)
+
+	spans := make(map[string]tracing.SpanData)
+	for _, span := range exporter.Spans() {
+		spans[span.Name] = span
+	}
+
+	root := spans["logic.ProcessTrade"]
+	assert.Equal(t, uint64(0), root.ParentID)
+	assert.Equal(t, "PGON", root.Attributes["ticker"])
+	assert.Equal(t, "min", root.Attributes["bar_length"])
+
+	// the transaction is a child of the trade, and the operations and lock are children of the transaction
+	tx := spans["db.Tx"]
+	assert.Equal(t, root.SpanID, tx.ParentID)
+	assert.Equal(t, root.SpanID, spans["logic.Update"].ParentID)
+	for _, name := range []string{"db.NewTx", "db.Lock", "db.Get", "db.GetState", "db.Upsert", "db.UpsertState", "db.Commit"} {
+		require.Contains(t, spans, name)
+		assert.Equal(t, root.TraceID, spans[name].TraceID, name)
+		assert.Equal(t, tx.SpanID, spans[name].ParentID, name)
+	}
+	assert.Equal(t, "native", spans["db.Get"].Attributes["backend"])
+	assert.Len(t, exporter.Spans(), 10)
+
+	// without a tracer, nothing is recorded
+	exporter.Reset()
+	_, _, err = logic.ProcessTrade[db.Tx](context.Background(), store, testLogic, &testTrades[1], db.BarLengthMinute)
+	require.NoError(t, err)
+	assert.Empty(t, exporter.Spans())
+}
@@ -0,0 +1,60 @@
+// Package config loads the versioned JSON and YAML files that describe data rather than code,
+// such as market calendars and trade condition rules.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Decoder decodes the contents of a file into v.
+type Decoder func(data []byte, v interface{}) error
+
+var (
+	JSON Decoder = json.Unmarshal
+	YAML Decoder = yaml.Unmarshal
+)
+
+// Parse decodes a T with decode and validates it. Decoding errors are wrapped in invalid,
+// while validate returns its own errors.
+func Parse[T any](data []byte, decode Decoder, invalid error, validate func(*T) error) (*T, error) {
+	var v T
+	if err := decode(data, &v); err != nil {
+		return nil, fmt.Errorf("%w: %v", invalid, err)
+	}
+
+	if err := validate(&v); err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+// Load reads a T from a JSON or YAML file, depending on its extension, like Parse.
+func Load[T any](path string, invalid error, validate func(*T) error) (*T, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var decode Decoder
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+		decode = JSON
+	case ".yaml", ".yml":
+		decode = YAML
+	default:
+		return nil, fmt.Errorf("%s: %w: unknown extension %q", path, invalid, ext)
+	}
+
+	v, err := Parse(data, decode, invalid, validate)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return v, nil
+}
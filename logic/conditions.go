@@ -0,0 +1,108 @@
+package logic
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+
+	"github.com/suremarc/go-lib-aggregates/internal/config"
+)
+
+// Permissions are the parts of a bar that a trade may update.
+type Permissions struct {
+	HighLow   bool `json:"highLow" yaml:"highLow"`
+	OpenClose bool `json:"openClose" yaml:"openClose"`
+	Volume    bool `json:"volume" yaml:"volume"`
+}
+
+// allPermissions are the permissions of a trade without conditions.
+var allPermissions = Permissions{HighLow: true, OpenClose: true, Volume: true}
+
+// ConditionTable maps trade condition codes to the parts of a bar that a trade carrying them may update.
+// Codes missing from the table update everything.
+type ConditionTable map[int32]Permissions
+
+// Permissions returns what a trade with the given conditions may update: only what all of them allow.
+func (t ConditionTable) Permissions(conditions []int32) Permissions {
+	p := allPermissions
+	for _, c := range conditions {
+		if rule, ok := t[c]; ok {
+			p.HighLow = p.HighLow && rule.HighLow
+			p.OpenClose = p.OpenClose && rule.OpenClose
+			p.Volume = p.Volume && rule.Volume
+		}
+	}
+
+	return p
+}
+
+// ConditionTables are the tables for intraday bars and for daily bars.
+type ConditionTables struct {
+	Intraday ConditionTable `json:"intraday" yaml:"intraday"`
+	Daily    ConditionTable `json:"daily" yaml:"daily"`
+}
+
+// ConditionRules are the eligibility rules of trades, as published in the UTP and CTA condition matrices.
+// Consolidated rules apply to bars of every trade in a ticker, and market center rules to bars of the trades
+// of a single exchange, such as the primary listing exchange.
+//
+// Rules are loaded from a config file, so that changes to the matrices don't require a release;
+// see conditions.yaml for the format, and for the rules in DefaultConditionRules.
+type ConditionRules struct {
+	// Version is the version of the config format, which must be ConditionRulesVersion.
+	Version int `json:"version" yaml:"version"`
+	// Revision identifies the rules themselves, e.g. the date of the matrices they were taken from.
+	Revision string `json:"revision" yaml:"revision"`
+
+	Consolidated ConditionTables `json:"consolidated" yaml:"consolidated"`
+	MarketCenter ConditionTables `json:"marketCenter" yaml:"marketCenter"`
+
+	// OfficialOpen and OfficialClose are the conditions of the primary listing exchange's prints
+	// that set the official open and close of a daily bar (see NewStocksDailyLogic).
+	OfficialOpen  []int32 `json:"officialOpen" yaml:"officialOpen"`
+	OfficialClose []int32 `json:"officialClose" yaml:"officialClose"`
+}
+
+// ConditionRulesVersion is the only version of the config format supported.
+const ConditionRulesVersion = 1
+
+// ErrInvalidConditionRules is returned when condition rules can't be parsed.
+var ErrInvalidConditionRules = errors.New("invalid condition rules")
+
+//go:embed conditions.yaml
+var defaultConditionRules []byte
+
+// DefaultConditionRules are the rules that StocksLogic follows.
+var DefaultConditionRules = mustParseConditionRules(defaultConditionRules)
+
+// ParseConditionRules parses condition rules in YAML.
+func ParseConditionRules(data []byte) (*ConditionRules, error) {
+	return config.Parse(data, config.YAML, ErrInvalidConditionRules, (*ConditionRules).validate)
+}
+
+// ParseConditionRulesJSON parses condition rules in JSON, in which condition codes are keys given as strings.
+func ParseConditionRulesJSON(data []byte) (*ConditionRules, error) {
+	return config.Parse(data, config.JSON, ErrInvalidConditionRules, (*ConditionRules).validate)
+}
+
+// LoadConditionRules reads condition rules from a JSON or YAML file, depending on its extension.
+func LoadConditionRules(path string) (*ConditionRules, error) {
+	return config.Load(path, ErrInvalidConditionRules, (*ConditionRules).validate)
+}
+
+func (r *ConditionRules) validate() error {
+	if r.Version != ConditionRulesVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidConditionRules, r.Version)
+	}
+
+	return nil
+}
+
+func mustParseConditionRules(data []byte) *ConditionRules {
+	rules, err := ParseConditionRules(data)
+	if err != nil {
+		panic(err)
+	}
+
+	return rules
+}
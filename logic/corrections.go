@@ -0,0 +1,175 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/ptime"
+	"github.com/suremarc/go-lib-aggregates/db"
+)
+
+// ErrTradeNotFound is returned when a canceled or corrected trade isn't in the TradeStore,
+// e.g. because it expired, or was never applied.
+var ErrTradeNotFound = errors.New("trade not found")
+
+// CancelTrade removes the trade of a ticker with the given ID from a TradeStore, and recomputes the bar of the given
+// length that contained it from the trades left, since logic can't un-apply a trade from its high, low or VWAP.
+// A bar left without trades is deleted. It returns the recomputed bars, to be published in place of the old ones,
+// which here is the one bar; a deleted bar is returned empty.
+func CancelTrade[Txn any, Trade Aggregable](ctx context.Context, store db.DB[Txn], trades db.TradeStore[Trade], logic UpdateLogic[Trade], ticker string, id db.TradeID, barLength db.BarLength) ([]globals.Aggregate, error) {
+	return correctTrade(ctx, store, trades, logic, ticker, id, nil, barLength)
+}
+
+// CorrectTrade replaces the trade with the given ID, of the correction's ticker, by the correction, and recomputes
+// the bars of the given length that contained either, like CancelTrade. It returns the recomputed bars: one,
+// or two if the correction moved the trade to another bar.
+func CorrectTrade[Txn any, Trade Aggregable](ctx context.Context, store db.DB[Txn], trades db.TradeStore[Trade], logic UpdateLogic[Trade], id db.TradeID, correction Trade, barLength db.BarLength) ([]globals.Aggregate, error) {
+	return correctTrade(ctx, store, trades, logic, correction.GetTicker(), id, &correction, barLength)
+}
+
+func correctTrade[Txn any, Trade Aggregable](ctx context.Context, store db.DB[Txn], trades db.TradeStore[Trade], logic UpdateLogic[Trade], ticker string, id db.TradeID, correction *Trade, barLength db.BarLength) ([]globals.Aggregate, error) {
+	// like ProcessTrade, the correction is applied again if another transaction updated one of its bars in the meantime
+	for {
+		aggregates, err := applyCorrection(ctx, store, trades, logic, ticker, id, correction, barLength)
+		if !errors.Is(err, db.ErrConflict) || ctx.Err() != nil {
+			return aggregates, err
+		}
+	}
+}
+
+func applyCorrection[Txn any, Trade Aggregable](ctx context.Context, store db.DB[Txn], trades db.TradeStore[Trade], logic UpdateLogic[Trade], ticker string, id db.TradeID, correction *Trade, barLength db.BarLength) (aggregates []globals.Aggregate, err error) {
+	tx, err := store.NewTx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("new tx: %w", err)
+	}
+
+	var restore func() error
+	defer func() {
+		if commitErr := store.Commit(tx); commitErr != nil && err == nil {
+			aggregates, err = nil, fmt.Errorf("commit: %w", commitErr)
+		}
+
+		// the TradeStore isn't part of the transaction, so the trade is put back if the bars weren't updated,
+		// for the correction to be retried
+		if err != nil && restore != nil {
+			if restoreErr := restore(); restoreErr != nil {
+				err = fmt.Errorf("%w (restore trade: %v)", err, restoreErr)
+			}
+		}
+	}()
+
+	old, ts, ok, err := trades.Get(ticker, id)
+	if err != nil {
+		return nil, fmt.Errorf("get trade: %w", err)
+	} else if !ok {
+		return nil, fmt.Errorf("%w: %s %+v", ErrTradeNotFound, ticker, id)
+	}
+
+	// the bar is read first so that the transaction holds the ticker while its trades change
+	aggregate, err := store.Get(tx, ticker, ts, barLength)
+	if err != nil {
+		return nil, fmt.Errorf("get: %w", err)
+	}
+
+	affected := []ptime.INanoseconds{ts}
+	if correction != nil {
+		correctedTs := parseTimestampFromInt64((*correction).GetTimestamp())
+		if err := trades.Put(ticker, id, correctedTs, *correction); err != nil {
+			return nil, fmt.Errorf("store correction: %w", err)
+		}
+
+		if ms := ptime.IMillisecondsFromTime(correctedTs.ToTime()); ms < aggregate.StartTimestamp || ms >= aggregate.EndTimestamp {
+			affected = append(affected, correctedTs)
+		}
+	} else if err := trades.Delete(ticker, id); err != nil {
+		return nil, fmt.Errorf("delete trade: %w", err)
+	}
+
+	restore = func() error {
+		return trades.Put(ticker, id, ts, old)
+	}
+
+	// every bar is recomputed before any is written, so that a failure doesn't commit half of a correction
+	bars := make([]recomputedBar, 0, len(affected))
+	for _, ts := range affected {
+		bar, err := recomputeBar(tx, store, trades, logic, ticker, ts, barLength)
+		if err != nil {
+			return nil, err
+		}
+
+		bars = append(bars, bar)
+	}
+
+	aggregates = make([]globals.Aggregate, 0, len(bars))
+	for _, bar := range bars {
+		if err := writeBar(tx, store, ticker, bar, barLength); err != nil {
+			return nil, err
+		}
+
+		aggregates = append(aggregates, bar.aggregate)
+	}
+
+	return aggregates, nil
+}
+
+// recomputedBar is a bar rebuilt from its trades, to be written in place of the stored one.
+type recomputedBar struct {
+	// ts is a timestamp within the bar
+	ts        ptime.INanoseconds
+	aggregate globals.Aggregate
+	state     BarState
+	// empty is set if the bar has no trades left, and is to be deleted
+	empty bool
+}
+
+// recomputeBar rebuilds the bar that contains ts from scratch, from the trades in the TradeStore.
+func recomputeBar[Txn any, Trade Aggregable](tx *Txn, store db.DB[Txn], trades db.TradeStore[Trade], logic UpdateLogic[Trade], ticker string, ts ptime.INanoseconds, barLength db.BarLength) (recomputedBar, error) {
+	old, err := store.Get(tx, ticker, ts, barLength)
+	if err != nil {
+		return recomputedBar{}, fmt.Errorf("get: %w", err)
+	}
+
+	bar := recomputedBar{
+		ts: ts,
+		aggregate: globals.Aggregate{
+			Ticker:         old.Ticker,
+			Timestamp:      old.Timestamp,
+			StartTimestamp: old.StartTimestamp,
+			EndTimestamp:   old.EndTimestamp,
+		},
+		empty: true,
+	}
+
+	if err := trades.Range(ticker, bar.aggregate.StartTimestamp.ToINanoseconds(), bar.aggregate.EndTimestamp.ToINanoseconds(), func(trade Trade) bool {
+		bar.aggregate = logic(bar.aggregate, &bar.state, trade)
+		bar.empty = false
+		return true
+	}); err != nil {
+		return recomputedBar{}, fmt.Errorf("range trades: %w", err)
+	}
+
+	return bar, nil
+}
+
+// writeBar replaces the stored bar with a recomputed one, or deletes it if it's empty.
+func writeBar[Txn any](tx *Txn, store db.DB[Txn], ticker string, bar recomputedBar, barLength db.BarLength) error {
+	if bar.empty {
+		if err := store.Delete(tx, ticker, bar.ts, barLength); err != nil {
+			return fmt.Errorf("delete: %w", err)
+		}
+
+		return nil
+	}
+
+	if err := store.Upsert(tx, bar.aggregate); err != nil {
+		return fmt.Errorf("set: %w", err)
+	}
+
+	if err := store.UpsertState(tx, ticker, bar.ts, barLength, bar.state.appendBinary(nil)); err != nil {
+		return fmt.Errorf("set state: %w", err)
+	}
+
+	return nil
+}
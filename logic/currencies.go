@@ -7,14 +7,9 @@ import (
 
 var _ UpdateLogic[*currencies.Trade] = CurrenciesLogic
 
-func CurrenciesLogic(aggregate globals.Aggregate, trade *currencies.Trade) globals.Aggregate {
-	if aggregate.Open == 0 {
-		aggregate.Open = trade.Price
-	}
-
-	if aggregate.Close == 0 {
-		aggregate.Close = trade.Price
-	}
+func CurrenciesLogic(aggregate globals.Aggregate, state *BarState, trade *currencies.Trade) globals.Aggregate {
+	// currency trades have no sequence numbers, so ties are broken by arrival order
+	state.updateOpenClose(&aggregate, trade.Price, TradePosition{Timestamp: parseTimestampFromInt64(trade.Timestamp)})
 
 	if trade.Price > aggregate.High {
 		aggregate.High = trade.Price
@@ -24,10 +19,7 @@ func CurrenciesLogic(aggregate globals.Aggregate, trade *currencies.Trade) globa
 		aggregate.Low = trade.Price
 	}
 
-	aggregate.VWAP *= aggregate.Volume
-	aggregate.Volume += trade.OrderSize
-	aggregate.VWAP += trade.Price
-	aggregate.VWAP /= aggregate.Volume
+	state.addVolume(&aggregate, trade.Price, trade.OrderSize)
 
 	aggregate.Transactions++
 
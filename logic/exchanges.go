@@ -0,0 +1,53 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/suremarc/go-lib-aggregates/internal/config"
+)
+
+// PrimaryExchangeMap maps tickers to the ID of their primary listing exchange. Its Lookup method is a PrimaryExchanges.
+type PrimaryExchangeMap map[string]int32
+
+// Lookup implements PrimaryExchanges.
+func (m PrimaryExchangeMap) Lookup(ticker string) (int32, bool) {
+	exchange, ok := m[ticker]
+	return exchange, ok
+}
+
+// PrimaryExchangesVersion is the only version of the primary exchanges format supported.
+const PrimaryExchangesVersion = 1
+
+// ErrInvalidPrimaryExchanges is returned when primary exchanges can't be parsed.
+var ErrInvalidPrimaryExchanges = errors.New("invalid primary exchanges")
+
+type primaryExchangesFile struct {
+	// Version is the version of the format, which must be PrimaryExchangesVersion.
+	Version   int                `json:"version" yaml:"version"`
+	Exchanges PrimaryExchangeMap `json:"exchanges" yaml:"exchanges"`
+}
+
+// LoadPrimaryExchanges reads the primary listing exchanges of tickers from a JSON or YAML file, depending on its
+// extension, in which they're given by ticker under exchanges, e.g. in YAML:
+//
+//	version: 1
+//	exchanges:
+//	  AAPL: 12
+//	  IBM: 10
+func LoadPrimaryExchanges(path string) (PrimaryExchangeMap, error) {
+	f, err := config.Load(path, ErrInvalidPrimaryExchanges, (*primaryExchangesFile).validate)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.Exchanges, nil
+}
+
+func (f *primaryExchangesFile) validate() error {
+	if f.Version != PrimaryExchangesVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidPrimaryExchanges, f.Version)
+	}
+
+	return nil
+}
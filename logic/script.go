@@ -0,0 +1,184 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/polygon-io/go-lib-models/v2/currencies"
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/go-lib-models/v2/stocks"
+	"github.com/suremarc/go-lib-aggregates/db"
+)
+
+// ScriptLogic pairs an UpdateLogic with an equivalent Lua implementation that runs inside Redis,
+// so that a trade can be applied in one atomic call instead of a read and a write.
+// CheckScriptLogic verifies that the two implementations agree.
+type ScriptLogic[Trade any] struct {
+	Logic  UpdateLogic[Trade]
+	Script *db.RedisScript
+	// Args converts a trade into the script's arguments.
+	Args func(Trade) []interface{}
+}
+
+// StocksScriptLogic mirrors StocksIntradayLogic. There are no scripts for daily bars.
+var StocksScriptLogic = NewStocksScriptLogic(DefaultConditionRules.Consolidated.Intraday)
+
+// NewStocksScriptLogic pairs NewStocksLogic with its Lua equivalent. The rules are applied before the script runs,
+// which is only passed the resulting permissions.
+func NewStocksScriptLogic(rules ConditionTable) ScriptLogic[*stocks.Trade] {
+	return ScriptLogic[*stocks.Trade]{
+		Logic:  NewStocksLogic(rules),
+		Script: stocksScript,
+		Args: func(trade *stocks.Trade) []interface{} {
+			permissions := rules.Permissions(trade.Conditions)
+
+			return []interface{}{
+				trade.Price,
+				int64(trade.Size_),
+				luaBool(permissions.HighLow),
+				luaBool(permissions.OpenClose),
+				luaBool(permissions.Volume),
+				luaPosition(stocksTradePosition(trade)),
+			}
+		},
+	}
+}
+
+var stocksScript = db.NewRedisScript(stocksLua)
+
+func luaBool(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// luaPosition encodes a position as a string that sorts like the position, since Lua's numbers can't hold
+// nanosecond timestamps exactly: the timestamp and sequence number, each offset by 2^63 so that negative values sort
+// first, as zero-padded unsigned decimals.
+func luaPosition(pos TradePosition) string {
+	return fmt.Sprintf("%020d%020d", uint64(pos.Timestamp)^1<<63, uint64(pos.Sequence)^1<<63)
+}
+
+// luaOpenClose mirrors BarState.updateOpenClose. Scripts can't see the bar's state, so the positions of the trades
+// that set the open and close are kept in fields of their own, op and cp, encoded by luaPosition.
+// An unknown position is the empty string.
+const luaOpenClose = `
+local function update_open_close(price, pos)
+	local positions = redis.call('HMGET', key, 'op', 'cp')
+	if agg.o == 0 or pos < (positions[1] or '') then
+		agg.o = price
+		redis.call('HSET', key, 'op', pos)
+	end
+
+	if agg.c == 0 or pos >= (positions[2] or '') then
+		agg.c = price
+		redis.call('HSET', key, 'cp', pos)
+	end
+end
+`
+
+// stocksLua mirrors StocksLogic. Scripts can't see the bar's state,
+// so the sum of price × size is derived from the VWAP and volume instead.
+const stocksLua = luaOpenClose + `
+local price, size = tonumber(args[1]), tonumber(args[2])
+local high_low, open_close, volume = args[3] == '1', args[4] == '1', args[5] == '1'
+
+if open_close then
+	update_open_close(price, args[6])
+end
+
+if high_low then
+	if price > agg.h then agg.h = price end
+	if price < agg.l or agg.l == 0 then agg.l = price end
+end
+
+if volume then
+	local pv = agg.vw * agg.v + price * size
+	agg.v = agg.v + size
+	if agg.v ~= 0 then agg.vw = pv / agg.v end
+
+	agg.n = agg.n + 1
+end
+`
+
+var CurrenciesScriptLogic = ScriptLogic[*currencies.Trade]{
+	Logic:  CurrenciesLogic,
+	Script: db.NewRedisScript(currenciesLua),
+	Args: func(trade *currencies.Trade) []interface{} {
+		pos := TradePosition{Timestamp: parseTimestampFromInt64(trade.Timestamp)}
+
+		return []interface{}{trade.Price, trade.OrderSize, luaPosition(pos)}
+	},
+}
+
+// currenciesLua mirrors CurrenciesLogic.
+const currenciesLua = luaOpenClose + `
+local price, size = tonumber(args[1]), tonumber(args[2])
+
+update_open_close(price, args[3])
+if price > agg.h then agg.h = price end
+if price < agg.l or agg.l == 0 then agg.l = price end
+
+local pv = agg.vw * agg.v + price * size
+agg.v = agg.v + size
+if agg.v ~= 0 then agg.vw = pv / agg.v end
+
+agg.n = agg.n + 1
+`
+
+// ProcessTradeScript is the equivalent of ProcessTrade for a Redis DB using the hash layout,
+// which runs the logic's script inside Redis.
+func ProcessTradeScript[Trade Aggregable](ctx context.Context, store *db.Redis, logic ScriptLogic[Trade], trade Trade, barLength db.BarLength) (globals.Aggregate, bool, error) {
+	ts := parseTimestampFromInt64(trade.GetTimestamp())
+
+	return store.RunScript(ctx, logic.Script, trade.GetTicker(), ts, barLength, logic.Args(trade)...)
+}
+
+// CheckScriptLogic applies the trades with both the Go and the Lua implementation of the logic,
+// and returns an error describing the first bar on which they disagree.
+// The trades are written to store, so it should be a scratch keyspace.
+func CheckScriptLogic[Trade Aggregable](ctx context.Context, store *db.Redis, logic ScriptLogic[Trade], trades []Trade, barLength db.BarLength) error {
+	reference := db.NewNativeDB(false)
+
+	for i, trade := range trades {
+		want, _, err := ProcessTrade[db.Tx](ctx, reference, logic.Logic, trade, barLength)
+		if err != nil {
+			return fmt.Errorf("trade %d: process with Go logic: %w", i, err)
+		}
+
+		got, _, err := ProcessTradeScript(ctx, store, logic, trade, barLength)
+		if err != nil {
+			return fmt.Errorf("trade %d: process with script: %w", i, err)
+		}
+
+		if !aggregatesMatch(want, got) {
+			return fmt.Errorf("trade %d: script produced %+v, Go logic produced %+v", i, got, want)
+		}
+	}
+
+	return nil
+}
+
+// aggregatesMatch compares aggregates with a small tolerance, since Go may fuse floating-point operations
+// that Lua performs separately.
+func aggregatesMatch(a, b globals.Aggregate) bool {
+	const epsilon = 1e-9
+	closeEnough := func(x, y float64) bool {
+		return x == y || math.Abs(x-y) <= epsilon*math.Max(math.Abs(x), math.Abs(y))
+	}
+
+	return a.Ticker == b.Ticker &&
+		a.Timestamp == b.Timestamp &&
+		a.StartTimestamp == b.StartTimestamp &&
+		a.EndTimestamp == b.EndTimestamp &&
+		a.Transactions == b.Transactions &&
+		closeEnough(a.Open, b.Open) &&
+		closeEnough(a.High, b.High) &&
+		closeEnough(a.Low, b.Low) &&
+		closeEnough(a.Close, b.Close) &&
+		closeEnough(a.Volume, b.Volume) &&
+		closeEnough(a.VWAP, b.VWAP)
+}
@@ -0,0 +1,42 @@
+package logic
+
+import (
+	"time"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/go-lib-models/v2/stocks"
+	"github.com/suremarc/go-lib-aggregates/calendar"
+	"github.com/suremarc/go-lib-aggregates/db"
+)
+
+// RegularHours returns logic that applies logic to the trades made during the regular session of the ticker's market
+// calendar (see db.MarketCalendars), and ignores the others, such as pre-market and after-hours trades, or trades
+// on holidays. Tickers without a calendar trade around the clock, so all of their trades are applied.
+func RegularHours[Trade Aggregable](logic UpdateLogic[Trade]) UpdateLogic[Trade] {
+	return func(aggregate globals.Aggregate, state *BarState, trade Trade) globals.Aggregate {
+		if c := db.MarketCalendar(trade.GetTicker()); c != nil {
+			ts := parseTimestampFromInt64(trade.GetTimestamp())
+			if c.Session(time.Unix(0, int64(ts))) != calendar.SessionRegular {
+				return aggregate
+			}
+		}
+
+		return logic(aggregate, state, trade)
+	}
+}
+
+// NewStocksRegularHoursDailyLogic is the equivalent of NewStocksDailyLogic for daily bars of regular-hours trades only.
+// The official open and close are applied whenever they arrive, since the closing print is usually reported
+// shortly after the regular session ends.
+func NewStocksRegularHoursDailyLogic(rules *ConditionRules, primaryExchanges PrimaryExchanges) UpdateLogic[*stocks.Trade] {
+	daily := NewStocksDailyLogic(rules, primaryExchanges)
+	regular := RegularHours(daily)
+
+	return func(aggregate globals.Aggregate, state *BarState, trade *stocks.Trade) globals.Aggregate {
+		if hasAnyCondition(trade, rules.OfficialOpen) || hasAnyCondition(trade, rules.OfficialClose) {
+			return daily(aggregate, state, trade)
+		}
+
+		return regular(aggregate, state, trade)
+	}
+}
@@ -0,0 +1,159 @@
+package logic
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/ptime"
+)
+
+// BarState is the auxiliary state that the logic keeps for every bar, alongside its aggregate, for values that can't
+// be derived from the aggregate itself. The DB persists it as an opaque value (see db.DB.GetState).
+type BarState struct {
+	// PriceVolume is the sum of price × size over every trade counted in the bar's volume.
+	// VWAP is derived from it, rather than updated in place, so that rounding errors don't accumulate.
+	PriceVolume float64
+	// First and Last are the positions of the trades that set the bar's open and close.
+	// They are zero if unknown, e.g. in a reconstructed state, in which case open and close follow arrival order.
+	// An official open or close has the first or last possible position of its trading day, so that no trade of
+	// that day can replace it.
+	First, Last TradePosition
+}
+
+// TradePosition orders the trades of a bar: by SIP timestamp, then by sequence number.
+type TradePosition struct {
+	Timestamp ptime.INanoseconds
+	Sequence  int64
+}
+
+// Before reports whether p comes strictly before q.
+func (p TradePosition) Before(q TradePosition) bool {
+	if p.Timestamp != q.Timestamp {
+		return p.Timestamp < q.Timestamp
+	}
+
+	return p.Sequence < q.Sequence
+}
+
+// ErrInvalidBarState is returned when a bar's stored state can't be decoded.
+var ErrInvalidBarState = errors.New("invalid bar state")
+
+// barStateVersion is written before every encoded state, so that fields can be added without invalidating stored states.
+// Version 1 only held PriceVolume.
+const barStateVersion = 2
+
+const (
+	barStateSizeV1 = 1 + 8
+	barStateSize   = barStateSizeV1 + 4*8
+)
+
+// NewBarState reconstructs the state of a bar that has none, e.g. because it was written by a Redis script,
+// before states existed, or copied from another store.
+func NewBarState(aggregate globals.Aggregate) BarState {
+	return BarState{
+		PriceVolume: aggregate.VWAP * aggregate.Volume,
+	}
+}
+
+func (s BarState) MarshalBinary() ([]byte, error) {
+	return s.appendBinary(make([]byte, 0, barStateSize)), nil
+}
+
+func (s *BarState) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("%w: empty", ErrInvalidBarState)
+	}
+
+	var size int
+	switch data[0] {
+	case 1:
+		size = barStateSizeV1
+	case barStateVersion:
+		size = barStateSize
+	default:
+		return fmt.Errorf("%w: unknown version %d", ErrInvalidBarState, data[0])
+	}
+
+	if len(data) != size {
+		return fmt.Errorf("%w: %d bytes", ErrInvalidBarState, len(data))
+	}
+
+	*s = BarState{
+		PriceVolume: math.Float64frombits(binary.LittleEndian.Uint64(data[1:])),
+	}
+
+	if data[0] == barStateVersion {
+		s.First.Timestamp = ptime.INanoseconds(binary.LittleEndian.Uint64(data[9:]))
+		s.First.Sequence = int64(binary.LittleEndian.Uint64(data[17:]))
+		s.Last.Timestamp = ptime.INanoseconds(binary.LittleEndian.Uint64(data[25:]))
+		s.Last.Sequence = int64(binary.LittleEndian.Uint64(data[33:]))
+	}
+
+	return nil
+}
+
+func (s BarState) appendBinary(buf []byte) []byte {
+	var b [barStateSize]byte
+	b[0] = barStateVersion
+	binary.LittleEndian.PutUint64(b[1:], math.Float64bits(s.PriceVolume))
+	binary.LittleEndian.PutUint64(b[9:], uint64(s.First.Timestamp))
+	binary.LittleEndian.PutUint64(b[17:], uint64(s.First.Sequence))
+	binary.LittleEndian.PutUint64(b[25:], uint64(s.Last.Timestamp))
+	binary.LittleEndian.PutUint64(b[33:], uint64(s.Last.Sequence))
+
+	return append(buf, b[:]...)
+}
+
+// addVolume counts a trade in the aggregate's volume and VWAP.
+func (s *BarState) addVolume(aggregate *globals.Aggregate, price, size float64) {
+	s.PriceVolume += price * size
+	aggregate.Volume += size
+
+	if aggregate.Volume != 0 {
+		aggregate.VWAP = s.PriceVolume / aggregate.Volume
+	}
+}
+
+// updateOpenClose makes a trade the bar's open if it's the earliest eligible trade so far,
+// and its close if it's the latest, so that both are independent of the order in which trades arrive.
+func (s *BarState) updateOpenClose(aggregate *globals.Aggregate, price float64, pos TradePosition) {
+	s.updateOpen(aggregate, price, pos)
+	s.updateClose(aggregate, price, pos)
+}
+
+func (s *BarState) updateOpen(aggregate *globals.Aggregate, price float64, pos TradePosition) {
+	// an open of 0 means that the bar has no eligible trades yet
+	if aggregate.Open == 0 || pos.Before(s.First) {
+		aggregate.Open = price
+		s.First = pos
+	}
+}
+
+func (s *BarState) updateClose(aggregate *globals.Aggregate, price float64, pos TradePosition) {
+	if aggregate.Close == 0 || !pos.Before(s.Last) {
+		aggregate.Close = price
+		s.Last = pos
+	}
+}
+
+// loadBarState decodes a bar's stored state, or reconstructs it from the aggregate if it has none.
+// The state of other aggregate types can't be reconstructed, so it starts empty.
+func loadBarState[A any](aggregate A, raw []byte) (BarState, error) {
+	if raw == nil {
+		if agg, ok := any(aggregate).(globals.Aggregate); ok {
+			return NewBarState(agg), nil
+		}
+
+		return BarState{}, nil
+	}
+
+	var state BarState
+	if err := state.UnmarshalBinary(raw); err != nil {
+		return BarState{}, err
+	}
+
+	return state, nil
+}
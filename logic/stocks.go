@@ -1,25 +1,52 @@
 package logic
 
 import (
+	"math"
+
 	"github.com/polygon-io/go-lib-models/v2/globals"
 	"github.com/polygon-io/go-lib-models/v2/stocks"
+	"github.com/suremarc/go-lib-aggregates/db"
 )
 
-var _ UpdateLogic[*stocks.Trade] = StocksLogic
+// StocksLogic applies StocksIntradayLogic to intraday bars and StocksDailyLogic to daily bars.
+var StocksLogic = ByBarLength(StocksIntradayLogic, StocksDailyLogic)
 
-// TODO: showcase separate intraday and EOD logic
-func StocksLogic(aggregate globals.Aggregate, trade *stocks.Trade) globals.Aggregate {
-	if stocksCanUpdateHighLow(trade) {
-		if aggregate.Open == 0 {
-			aggregate.Open = trade.Price
-		}
+// StocksRegularHoursLogic is the equivalent of StocksLogic whose daily bars only include regular-hours trades
+// (see NewStocksRegularHoursDailyLogic). Intraday bars include every trade, and can be told apart by their session.
+var StocksRegularHoursLogic = ByBarLength(StocksIntradayLogic, NewStocksRegularHoursDailyLogic(DefaultConditionRules, nil))
+
+// StocksIntradayLogic follows the consolidated intraday rules of DefaultConditionRules.
+var StocksIntradayLogic = NewStocksLogic(DefaultConditionRules.Consolidated.Intraday)
+
+// StocksDailyLogic follows the daily rules of DefaultConditionRules. Since it doesn't know any ticker's primary
+// listing exchange, its open and close are those of the consolidated trades; see NewStocksDailyLogic.
+var StocksDailyLogic = NewStocksDailyLogic(DefaultConditionRules, nil)
 
-		if aggregate.Close == 0 {
-			aggregate.Close = trade.Price
+// ByBarLength returns logic that applies intraday to intraday bars, and daily to day and week bars,
+// which may be shorter than 24 hours across DST transitions.
+func ByBarLength[Trade any](intraday, daily UpdateLogic[Trade]) UpdateLogic[Trade] {
+	return func(aggregate globals.Aggregate, state *BarState, trade Trade) globals.Aggregate {
+		if barLength, err := db.AggregateSchema.Key(aggregate).BarLength(); err == nil && !barLength.Intraday() {
+			return daily(aggregate, state, trade)
 		}
+
+		return intraday(aggregate, state, trade)
 	}
+}
 
-	if stocksCanUpdateOpenClose(trade) {
+// NewStocksLogic returns the logic for intraday bars of stock trades that follows the given condition rules.
+func NewStocksLogic(rules ConditionTable) UpdateLogic[*stocks.Trade] {
+	return func(aggregate globals.Aggregate, state *BarState, trade *stocks.Trade) globals.Aggregate {
+		return applyStocksTrade(aggregate, state, trade, rules.Permissions(trade.Conditions))
+	}
+}
+
+func applyStocksTrade(aggregate globals.Aggregate, state *BarState, trade *stocks.Trade, permissions Permissions) globals.Aggregate {
+	if permissions.OpenClose {
+		state.updateOpenClose(&aggregate, trade.Price, stocksTradePosition(trade))
+	}
+
+	if permissions.HighLow {
 		if trade.Price > aggregate.High {
 			aggregate.High = trade.Price
 		}
@@ -29,11 +56,8 @@ func StocksLogic(aggregate globals.Aggregate, trade *stocks.Trade) globals.Aggre
 		}
 	}
 
-	if stocksCanUpdateVolume(trade) {
-		aggregate.VWAP *= aggregate.Volume
-		aggregate.Volume += float64(trade.Size_)
-		aggregate.VWAP += trade.Price
-		aggregate.VWAP /= aggregate.Volume
+	if permissions.Volume {
+		state.addVolume(&aggregate, trade.Price, float64(trade.Size_))
 
 		aggregate.Transactions++
 	}
@@ -41,35 +65,77 @@ func StocksLogic(aggregate globals.Aggregate, trade *stocks.Trade) globals.Aggre
 	return aggregate
 }
 
-func stocksCanUpdateHighLow(trade *stocks.Trade) bool {
-	for _, c := range trade.Conditions {
-		switch c {
-		case 2, 7, 15, 16, 20, 21, 22, 29, 37, 52:
-			return false
-		}
-	}
+// PrimaryExchanges looks up the primary listing exchange of a ticker, if it's known.
+type PrimaryExchanges func(ticker string) (exchange int32, ok bool)
+
+// officialPositions returns the positions of the official open and close of a trade's trading day: the first and
+// last possible positions of the day, so that no trade of the same day can replace them, but those of other days in
+// a week bar still can.
+func officialPositions(trade *stocks.Trade) (first, last TradePosition) {
+	// day bounds don't fail
+	start, end, _ := db.BarBounds(trade.Ticker, parseTimestampFromInt64(trade.Timestamp), db.BarLengthDay)
 
-	return true
+	return TradePosition{Timestamp: start.ToINanoseconds(), Sequence: math.MinInt64},
+		TradePosition{Timestamp: end.ToINanoseconds() - 1, Sequence: math.MaxInt64}
 }
 
-func stocksCanUpdateOpenClose(trade *stocks.Trade) bool {
-	for _, c := range trade.Conditions {
-		switch c {
-		case 2, 5, 7, 10, 12, 13, 15, 16, 17, 20, 21, 22, 29, 32, 33, 37, 38, 52:
-			return false
+// NewStocksDailyLogic returns the logic for daily bars of stock trades. The official open and close of a daily bar
+// are the opening and closing prints of the ticker's primary listing exchange, i.e. trades from that exchange with
+// one of the rules' OfficialOpen or OfficialClose conditions that the market center daily rules let update the open
+// and close. Until they arrive, and for tickers whose primary exchange isn't known, the open and close are those of
+// the trades that the consolidated daily rules allow. The open of a week bar is that of its first trading day,
+// and its close that of its last. High, low and volume always follow the consolidated daily rules.
+// primaryExchanges may be nil.
+func NewStocksDailyLogic(rules *ConditionRules, primaryExchanges PrimaryExchanges) UpdateLogic[*stocks.Trade] {
+	consolidated := NewStocksLogic(rules.Consolidated.Daily)
+
+	return func(aggregate globals.Aggregate, state *BarState, trade *stocks.Trade) globals.Aggregate {
+		opening, closing := hasAnyCondition(trade, rules.OfficialOpen), hasAnyCondition(trade, rules.OfficialClose)
+		if !opening && !closing || primaryExchanges == nil || !rules.MarketCenter.Daily.Permissions(trade.Conditions).OpenClose {
+			return consolidated(aggregate, state, trade)
+		}
+
+		if primary, ok := primaryExchanges(trade.Ticker); !ok || trade.Exchange != primary {
+			return consolidated(aggregate, state, trade)
+		}
+
+		first, last := officialPositions(trade)
+		if opening {
+			// the trade that set the open is unknown, e.g. in a reconstructed state, so the official open takes over
+			if state.First == (TradePosition{}) {
+				aggregate.Open = 0
+			}
+
+			state.updateOpen(&aggregate, trade.Price, first)
 		}
-	}
 
-	return true
+		if closing {
+			state.updateClose(&aggregate, trade.Price, last)
+		}
+
+		// official prints may still count toward the high, low and volume, if the consolidated rules say so
+		permissions := rules.Consolidated.Daily.Permissions(trade.Conditions)
+		permissions.OpenClose = false
+
+		return applyStocksTrade(aggregate, state, trade, permissions)
+	}
 }
 
-func stocksCanUpdateVolume(trade *stocks.Trade) bool {
+func hasAnyCondition(trade *stocks.Trade, conditions []int32) bool {
 	for _, c := range trade.Conditions {
-		switch c {
-		case 15, 16:
-			return false
+		for _, d := range conditions {
+			if c == d {
+				return true
+			}
 		}
 	}
 
-	return true
+	return false
+}
+
+func stocksTradePosition(trade *stocks.Trade) TradePosition {
+	return TradePosition{
+		Timestamp: parseTimestampFromInt64(trade.Timestamp),
+		Sequence:  trade.SequenceNumber,
+	}
 }
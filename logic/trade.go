@@ -1,12 +1,15 @@
 package logic
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/polygon-io/go-lib-models/v2/globals"
 	"github.com/polygon-io/ptime"
 	"github.com/suremarc/go-lib-aggregates/db"
+	"github.com/suremarc/go-lib-aggregates/tracing"
 )
 
 type Aggregable interface {
@@ -14,33 +17,142 @@ type Aggregable interface {
 	GetTimestamp() int64
 }
 
-type UpdateLogic[Trade any] func(globals.Aggregate, Trade) globals.Aggregate
+// UpdateLogic computes the new value of an aggregate from its current value and a trade.
+// It may also update the bar's state, which is persisted alongside the aggregate.
+type UpdateLogic[Trade any] func(globals.Aggregate, *BarState, Trade) globals.Aggregate
+
+// Logic is the equivalent of UpdateLogic for a custom aggregate type (see db.Schema).
+type Logic[A, Trade any] func(A, *BarState, Trade) A
+
+// ProcessTrade applies a trade to the bar of the given length that contains it. Logic that differs between
+// intraday and daily bars, such as StocksLogic, picks the right rules from the bar's length (see ByBarLength).
+func ProcessTrade[Txn any, Trade Aggregable](ctx context.Context, store db.DB[Txn], logic UpdateLogic[Trade], trade Trade, barLength db.BarLength) (globals.Aggregate, bool, error) {
+	return ProcessTradeOf[Txn, globals.Aggregate, Trade](ctx, store, Logic[globals.Aggregate, Trade](logic), trade, barLength)
+}
+
+// ProcessTradeOf is the equivalent of ProcessTrade for a store of a custom aggregate type.
+// Bars without a state start from an empty one, since only a globals.Aggregate's state can be reconstructed.
+func ProcessTradeOf[Txn any, A comparable, Trade Aggregable](ctx context.Context, store db.Store[Txn, A], logic Logic[A, Trade], trade Trade, barLength db.BarLength) (agg A, updated bool, err error) {
+	return processTradeOf(ctx, store, logic, trade, barLength, nil)
+}
+
+// ProcessStoredTrade is the equivalent of ProcessTrade that also stores the trade in a TradeStore, under its ID,
+// so that its bar can be recomputed if the trade is canceled or corrected (see CancelTrade and CorrectTrade).
+// The trade is stored before the transaction is committed, so that a correction of the bar sees either both or neither.
+func ProcessStoredTrade[Txn any, Trade Aggregable](ctx context.Context, store db.DB[Txn], trades db.TradeStore[Trade], logic UpdateLogic[Trade], trade Trade, id db.TradeID, barLength db.BarLength) (globals.Aggregate, bool, error) {
+	return processTradeOf[Txn, globals.Aggregate, Trade](ctx, store, Logic[globals.Aggregate, Trade](logic), trade, barLength, func(ts ptime.INanoseconds) error {
+		return trades.Put(trade.GetTicker(), id, ts, trade)
+	})
+}
+
+// processTradeOf implements ProcessTradeOf. If record is not nil, it's called with the trade's timestamp
+// once the bar is updated, before the transaction is committed.
+func processTradeOf[Txn any, A comparable, Trade Aggregable](ctx context.Context, store db.Store[Txn, A], logic Logic[A, Trade], trade Trade, barLength db.BarLength, record func(ptime.INanoseconds) error) (agg A, updated bool, err error) {
+	ticker := trade.GetTicker()
+
+	ctx, span := tracing.Start(ctx, "logic.ProcessTrade", tracing.String("ticker", ticker), tracing.String("bar_length", string(barLength)))
+	defer func() { span.End(err) }()
+
+	// stores with optimistic transactions fail the commit if another transaction updated the bar in the meantime,
+	// in which case the trade is applied again to the new bar
+	for {
+		agg, updated, err = applyTrade(ctx, store, logic, trade, barLength, record)
+		if !errors.Is(err, db.ErrConflict) || ctx.Err() != nil {
+			return agg, updated, err
+		}
+	}
+}
+
+func applyTrade[Txn any, A comparable, Trade Aggregable](ctx context.Context, store db.Store[Txn, A], logic Logic[A, Trade], trade Trade, barLength db.BarLength, record func(ptime.INanoseconds) error) (agg A, updated bool, err error) {
+	ticker := trade.GetTicker()
 
-func ProcessTrade[Txn any, Trade Aggregable](ctx context.Context, store db.DB[Txn], logic UpdateLogic[Trade], trade Trade, barLength db.BarLength) (agg globals.Aggregate, updated bool, err error) {
 	tx, err := store.NewTx(ctx)
 	if err != nil {
 		return agg, false, fmt.Errorf("new tx: %w", err)
 	}
-	defer store.Commit(tx)
+	defer func() {
+		if commitErr := store.Commit(tx); commitErr != nil && err == nil {
+			updated, err = false, fmt.Errorf("commit: %w", commitErr)
+		}
+	}()
 
 	ts := parseTimestampFromInt64(trade.GetTimestamp())
-	ticker := trade.GetTicker()
 
 	aggregate, err := store.Get(tx, ticker, ts, barLength)
 	if err != nil {
 		return agg, false, fmt.Errorf("get: %w", err)
 	}
 
-	newAggregate := logic(aggregate, trade)
+	rawState, err := store.GetState(tx, ticker, ts, barLength)
+	if err != nil {
+		return agg, false, fmt.Errorf("get state: %w", err)
+	}
+
+	state, err := loadBarState(aggregate, rawState)
+	if err != nil {
+		return agg, false, fmt.Errorf("load state: %w", err)
+	}
+
+	_, logicSpan := tracing.Start(ctx, "logic.Update", tracing.String("ticker", ticker))
+	newAggregate := logic(aggregate, &state, trade)
+	logicSpan.End(nil)
 	updated = newAggregate != aggregate
 
 	if err := store.Upsert(tx, newAggregate); err != nil {
 		return agg, false, fmt.Errorf("set: %w", err)
 	}
 
+	if newRawState := state.appendBinary(nil); !bytes.Equal(newRawState, rawState) {
+		if err := store.UpsertState(tx, ticker, ts, barLength, newRawState); err != nil {
+			return agg, false, fmt.Errorf("set state: %w", err)
+		}
+	}
+
+	if record != nil {
+		if err := record(ts); err != nil {
+			return agg, false, fmt.Errorf("store trade: %w", err)
+		}
+	}
+
 	return newAggregate, updated, nil
 }
 
+// ProcessTradeActor is the equivalent of ProcessTrade for an ActorDB. It waits for the trade to be applied.
+func ProcessTradeActor[Trade Aggregable](ctx context.Context, store *db.ActorDB, logic UpdateLogic[Trade], trade Trade, barLength db.BarLength) (globals.Aggregate, bool, error) {
+	ts := parseTimestampFromInt64(trade.GetTimestamp())
+
+	return store.Update(ctx, trade.GetTicker(), ts, barLength, actorUpdate(logic, trade))
+}
+
+// SendTrade sends a trade to an ActorDB without waiting for it to be applied.
+// onUpdate, if not nil, is called from the shard goroutine with the result.
+// Trades sent from a single goroutine are applied in the order they were sent.
+func SendTrade[Trade Aggregable](ctx context.Context, store *db.ActorDB, logic UpdateLogic[Trade], trade Trade, barLength db.BarLength, onUpdate func(agg globals.Aggregate, updated bool, err error)) error {
+	ts := parseTimestampFromInt64(trade.GetTimestamp())
+
+	return store.Send(ctx, trade.GetTicker(), ts, barLength, actorUpdate(logic, trade), onUpdate)
+}
+
+func actorUpdate[Trade any](logic UpdateLogic[Trade], trade Trade) db.UpdateFunc {
+	return func(aggregate globals.Aggregate, rawState []byte) (globals.Aggregate, []byte) {
+		state, err := loadBarState(aggregate, rawState)
+		if err != nil {
+			// the shard only holds states encoded below, so this can't happen, but rebuilding it is the best we can do
+			state = NewBarState(aggregate)
+		}
+
+		aggregate = logic(aggregate, &state, trade)
+
+		// the shard doesn't keep the old state, so its buffer can be reused
+		return aggregate, state.appendBinary(rawState[:0])
+	}
+}
+
+// TradeTimestamp returns the timestamp of a trade, which feeds send in either milliseconds or nanoseconds.
+func TradeTimestamp(trade Aggregable) ptime.INanoseconds {
+	return parseTimestampFromInt64(trade.GetTimestamp())
+}
+
 func parseTimestampFromInt64(x int64) ptime.INanoseconds {
 	if x < 9999999999999 {
 		return ptime.IMilliseconds(x).ToINanoseconds()
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/sirupsen/logrus"
+	"github.com/suremarc/go-lib-aggregates/db"
+	"github.com/suremarc/go-lib-aggregates/internal/backend"
+)
+
+// migrate copies aggregates from one backend to another. Backends are given as URLs, see backend.Open.
+func main() {
+	var (
+		src        = flag.String("src", "", "source backend URL")
+		dst        = flag.String("dst", "", "destination backend URL")
+		tickers    = flag.String("tickers", "", "comma-separated tickers to copy (default all)")
+		barLengths = flag.String("bar-lengths", "", "comma-separated bar lengths to copy, e.g. min,day (default all)")
+		from       = flag.String("from", "", "copy bars starting at or after this date or RFC 3339 time")
+		to         = flag.String("to", "", "copy bars starting before this date or RFC 3339 time")
+		batchSize  = flag.Int("batch", 1000, "aggregates written between checkpoints")
+		checkpoint = flag.String("checkpoint", "", "file to record progress in, and resume from")
+		verify     = flag.Bool("verify", false, "read back every aggregate and report mismatches")
+	)
+	flag.Parse()
+
+	opts := db.CopyOptions{
+		BatchSize:  *batchSize,
+		Checkpoint: *checkpoint,
+		Verify:     *verify,
+		OnMismatch: func(want, got globals.Aggregate) {
+			logrus.WithFields(logrus.Fields{
+				"want": fmt.Sprintf("%+v", want),
+				"got":  fmt.Sprintf("%+v", got),
+			}).Warn("mismatch")
+		},
+	}
+
+	var err error
+	if opts.Filter, err = backend.ParseFilter(*tickers, *barLengths, *from, *to); err != nil {
+		logrus.WithError(err).Fatal("parse filter")
+	}
+
+	source, err := backend.Open(*src)
+	if err != nil {
+		logrus.WithError(err).Fatal("open source")
+	}
+	defer source.Close()
+
+	dest, err := backend.Open(*dst)
+	if err != nil {
+		logrus.WithError(err).Fatal("open destination")
+	}
+	defer dest.Close()
+
+	// tables created before bar specs existed can't hold them
+	if dest.UpgradeSchema != nil {
+		if err := dest.UpgradeSchema(context.Background()); err != nil {
+			logrus.WithError(err).Fatal("upgrade destination schema")
+		}
+	}
+
+	srcRange := source.Source
+	if opts.Checkpoint != "" && !source.Ordered {
+		srcRange = db.SortedSource(srcRange)
+	}
+
+	start := time.Now()
+	stats, err := dest.CopyFrom(context.Background(), srcRange, opts)
+
+	logrus.WithFields(logrus.Fields{
+		"read":       stats.Read,
+		"skipped":    stats.Skipped,
+		"copied":     stats.Copied,
+		"mismatches": stats.Mismatches,
+		"elapsed":    time.Since(start).Round(time.Millisecond),
+	}).Info("copy finished")
+
+	if err != nil {
+		logrus.WithError(err).Fatal("copy")
+	}
+}
@@ -6,9 +6,13 @@ import (
 	"encoding/csv"
 	"io"
 	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/polygon-io/go-lib-models/v2/globals"
 	"github.com/polygon-io/go-lib-models/v2/stocks"
 	"github.com/suremarc/go-lib-aggregates/db"
 	"github.com/suremarc/go-lib-aggregates/logic"
@@ -53,6 +57,20 @@ func BenchmarkDragonfly(b *testing.B) {
 	})
 }
 
+func BenchmarkRedisCluster(b *testing.B) {
+	addrs, ok := os.LookupEnv("REDIS_CLUSTER_URLS")
+	if !ok {
+		b.Skip("REDIS_CLUSTER_URLS not set")
+	}
+
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs: strings.Split(addrs, ","),
+	})
+
+	store := db.NewRedis(client, db.WithNamespace("bench"))
+	benchmarkDB[db.RedisTx](b, store, true)
+}
+
 func benchmarkRedisProtocol(b *testing.B, opts *redis.Options) {
 	client := redis.NewClient(opts)
 
@@ -62,6 +80,36 @@ func benchmarkRedisProtocol(b *testing.B, opts *redis.Options) {
 	benchmarkDB[db.RedisTx](b, store, true)
 }
 
+func BenchmarkRedisScript(b *testing.B) {
+	benchmarkRedisScript(b, &redis.Options{
+		Addr: getEnv("REDIS_URL", "localhost:6379"),
+	})
+}
+
+func BenchmarkKeyDBScript(b *testing.B) {
+	benchmarkRedisScript(b, &redis.Options{
+		Addr: getEnv("KEYDB_URL", "localhost:6380"),
+	})
+}
+
+func BenchmarkDragonflyScript(b *testing.B) {
+	benchmarkRedisScript(b, &redis.Options{
+		Addr: getEnv("DRAGONFLY_URL", "localhost:6381"),
+	})
+}
+
+func benchmarkRedisScript(b *testing.B, opts *redis.Options) {
+	client := redis.NewClient(opts)
+
+	require.NoError(b, client.FlushAll(context.Background()).Err())
+
+	store := db.NewRedis(client, db.WithHashLayout())
+	benchmarkParallel(b, func(ctx context.Context, trade *stocks.Trade) error {
+		_, _, err := logic.ProcessTradeScript(ctx, store, logic.StocksScriptLogic, trade, db.BarLengthMinute)
+		return err
+	})
+}
+
 func BenchmarkSQLiteInMemory(b *testing.B) {
 	benchmarkSQL(b, "sqlite", "file::memory:?cache=shared", false)
 }
@@ -87,7 +135,49 @@ func benchmarkSQL(b *testing.B, driver, dataSourceName string, parallel bool) {
 	benchmarkDB[sql.Tx](b, store, parallel)
 }
 
-func benchmarkDB[Tx any](b *testing.B, store db.DB[Tx], parallel bool) {
+func BenchmarkActorDB(b *testing.B) {
+	store := db.NewActorDB(runtime.GOMAXPROCS(0), 1000, false)
+	defer store.Close()
+
+	benchmarkParallel(b, func(ctx context.Context, trade *stocks.Trade) error {
+		_, _, err := logic.ProcessTradeActor(ctx, store, logic.StocksLogic, trade, db.BarLengthMinute)
+		return err
+	})
+}
+
+func BenchmarkActorDBAsync(b *testing.B) {
+	store := db.NewActorDB(runtime.GOMAXPROCS(0), 1000, false)
+
+	// updates are applied on the shards' goroutines, so their errors are only counted there
+	var errs int64
+	onUpdate := func(_ globals.Aggregate, _ bool, err error) {
+		if err != nil {
+			atomic.AddInt64(&errs, 1)
+		}
+	}
+
+	tradesChan := benchmarkTrades(b)
+
+	ctx := context.Background()
+	b.ResetTimer()
+
+	// a single sender, like a feed, so that trades are applied in order
+	for trade := range tradesChan {
+		trade := trade
+		if err := logic.SendTrade(ctx, store, logic.StocksLogic, &trade, db.BarLengthMinute, onUpdate); err != nil {
+			b.Error(err)
+		}
+	}
+
+	// wait for the shards to drain their inboxes
+	store.Close()
+
+	if n := atomic.LoadInt64(&errs); n > 0 {
+		b.Errorf("%d trades failed to apply", n)
+	}
+}
+
+func benchmarkTrades(b *testing.B) <-chan stocks.Trade {
 	tradesChan := make(chan stocks.Trade, 1000)
 	go func() {
 		defer close(tradesChan)
@@ -121,23 +211,43 @@ func benchmarkDB[Tx any](b *testing.B, store db.DB[Tx], parallel bool) {
 		}
 	}()
 
+	return tradesChan
+}
+
+// benchmarkParallel processes the benchmark's trades from parallel goroutines.
+func benchmarkParallel(b *testing.B, process func(context.Context, *stocks.Trade) error) {
+	tradesChan := benchmarkTrades(b)
+
 	ctx := context.Background()
 	b.ResetTimer()
 
-	if parallel {
-		b.RunParallel(func(pb *testing.PB) {
-			for pb.Next() {
-				trade := <-tradesChan
-				if _, _, err := logic.ProcessTrade(ctx, store, logic.StocksLogic, &trade, db.BarLengthMinute); err != nil {
-					b.Error(err)
-				}
-			}
-		})
-	} else {
-		for trade := range tradesChan {
-			if _, _, err := logic.ProcessTrade(ctx, store, logic.StocksLogic, &trade, db.BarLengthMinute); err != nil {
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			trade := <-tradesChan
+			if err := process(ctx, &trade); err != nil {
 				b.Error(err)
 			}
 		}
+	})
+}
+
+func benchmarkDB[Tx any](b *testing.B, store db.DB[Tx], parallel bool) {
+	if parallel {
+		benchmarkParallel(b, func(ctx context.Context, trade *stocks.Trade) error {
+			_, _, err := logic.ProcessTrade(ctx, store, logic.StocksLogic, trade, db.BarLengthMinute)
+			return err
+		})
+		return
+	}
+
+	tradesChan := benchmarkTrades(b)
+
+	ctx := context.Background()
+	b.ResetTimer()
+
+	for trade := range tradesChan {
+		if _, _, err := logic.ProcessTrade(ctx, store, logic.StocksLogic, &trade, db.BarLengthMinute); err != nil {
+			b.Error(err)
+		}
 	}
 }
@@ -0,0 +1,218 @@
+// Package publish decides when bars are published, in event time rather than wall-clock time.
+//
+// A Queue tracks a watermark: the latest trade timestamp seen, which no trade should be much later than.
+// A bar is published once the watermark passes its end, and republished as a new revision whenever a late trade
+// changes it, until the watermark passes its end plus the allowed lateness. Its last publication is marked final;
+// trades that arrive after that are still applied to the stored bar, but don't republish it. Bars recomputed after
+// one of their trades is canceled or corrected are republished even once final, as corrections.
+package publish
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/polygon-io/ptime"
+	"github.com/suremarc/go-lib-aggregates/db"
+)
+
+// Bar is a publication of a bar.
+type Bar struct {
+	globals.Aggregate
+	BarLength db.BarLength
+	// Revision is 0 the first time a bar is published, and is incremented every time late trades change it after that.
+	Revision int
+	// Final marks the last publication of a bar: no trade changes it anymore. If the bar didn't change since its
+	// last publication, it's published again, with the same revision, to mark it final.
+	Final bool
+	// Correction marks the republication of a bar that was already final, because it was recomputed after one of its
+	// trades was canceled or corrected. Corrections are final, and their revision starts over from 0.
+	Correction bool
+}
+
+// Option configures a Queue.
+type Option func(*Queue)
+
+// WithAllowedLateness sets how long after a bar ends, in event time, trades still republish it. The default is 0,
+// which makes every bar final when it's first published: since the watermark is the latest trade timestamp seen,
+// trades that arrive slightly out of order, e.g. from different workers, then don't republish their bar, although
+// they're still applied to it. Later trades are applied all the same, so lateness only bounds what's published.
+func WithAllowedLateness(d time.Duration) Option {
+	return func(q *Queue) {
+		q.allowedLateness = ptime.IMillisecondsFromDuration(d)
+	}
+}
+
+// WithMaxIdle sets how far the watermark may lag behind the wall clock, so that bars are still published when trades
+// stop arriving, e.g. outside trading hours. The default is a minute.
+func WithMaxIdle(d time.Duration) Option {
+	return func(q *Queue) {
+		q.maxIdle = ptime.IMillisecondsFromDuration(d)
+	}
+}
+
+// WithClock sets the source of the wall-clock time, for tests. The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(q *Queue) {
+		q.now = now
+	}
+}
+
+// Queue holds the bars that were updated but aren't final yet, until they're published.
+type Queue struct {
+	allowedLateness ptime.IMilliseconds
+	maxIdle         ptime.IMilliseconds
+	now             func() time.Time
+
+	// latest is the latest trade timestamp seen, in milliseconds.
+	latest int64
+	// late counts the trades that arrived after their bar was final.
+	late int64
+
+	mu   sync.Mutex
+	bars map[key]*entry
+}
+
+type key struct {
+	ticker    string
+	timestamp ptime.IMilliseconds
+	barLength db.BarLength
+}
+
+type entry struct {
+	aggregate globals.Aggregate
+	// revision is the revision of the next publication.
+	revision int
+	// changed is set when the bar changes, and cleared when it's published.
+	changed bool
+	// correction is set if the bar was already final when it was enqueued.
+	correction bool
+}
+
+func NewQueue(opts ...Option) *Queue {
+	q := &Queue{
+		maxIdle: ptime.IMillisecondsFromDuration(time.Minute),
+		now:     time.Now,
+		bars:    make(map[key]*entry),
+	}
+
+	for _, opt := range opts {
+		opt(q)
+	}
+
+	return q
+}
+
+// Watermark returns the event time up to which bars are considered complete: the latest trade timestamp seen,
+// but no later than the wall clock, and no earlier than the maximum idle time before it.
+func (q *Queue) Watermark() ptime.IMilliseconds {
+	now := ptime.IMillisecondsFromTime(q.now())
+	watermark := ptime.IMilliseconds(atomic.LoadInt64(&q.latest))
+	if watermark > now {
+		return now
+	}
+
+	if watermark < now-q.maxIdle {
+		return now - q.maxIdle
+	}
+
+	return watermark
+}
+
+// Observe advances the watermark to a trade's timestamp, or only to the wall clock if the trade is from the future,
+// so that a bad timestamp can't keep the bars of every other ticker final early. It reports whether the trade's bar
+// of the given length can still be republished. Once the bar is final, the trade should still be applied to it,
+// but not enqueued; it's counted as late instead.
+func (q *Queue) Observe(ticker string, ts ptime.INanoseconds, barLength db.BarLength) (bool, error) {
+	_, end, err := db.BarBounds(ticker, ts, barLength)
+	if err != nil {
+		return false, err
+	}
+
+	ms := int64(ptime.IMillisecondsFromTime(ts.ToTime()))
+	if now := int64(ptime.IMillisecondsFromTime(q.now())); ms > now {
+		ms = now
+	}
+
+	for {
+		latest := atomic.LoadInt64(&q.latest)
+		if ms <= latest || atomic.CompareAndSwapInt64(&q.latest, latest, ms) {
+			break
+		}
+	}
+
+	if q.final(end, q.Watermark()) {
+		atomic.AddInt64(&q.late, 1)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Late returns the number of trades that arrived after their bar was final, which weren't republished.
+func (q *Queue) Late() int64 {
+	return atomic.LoadInt64(&q.late)
+}
+
+// Enqueue records the new value of a bar, to be published by the next Sweep that finds it complete.
+// A bar that's already final, because it was recomputed after a trade was canceled or corrected, or because a trade
+// raced it becoming final, is published again as a Correction.
+func (q *Queue) Enqueue(aggregate globals.Aggregate, barLength db.BarLength) {
+	watermark := q.Watermark()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	k := key{ticker: aggregate.Ticker, timestamp: aggregate.Timestamp, barLength: barLength}
+	e, ok := q.bars[k]
+	if !ok {
+		e = &entry{correction: q.final(aggregate.EndTimestamp, watermark)}
+		q.bars[k] = e
+	}
+
+	e.aggregate = aggregate
+	e.changed = true
+}
+
+// Sweep publishes, in no particular order, every bar that's complete at the current watermark and changed since it
+// was last published, as well as every bar that became final. Final bars are then forgotten.
+func (q *Queue) Sweep(publish func(Bar)) {
+	watermark := q.Watermark()
+
+	var bars []Bar
+	q.mu.Lock()
+	for k, e := range q.bars {
+		if e.aggregate.EndTimestamp > watermark {
+			continue
+		}
+
+		final := q.final(e.aggregate.EndTimestamp, watermark)
+		if !e.changed && !final {
+			continue
+		}
+
+		bar := Bar{Aggregate: e.aggregate, BarLength: k.barLength, Revision: e.revision, Final: final, Correction: e.correction}
+		if e.changed {
+			e.revision++
+			e.changed = false
+		} else {
+			// the bar was already published as is
+			bar.Revision--
+		}
+
+		bars = append(bars, bar)
+		if final {
+			delete(q.bars, k)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, bar := range bars {
+		publish(bar)
+	}
+}
+
+func (q *Queue) final(end, watermark ptime.IMilliseconds) bool {
+	return end+q.allowedLateness <= watermark
+}
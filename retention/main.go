@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/suremarc/go-lib-aggregates/db"
+
+	_ "modernc.org/sqlite"
+)
+
+// retention applies db.DefaultRetentionPolicies to a SQL database, once,
+// or on the cron schedule in RETENTION_SCHEDULE if it is set.
+func main() {
+	driver := os.Getenv("SQL_DRIVER")
+	if driver == "" {
+		driver = "postgres"
+	}
+
+	sqlDB, err := sql.Open(driver, os.Getenv("SQL_URL"))
+	if err != nil {
+		logrus.WithError(err).Fatal("open database")
+	}
+	defer sqlDB.Close()
+
+	store, err := db.NewSQL(sqlDB)
+	if err != nil {
+		logrus.WithError(err).Fatal("create table")
+	}
+
+	schedule := os.Getenv("RETENTION_SCHEDULE")
+	if schedule == "" {
+		if err := applyRetention(context.Background(), store); err != nil {
+			logrus.WithError(err).Fatal("apply retention")
+		}
+		return
+	}
+
+	c := cron.New()
+	if _, err := c.AddFunc(schedule, func() {
+		if err := applyRetention(context.Background(), store); err != nil {
+			logrus.WithError(err).Error("apply retention")
+		}
+	}); err != nil {
+		logrus.WithError(err).Fatal("parse schedule")
+	}
+
+	c.Run()
+}
+
+func applyRetention(ctx context.Context, store *db.SQL) error {
+	stats, err := store.ApplyRetention(ctx, time.Now(), db.DefaultRetentionPolicies)
+	for _, s := range stats {
+		logrus.WithFields(logrus.Fields{
+			"barLength":   s.BarLength,
+			"cutoff":      s.Cutoff,
+			"downsampled": s.Downsampled,
+			"deleted":     s.Deleted,
+		}).Info("applied retention")
+	}
+
+	return err
+}
@@ -2,18 +2,23 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"time"
 
 	polygonws "github.com/polygon-io/client-go/websocket"
 	"github.com/polygon-io/go-lib-models/v2/globals"
-	"github.com/polygon-io/go-lib-models/v2/stocks"
+	"github.com/polygon-io/ptime"
 	"github.com/robfig/cron/v3"
 	"github.com/sirupsen/logrus"
+	"github.com/suremarc/go-lib-aggregates/calendar"
 	"github.com/suremarc/go-lib-aggregates/db"
 	"github.com/suremarc/go-lib-aggregates/logic"
+	"github.com/suremarc/go-lib-aggregates/publish"
+	"github.com/suremarc/go-lib-aggregates/tracing"
 	"gopkg.in/tomb.v2"
 )
 
@@ -21,7 +26,16 @@ const barLength = db.BarLengthMinute
 
 func main() {
 	store := db.NewNativeDB(true)
-	var publishQueue aggregateQueue
+
+	// optionally, keep republishing bars that late trades change for a while after they end
+	var allowedLateness time.Duration
+	if s := os.Getenv("ALLOWED_LATENESS"); s != "" {
+		var err error
+		if allowedLateness, err = time.ParseDuration(s); err != nil {
+			logrus.WithError(err).Fatal("parse allowed lateness")
+		}
+	}
+	publishQueue := publish.NewQueue(publish.WithAllowedLateness(allowedLateness))
 
 	t, ctx := tomb.WithContext(context.Background())
 
@@ -35,37 +49,147 @@ func main() {
 		logrus.WithError(err).Fatal("initialize ws client")
 	}
 
-	trades := make(chan *stocks.Trade, 1000)
-	t.Go(func() error { return consumerLoop(ctx, client, stocksTranslator, trades, polygonws.StocksTrades, "*") })
+	trades := make(chan *stocksFeedTrade, 1000)
+	// cancels and corrections of earlier trades, which are applied by recomputing their bars from the stored trades
+	corrections := make(chan tradeCorrection[*stocksFeedTrade], 100)
+	t.Go(func() error {
+		return consumerLoop(ctx, client, stocksTranslator, trades, corrections, polygonws.StocksTrades, "*")
+	})
+
+	tradeStore := db.NewNativeTradeStore[*stocksFeedTrade]()
+	tradeRetention := 24 * time.Hour
+	if s := os.Getenv("TRADE_RETENTION"); s != "" {
+		if tradeRetention, err = time.ParseDuration(s); err != nil {
+			logrus.WithError(err).Fatal("parse trade retention")
+		}
+	}
+
+	// optionally, serve metrics about the store in the Prometheus text format
+	var instrumented db.DB[db.Tx] = store
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		metrics := db.NewMetrics()
+		instrumented = db.Instrument[db.Tx](store, "native", metrics)
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				logrus.WithError(err).Error("serve metrics")
+			}
+		}()
+	}
+
+	// optionally, trace every trade to stdout
+	if os.Getenv("TRACE_STDOUT") != "" {
+		ctx = tracing.ContextWithTracer(ctx, tracing.NewTracer(tracing.NewStdoutExporter()))
+		instrumented = db.Trace(instrumented, "native")
+	}
+
+	// optionally, load the trade condition rules from a file instead of using the built-in ones
+	rules := logic.DefaultConditionRules
+	if path := os.Getenv("CONDITION_RULES"); path != "" {
+		if rules, err = logic.LoadConditionRules(path); err != nil {
+			logrus.WithError(err).Fatal("load condition rules")
+		}
+
+		logrus.WithField("revision", rules.Revision).Info("loaded condition rules")
+	}
+
+	// optionally, load the primary listing exchanges of tickers, whose official prints set the open and close of daily bars
+	var primaryExchanges logic.PrimaryExchanges
+	if path := os.Getenv("PRIMARY_EXCHANGES"); path != "" {
+		exchanges, err := logic.LoadPrimaryExchanges(path)
+		if err != nil {
+			logrus.WithError(err).Fatal("load primary exchanges")
+		}
+
+		logrus.WithField("tickers", len(exchanges)).Info("loaded primary exchanges")
+		primaryExchanges = exchanges.Lookup
+	}
+
+	// optionally, load the stocks calendar from a file instead of using the built-in one
+	if path := os.Getenv("MARKET_CALENDAR"); path != "" {
+		c, err := calendar.Load(path)
+		if err != nil {
+			logrus.WithError(err).Fatal("load market calendar")
+		}
+
+		logrus.WithField("name", c.Name).Info("loaded market calendar")
+		db.MarketCalendars[db.AssetClassStocks] = c
+	}
+
+	// optionally, only include regular-hours trades in daily bars
+	dailyLogic := logic.NewStocksDailyLogic(rules, primaryExchanges)
+	if os.Getenv("REGULAR_HOURS_DAILY") != "" {
+		dailyLogic = logic.NewStocksRegularHoursDailyLogic(rules, primaryExchanges)
+	}
+	stocksLogic := logic.ByBarLength(logic.NewStocksLogic(rules.Consolidated.Intraday), dailyLogic)
+
+	feedLogic := func(aggregate globals.Aggregate, state *logic.BarState, trade *stocksFeedTrade) globals.Aggregate {
+		return stocksLogic(aggregate, state, trade.Trade)
+	}
 
 	for i := 0; i < 8; i++ {
 		t.Go(func() error {
-			return dbLoop(ctx, store, logic.StocksLogic, trades, &publishQueue)
+			return dbLoop[*stocksFeedTrade](ctx, instrumented, tradeStore, feedLogic, (*stocksFeedTrade).tradeID, trades, publishQueue)
 		})
 	}
+	t.Go(func() error {
+		return correctionLoop[*stocksFeedTrade](ctx, instrumented, tradeStore, feedLogic, corrections, publishQueue)
+	})
 
 	c := cron.New(cron.WithSeconds())
 	c.AddFunc("* * * * * *", func() {
-		publishQueue.sweepAndClear(func(aggregate globals.Aggregate, _ db.BarLength) bool {
-			if !isAggregateReady(aggregate) {
-				return false
+		publishQueue.Sweep(func(bar publish.Bar) {
+			status := "final"
+			if bar.Correction {
+				status = "correction"
+			} else if !bar.Final {
+				status = "preliminary"
 			}
 
 			fmt.Printf(
-				"%s %s - open: $%.2f, close: $%.2f, high: $%.2f, low: $%.2f, volume: %f\n",
-				aggregate.Ticker,
-				aggregate.StartTimestamp.ToTime().Format("15:04:05"),
-				aggregate.Open,
-				aggregate.Close,
-				aggregate.High,
-				aggregate.Low,
-				aggregate.Volume,
+				"%s %s (%s, revision %d, %s) - open: $%.2f, close: $%.2f, high: $%.2f, low: $%.2f, volume: %f\n",
+				bar.Ticker,
+				bar.StartTimestamp.ToTime().Format("15:04:05"),
+				db.AggregateSchema.Key(bar.Aggregate).Session(),
+				bar.Revision,
+				status,
+				bar.Open,
+				bar.Close,
+				bar.High,
+				bar.Low,
+				bar.Volume,
 			)
-
-			return true
 		})
 	})
 
+	c.AddFunc("0 * * * * *", func() {
+		logHotTickers(store, 5)
+		logrus.WithField("late", publishQueue.Late()).Info("late trades")
+	})
+
+	c.AddFunc("0 0 * * * *", func() {
+		expired, err := tradeStore.Expire(ptime.INanosecondsFromTime(time.Now().Add(-tradeRetention)))
+		if err != nil {
+			logrus.WithError(err).Error("expire trades")
+		}
+
+		logrus.WithField("expired", expired).Info("expired trades")
+	})
+
+	// optionally, also apply retention to a SQL database that the aggregates are archived to
+	if url := os.Getenv("RETENTION_SQL_URL"); url != "" {
+		sqlStore, err := openRetentionStore(url)
+		if err != nil {
+			logrus.WithError(err).Fatal("open retention database")
+		}
+
+		c.AddFunc("0 0 * * * *", func() {
+			applyRetention(ctx, sqlStore)
+		})
+	}
+
 	c.Start()
 
 	if err := t.Wait(); err != nil {
@@ -73,15 +197,56 @@ func main() {
 	}
 }
 
-type AggregableUnmarshaler interface {
-	logic.Aggregable
-	json.Unmarshaler
+func logHotTickers(store *db.NativeDB, n int) {
+	stats := store.LockStats()
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+
+	for _, s := range stats {
+		if s.Contended == 0 && s.Timeouts == 0 {
+			break
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"ticker":       s.Ticker,
+			"acquisitions": s.Acquisitions,
+			"contended":    s.Contended,
+			"timeouts":     s.Timeouts,
+			"totalWait":    s.TotalWait,
+			"maxWait":      s.MaxWait,
+		}).Info("lock contention")
+	}
+}
+
+func openRetentionStore(url string) (*db.SQL, error) {
+	sqlDB, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.NewSQL(sqlDB)
 }
 
-func consumerLoop[Trade any, PtrTrade interface {
-	*Trade
-	AggregableUnmarshaler
-}](ctx context.Context, c *polygonws.Client, t jsonTranslator[PtrTrade], output chan<- PtrTrade, topic polygonws.Topic, subscriptions ...string) error {
+func applyRetention(ctx context.Context, store *db.SQL) {
+	stats, err := store.ApplyRetention(ctx, time.Now(), db.DefaultRetentionPolicies)
+	if err != nil {
+		logrus.WithError(err).Error("apply retention")
+	}
+
+	for _, s := range stats {
+		logrus.WithFields(logrus.Fields{
+			"barLength":   s.BarLength,
+			"cutoff":      s.Cutoff,
+			"downsampled": s.Downsampled,
+			"deleted":     s.Deleted,
+		}).Info("applied retention")
+	}
+}
+
+// consumerLoop translates the messages of a trades feed, and sends trades to the trades channel, and cancels and
+// corrections of earlier trades to the corrections channel.
+func consumerLoop[Trade any](ctx context.Context, c *polygonws.Client, translate feedTranslator[Trade], trades chan<- Trade, corrections chan<- tradeCorrection[Trade], topic polygonws.Topic, subscriptions ...string) error {
 	if err := c.Connect(); err != nil {
 		return fmt.Errorf("connect: %w", err)
 	}
@@ -94,36 +259,101 @@ func consumerLoop[Trade any, PtrTrade interface {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case output, ok := <-c.Output():
+		case msg, ok := <-c.Output():
 			if !ok {
 				return nil
 			}
 
-			trade := PtrTrade(new(Trade))
-			if err := trade.UnmarshalJSON([]byte(output.(json.RawMessage))); err != nil {
-				return fmt.Errorf("unmarshal trade: %w", err)
+			event, err := translate([]byte(msg.(json.RawMessage)))
+			if err != nil {
+				return fmt.Errorf("translate message: %w", err)
+			}
+
+			if err := dispatch(ctx, event, trades, corrections); err != nil {
+				return err
 			}
 		}
 	}
 }
 
-func dbLoop[Trade logic.Aggregable](ctx context.Context, store *db.NativeDB, updateLogic logic.UpdateLogic[Trade], input <-chan Trade, publishQueue *aggregateQueue) error {
+// dispatch sends a feed event to the channel of the loop that handles it.
+func dispatch[Trade any](ctx context.Context, event feedEvent[Trade], trades chan<- Trade, corrections chan<- tradeCorrection[Trade]) error {
+	if event.correction != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case corrections <- *event.correction:
+			return nil
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case trades <- event.trade:
+		return nil
+	}
+}
+
+func dbLoop[Trade logic.Aggregable](ctx context.Context, store db.DB[db.Tx], tradeStore db.TradeStore[Trade], updateLogic logic.UpdateLogic[Trade], tradeID func(Trade) db.TradeID, input <-chan Trade, publishQueue *publish.Queue) error {
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case trade := <-input:
-			ctx, cancel := context.WithTimeout(ctx, time.Millisecond*100)
-			defer cancel()
+			publishable, err := publishQueue.Observe(trade.GetTicker(), logic.TradeTimestamp(trade), barLength)
+			if err != nil {
+				logrus.WithError(err).Error("couldn't observe trade")
+				continue
+			}
+
+			tradeCtx, cancel := context.WithTimeout(ctx, time.Millisecond*100)
 			// Unfortunately, Go will not infer that db.Txn is our type parameter, so we have to be explicit.
-			aggregate, updated, err := logic.ProcessTrade[db.Tx](ctx, store, updateLogic, trade, barLength)
+			aggregate, updated, err := logic.ProcessStoredTrade[db.Tx](tradeCtx, store, tradeStore, updateLogic, trade, tradeID(trade), barLength)
+			cancel()
 			if err != nil {
 				logrus.WithError(err).Error("couldn't process trade")
 				continue
 			}
 
-			if updated {
-				publishQueue.enqueue(aggregate, barLength)
+			// bars that are already final aren't republished, although the stored bar includes the trade
+			if updated && publishable {
+				publishQueue.Enqueue(aggregate, barLength)
+			}
+		}
+	}
+}
+
+// tradeCorrection cancels the trade of a ticker with the given ID, or replaces it with correction unless cancel is set.
+type tradeCorrection[Trade any] struct {
+	ticker     string
+	id         db.TradeID
+	cancel     bool
+	correction Trade
+}
+
+func correctionLoop[Trade logic.Aggregable](ctx context.Context, store db.DB[db.Tx], tradeStore db.TradeStore[Trade], updateLogic logic.UpdateLogic[Trade], input <-chan tradeCorrection[Trade], publishQueue *publish.Queue) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case c := <-input:
+			correctionCtx, cancel := context.WithTimeout(ctx, time.Millisecond*100)
+			var aggregates []globals.Aggregate
+			var err error
+			if c.cancel {
+				aggregates, err = logic.CancelTrade[db.Tx](correctionCtx, store, tradeStore, updateLogic, c.ticker, c.id, barLength)
+			} else {
+				aggregates, err = logic.CorrectTrade[db.Tx](correctionCtx, store, tradeStore, updateLogic, c.id, c.correction, barLength)
+			}
+			cancel()
+			if err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{"ticker": c.ticker, "id": c.id}).Error("couldn't correct trade")
+				continue
+			}
+
+			for _, aggregate := range aggregates {
+				publishQueue.Enqueue(aggregate, barLength)
 			}
 		}
 	}
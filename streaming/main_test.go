@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/polygon-io/go-lib-models/v2/globals"
+	"github.com/stretchr/testify/require"
+	"github.com/suremarc/go-lib-aggregates/db"
+	"github.com/suremarc/go-lib-aggregates/logic"
+	"github.com/suremarc/go-lib-aggregates/publish"
+)
+
+func TestFeedCorrections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := time.Date(2022, 3, 14, 14, 0, 0, 0, time.UTC)
+	var now int64 = start.Add(90 * time.Second).UnixNano()
+	queue := publish.NewQueue(publish.WithClock(func() time.Time {
+		return time.Unix(0, atomic.LoadInt64(&now))
+	}))
+
+	store := db.NewNativeDB(false)
+	tradeStore := db.NewNativeTradeStore[*stocksFeedTrade]()
+	feedLogic := func(aggregate globals.Aggregate, state *logic.BarState, trade *stocksFeedTrade) globals.Aggregate {
+		return logic.StocksLogic(aggregate, state, trade.Trade)
+	}
+
+	trades := make(chan *stocksFeedTrade)
+	corrections := make(chan tradeCorrection[*stocksFeedTrade])
+	go dbLoop[*stocksFeedTrade](ctx, store, tradeStore, feedLogic, (*stocksFeedTrade).tradeID, trades, queue)
+	go correctionLoop[*stocksFeedTrade](ctx, store, tradeStore, feedLogic, corrections, queue)
+
+	send := func(msg string) {
+		event, err := stocksTranslator([]byte(msg))
+		require.NoError(t, err)
+		require.NoError(t, dispatch(ctx, event, trades, corrections))
+	}
+
+	// sweep collects publications until one satisfies cond
+	sweep := func(cond func(publish.Bar) bool) publish.Bar {
+		var found publish.Bar
+		require.Eventually(t, func() bool {
+			var ok bool
+			queue.Sweep(func(bar publish.Bar) {
+				if cond(bar) {
+					found, ok = bar, true
+				}
+			})
+			return ok
+		}, time.Second, time.Millisecond)
+		return found
+	}
+
+	ms := func(d time.Duration) int64 { return start.Add(d).UnixMilli() }
+	send(fmt.Sprintf(`{"ev":"T","sym":"PGON","i":"1","x":4,"p":10,"s":100,"t":%d,"q":1}`, ms(10*time.Second)))
+	send(fmt.Sprintf(`{"ev":"T","sym":"PGON","i":"2","x":4,"p":12,"s":100,"t":%d,"q":2}`, ms(20*time.Second)))
+	// the same ID on another exchange is another trade
+	send(fmt.Sprintf(`{"ev":"T","sym":"PGON","i":"2","x":12,"p":11,"s":100,"t":%d,"q":3}`, ms(30*time.Second)))
+
+	require.Eventually(t, func() bool {
+		_, _, ok, err := tradeStore.Get("PGON", db.TradeID{Exchange: 12, ID: "2"})
+		return ok && err == nil
+	}, time.Second, time.Millisecond)
+
+	// the bar becomes final once the clock is past its end by more than the maximum idle time
+	atomic.StoreInt64(&now, start.Add(2*time.Minute).UnixNano())
+
+	bar := sweep(func(publish.Bar) bool { return true })
+	require.True(t, bar.Final)
+	require.False(t, bar.Correction)
+	require.Equal(t, 12.0, bar.High)
+	require.Equal(t, 300.0, bar.Volume)
+
+	send(`{"ev":"TX","sym":"PGON","i":"2","x":4}`)
+	bar = sweep(func(bar publish.Bar) bool { return bar.Correction })
+	require.True(t, bar.Final)
+	require.Equal(t, 11.0, bar.High)
+	require.Equal(t, 10.0, bar.Open)
+	require.Equal(t, 200.0, bar.Volume)
+
+	send(fmt.Sprintf(`{"ev":"TC","sym":"PGON","i":"1","x":4,"p":9,"s":200,"t":%d,"q":1}`, ms(10*time.Second)))
+	bar = sweep(func(bar publish.Bar) bool { return bar.Correction })
+	require.Equal(t, 9.0, bar.Open)
+	require.Equal(t, 9.0, bar.Low)
+	require.Equal(t, 11.0, bar.Close)
+	require.Equal(t, 300.0, bar.Volume)
+}
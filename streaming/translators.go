@@ -5,11 +5,29 @@ import (
 
 	"github.com/polygon-io/go-lib-models/v2/currencies"
 	"github.com/polygon-io/go-lib-models/v2/stocks"
+	"github.com/suremarc/go-lib-aggregates/db"
 	"github.com/suremarc/go-lib-aggregates/logic"
 )
 
 type jsonTranslator[Output logic.Aggregable] func([]byte) (Output, error)
 
+// feedEvent is a message of a trades feed: either a trade, or the cancel or correction of an earlier trade.
+type feedEvent[Trade any] struct {
+	trade      Trade
+	correction *tradeCorrection[Trade]
+}
+
+// feedTranslator translates a message of a trades feed that also cancels and corrects trades.
+type feedTranslator[Trade any] func([]byte) (feedEvent[Trade], error)
+
+// Event types of the stocks trades feed. Cancels and corrections name the trade they apply to by its symbol, exchange,
+// trade reporting facility and ID, like a trade; a correction also carries the corrected trade, under the same ID.
+const (
+	stocksTradeEvent      = "T"
+	stocksCancelEvent     = "TX"
+	stocksCorrectionEvent = "TC"
+)
+
 type websocketTrade struct {
 	EventType      string  `json:"ev"`
 	Symbol         string  `json:"sym"`
@@ -21,6 +39,22 @@ type websocketTrade struct {
 	Timestamp      int     `json:"t,omitempty"`
 	SequenceNumber int64   `json:"q,omitempty"`
 	Tape           int     `json:"z,omitempty"`
+	TRF            int32   `json:"trfi,omitempty"`
+}
+
+// stocksFeedTrade is a stock trade from the feed, along with the ID of the trade reporting facility that reported it,
+// if it was off-exchange, which stocks.Trade doesn't hold. Trade IDs are only unique along with both.
+type stocksFeedTrade struct {
+	*stocks.Trade
+	trf int32
+}
+
+func (t *stocksFeedTrade) tradeID() db.TradeID {
+	return db.TradeID{Exchange: t.Exchange, TRF: t.trf, ID: t.ID}
+}
+
+func (w *websocketTrade) toStocksFeedTrade() *stocksFeedTrade {
+	return &stocksFeedTrade{Trade: w.toStocksTrade(), trf: w.TRF}
 }
 
 func (w *websocketTrade) toStocksTrade() *stocks.Trade {
@@ -39,15 +73,31 @@ func (w *websocketTrade) toStocksTrade() *stocks.Trade {
 	}
 }
 
-var _ jsonTranslator[*stocks.Trade] = stocksTranslator
+var _ feedTranslator[*stocksFeedTrade] = stocksTranslator
 
-func stocksTranslator(buf []byte) (*stocks.Trade, error) {
+func stocksTranslator(buf []byte) (feedEvent[*stocksFeedTrade], error) {
 	var t websocketTrade
 	if err := json.Unmarshal(buf, &t); err != nil {
-		return nil, err
+		return feedEvent[*stocksFeedTrade]{}, err
 	}
 
-	return t.toStocksTrade(), nil
+	trade := t.toStocksFeedTrade()
+	switch t.EventType {
+	case stocksCancelEvent:
+		return feedEvent[*stocksFeedTrade]{correction: &tradeCorrection[*stocksFeedTrade]{
+			ticker: t.Symbol,
+			id:     trade.tradeID(),
+			cancel: true,
+		}}, nil
+	case stocksCorrectionEvent:
+		return feedEvent[*stocksFeedTrade]{correction: &tradeCorrection[*stocksFeedTrade]{
+			ticker:     t.Symbol,
+			id:         trade.tradeID(),
+			correction: trade,
+		}}, nil
+	default:
+		return feedEvent[*stocksFeedTrade]{trade: trade}, nil
+	}
 }
 
 var _ jsonTranslator[*currencies.Trade] = currenciesTranslator
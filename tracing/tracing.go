@@ -0,0 +1,136 @@
+// Package tracing records spans of work, such as processing a trade or running a DB operation,
+// and hands them to a pluggable Exporter when they end.
+//
+// Spans are propagated through contexts: a span started from a context that carries a Tracer, or another span,
+// becomes a child of that span. Starting a span from a context without a Tracer is a cheap no-op.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// Exporter receives every span when it ends. It must be safe for concurrent use.
+type Exporter interface {
+	ExportSpan(SpanData)
+}
+
+// SpanData is a finished span.
+type SpanData struct {
+	Name     string    `json:"name"`
+	TraceID  uint64    `json:"traceId"`
+	SpanID   uint64    `json:"spanId"`
+	ParentID uint64    `json:"parentId,omitempty"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	// Attributes describe what the span worked on, e.g. its ticker, bar length and backend.
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Error is the message of the error the span ended with, if any.
+	Error string `json:"error,omitempty"`
+}
+
+func (s SpanData) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+type Tracer struct {
+	exporter Exporter
+}
+
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+type contextKey struct{}
+
+// contextValue is what a context carries: the tracer, and the current span, if any.
+type contextValue struct {
+	tracer *Tracer
+	span   *Span
+}
+
+// ContextWithTracer returns a context in which spans are recorded by the tracer.
+func ContextWithTracer(ctx context.Context, tracer *Tracer) context.Context {
+	return context.WithValue(ctx, contextKey{}, contextValue{tracer: tracer})
+}
+
+// Attribute is a key-value pair describing a span.
+type Attribute struct {
+	Key, Value string
+}
+
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Span is a span in progress. A nil *Span is valid, and does nothing.
+type Span struct {
+	tracer *Tracer
+	data   SpanData
+}
+
+// Start starts a span, as a child of the span in ctx if there is one, and returns a context carrying it.
+// If ctx carries no tracer, it returns ctx and a nil span.
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	v, ok := ctx.Value(contextKey{}).(contextValue)
+	if !ok || v.tracer == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer: v.tracer,
+		data: SpanData{
+			Name:    name,
+			TraceID: newID(),
+			SpanID:  newID(),
+			Start:   time.Now(),
+		},
+	}
+
+	if v.span != nil {
+		span.data.TraceID = v.span.data.TraceID
+		span.data.ParentID = v.span.data.SpanID
+	}
+
+	span.SetAttributes(attrs...)
+
+	return context.WithValue(ctx, contextKey{}, contextValue{tracer: v.tracer, span: span}), span
+}
+
+// SetAttributes adds attributes to the span, replacing any with the same key.
+// It must not be called concurrently with other methods of the span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil || len(attrs) == 0 {
+		return
+	}
+
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]string, len(attrs))
+	}
+
+	for _, attr := range attrs {
+		s.data.Attributes[attr.Key] = attr.Value
+	}
+}
+
+// End ends the span and exports it. err, if not nil, is recorded on the span.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	s.data.End = time.Now()
+	if err != nil {
+		s.data.Error = err.Error()
+	}
+
+	s.tracer.exporter.ExportSpan(s.data)
+}
+
+func newID() uint64 {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return binary.LittleEndian.Uint64(buf[:])
+}